@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Autoplay strategies, used to pick the next track when a lobby's queue is empty.
+const (
+	AUTOPLAY_OFF      = ""
+	AUTOPLAY_HISTORY  = "history"
+	AUTOPLAY_PLAYLIST = "playlist"
+	AUTOPLAY_GENRE    = "genre"
+)
+
+// The number of played tracks a lobby remembers.
+const HISTORY_SIZE = 50
+
+var errNoRecommendation = errors.New("no track to recommend")
+
+// RecommendationSource picks a track to play in a lobby whose queue has run dry.
+type RecommendationSource interface {
+	Next(l *Lobby) (*Track, error)
+}
+
+// recommendationSource returns the source for the provided autoplay strategy.
+func recommendationSource(strategy string) (RecommendationSource, error) {
+	switch strategy {
+	case AUTOPLAY_HISTORY:
+		return historySource{}, nil
+	case AUTOPLAY_PLAYLIST:
+		return playlistSource{}, nil
+	case AUTOPLAY_GENRE:
+		return genreSource{find: selectTrackByGenre}, nil
+	}
+	return nil, fmt.Errorf("unknown autoplay strategy %q", strategy)
+}
+
+// autoplayTrack returns a copy of the track marked as autoplayed, so the original is left untouched.
+func autoplayTrack(t *Track) *Track {
+	track := *t
+	track.Position = 0
+	track.Username = ""
+	track.Autoplayed = true
+	return &track
+}
+
+// historySource replays a random track from the lobby's history.
+type historySource struct{}
+
+func (historySource) Next(l *Lobby) (*Track, error) {
+	// Avoid replaying the track that just finished.
+	var candidates []*Track
+	for _, t := range l.History {
+		if l.CurrentTrack == nil || t.URI != l.CurrentTrack.URI {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNoRecommendation
+	}
+	return autoplayTrack(candidates[rand.Intn(len(candidates))]), nil
+}
+
+// playlistSource plays the lobby's fallback playlist in order, starting again when it reaches the end.
+type playlistSource struct{}
+
+func (playlistSource) Next(l *Lobby) (*Track, error) {
+	if len(l.FallbackPlaylist) == 0 {
+		return nil, errNoRecommendation
+	}
+	track := l.FallbackPlaylist[l.fallbackIndex%len(l.FallbackPlaylist)]
+	l.fallbackIndex = (l.fallbackIndex + 1) % len(l.FallbackPlaylist)
+	return autoplayTrack(track), nil
+}
+
+// genreSource plays a random track of the lobby's genre.
+type genreSource struct {
+	// Returns a random track of the genre, other than the excluded URI.
+	find func(genre string, excludeURI string) (*Track, error)
+}
+
+func (s genreSource) Next(l *Lobby) (*Track, error) {
+	var exclude string
+	if l.CurrentTrack != nil {
+		exclude = l.CurrentTrack.URI
+	}
+	track, err := s.find(l.Genre, exclude)
+	if err != nil {
+		return nil, err
+	}
+	return autoplayTrack(track), nil
+}
+
+// addToHistory records that the track was played, keeping only the most recent HISTORY_SIZE tracks.
+func (l *Lobby) addToHistory(track *Track) {
+	l.History = append(l.History, track)
+	if len(l.History) > HISTORY_SIZE {
+		l.History = l.History[len(l.History)-HISTORY_SIZE:]
+	}
+	l.persistPlay(track)
+}
+
+// nextAutoplayTrack returns the next track from the lobby's autoplay strategy, or nil if
+// autoplay is off or has nothing to play.
+func (l *Lobby) nextAutoplayTrack() *Track {
+	if l.Autoplay == AUTOPLAY_OFF {
+		return nil
+	}
+	source, err := recommendationSource(l.Autoplay)
+	if err != nil {
+		l.log().Error("Failed to get recommendation source", "error", err)
+		return nil
+	}
+	track, err := source.Next(l)
+	if err != nil {
+		l.log().Info("Autoplay found no track", "error", err)
+		return nil
+	}
+	return track
+}
+
+// setAutoplay changes the lobby's autoplay strategy and fallback playlist.
+// The fallback playlist is only replaced if one is provided.
+func (l *Lobby) setAutoplay(strategy string, fallback []*Track) error {
+	if strategy != AUTOPLAY_OFF {
+		if _, err := recommendationSource(strategy); err != nil {
+			return err
+		}
+	}
+	for _, t := range fallback {
+		if err := l.checkTrack(t); err != nil {
+			return fmt.Errorf("invalid fallback track: %s", err)
+		}
+	}
+	if strategy == AUTOPLAY_PLAYLIST && len(fallback) == 0 && len(l.FallbackPlaylist) == 0 {
+		return errors.New("a fallback playlist is needed for playlist autoplay")
+	}
+
+	l.Autoplay = strategy
+	if len(fallback) > 0 {
+		l.FallbackPlaylist = fallback
+		l.fallbackIndex = 0
+	}
+	l.persistAutoplayState()
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHistorySource_SkipsCurrentTrack(t *testing.T) {
+	current := &Track{URI: "a"}
+	l := Lobby{CurrentTrack: current, History: []*Track{{URI: "b"}, current}}
+
+	for i := 0; i < 10; i++ {
+		got, err := historySource{}.Next(&l)
+		if err != nil {
+			t.Fatalf("Next returned error: %s", err)
+		}
+		if got.URI != "b" || !got.Autoplayed {
+			t.Errorf("Next, got: %#v, want autoplayed track b", got)
+		}
+	}
+}
+
+func TestHistorySource_Empty(t *testing.T) {
+	l := Lobby{CurrentTrack: &Track{URI: "a"}, History: []*Track{{URI: "a"}}}
+	if _, err := (historySource{}).Next(&l); err != errNoRecommendation {
+		t.Errorf("Next with no other tracks, got: %v, want: %v", err, errNoRecommendation)
+	}
+}
+
+func TestPlaylistSource_Cycles(t *testing.T) {
+	l := Lobby{FallbackPlaylist: []*Track{{URI: "1"}, {URI: "2"}}}
+	var got []string
+	for i := 0; i < 3; i++ {
+		track, err := playlistSource{}.Next(&l)
+		if err != nil {
+			t.Fatalf("Next returned error: %s", err)
+		}
+		got = append(got, track.URI)
+	}
+	if got[0] != "1" || got[1] != "2" || got[2] != "1" {
+		t.Errorf("Playlist not played in order, got: %v", got)
+	}
+	if l.FallbackPlaylist[0].Autoplayed {
+		t.Errorf("Next modified the fallback playlist")
+	}
+}
+
+func TestGenreSource(t *testing.T) {
+	l := Lobby{Genre: "Rock", CurrentTrack: &Track{URI: "a"}}
+	var gotGenre, gotExclude string
+	s := genreSource{find: func(genre string, excludeURI string) (*Track, error) {
+		gotGenre, gotExclude = genre, excludeURI
+		return &Track{URI: "b"}, nil
+	}}
+
+	track, err := s.Next(&l)
+	if err != nil {
+		t.Fatalf("Next returned error: %s", err)
+	}
+	if gotGenre != "Rock" || gotExclude != "a" {
+		t.Errorf("Incorrect query, got genre: %q, exclude: %q", gotGenre, gotExclude)
+	}
+	if !track.Autoplayed {
+		t.Errorf("Genre track not marked as autoplayed")
+	}
+
+	s.find = func(string, string) (*Track, error) { return nil, errors.New("db down") }
+	if _, err := s.Next(&l); err == nil {
+		t.Errorf("Next did not return the find error")
+	}
+}
+
+func TestRecommendationSource_Unknown(t *testing.T) {
+	if _, err := recommendationSource("shuffle"); err == nil {
+		t.Errorf("recommendationSource did not return an error for an unknown strategy")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The number of recent chat messages a lobby remembers and sends to members who join.
+const CHAT_HISTORY_SIZE = 50
+
+// The longest chat message that can be sent, in characters.
+const MAX_CHAT_LENGTH = 500
+
+// Chat messages starting with this are commands rather than being sent to the lobby.
+const CHAT_COMMAND_PREFIX = "/"
+
+// The number of queued tracks listed by the /queue chat command.
+const CHAT_QUEUE_LISTED = 10
+
+// ChatMessage is a message sent by a member to the lobby.
+type ChatMessage struct {
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	// Time the message was sent in millis.
+	SentAt int64 `json:"sentAt"`
+}
+
+// chat sends the user's message to all members and adds it to the lobby's chat history.
+func (l *Lobby) chat(username string, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errors.New("chat message is empty")
+	}
+	if utf8.RuneCountInString(text) > MAX_CHAT_LENGTH {
+		return fmt.Errorf("chat messages are limited to %d characters", MAX_CHAT_LENGTH)
+	}
+
+	msg := ChatMessage{Username: username, Text: text, SentAt: NowMillis()}
+	l.addToChatHistory(msg)
+	l.persistChatMessage(msg)
+	l.sendUserMessage(username, "%s", text)
+	return nil
+}
+
+// addToChatHistory adds the message to the lobby's chat history, forgetting the oldest if it is full.
+// A new slice is made, as messages being sent may still reference the old one.
+func (l *Lobby) addToChatHistory(msg ChatMessage) {
+	start := 0
+	if len(l.ChatHistory) >= CHAT_HISTORY_SIZE {
+		start = len(l.ChatHistory) - CHAT_HISTORY_SIZE + 1
+	}
+	history := make([]ChatMessage, 0, CHAT_HISTORY_SIZE)
+	history = append(history, l.ChatHistory[start:]...)
+	l.ChatHistory = append(history, msg)
+}
+
+// sendChatHistory sends the lobby's recent chat messages to the client.
+func (l *Lobby) sendChatHistory(c *Client) {
+	if len(l.ChatHistory) == 0 {
+		return
+	}
+	if err := c.Send(Message{ChatHistory: l.ChatHistory}); err != nil {
+		l.log().Warn("Failed to send chat history", "username", c.Username, "error", err)
+	}
+}
+
+// isChatCommand returns true if the chat message is a command.
+func isChatCommand(text string) bool {
+	return strings.HasPrefix(text, CHAT_COMMAND_PREFIX)
+}
+
+// splitChatCommand returns the lower case name of a chat command and its arguments.
+func splitChatCommand(text string) (string, []string) {
+	fields := strings.Fields(strings.TrimPrefix(text, CHAT_COMMAND_PREFIX))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToLower(fields[0]), fields[1:]
+}
+
+// parseChatCommand converts a chat command into the message a client would send for it.
+func parseChatCommand(name string, args []string) (Message, error) {
+	target := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: /%s <user>", name)
+		}
+		return args[0], nil
+	}
+	switch name {
+	case "":
+		return Message{}, errors.New("no command given")
+	case "skip":
+		return Message{Command: Command(VOTE_SKIP)}, nil
+	case "promote":
+		user, err := target()
+		return Message{Command: Command(PROMOTE), Admin: user}, err
+	case "kick":
+		user, err := target()
+		return Message{Command: Command(KICK), Target: user}, err
+	}
+	return Message{}, fmt.Errorf("unknown command /%s", name)
+}
+
+// runChatCommand turns a chat command from a user into the command it stands for.
+// Commands that only show information are answered privately and leave no command to run.
+func (l *Lobby) runChatCommand(inMsg *Message) error {
+	name, args := splitChatCommand(inMsg.UserMsg)
+	inMsg.UserMsg = ""
+	switch name {
+	case "np":
+		l.sendPrivateMessage(inMsg.Username, "%s", l.nowPlaying())
+		return nil
+	case "queue":
+		l.sendPrivateMessage(inMsg.Username, "%s", l.queueSummary())
+		return nil
+	}
+
+	msg, err := parseChatCommand(name, args)
+	if err != nil {
+		return err
+	}
+	inMsg.Command = msg.Command
+	inMsg.Admin = msg.Admin
+	inMsg.Target = msg.Target
+	return nil
+}
+
+// nowPlaying describes the current track.
+func (l *Lobby) nowPlaying() string {
+	if l.CurrentTrack == nil {
+		return "Nothing is playing."
+	}
+	return fmt.Sprintf("Now playing: %s - %s", l.CurrentTrack.Name, l.CurrentTrack.Artist)
+}
+
+// queueSummary lists the next tracks in the queue.
+func (l *Lobby) queueSummary() string {
+	if l.TrackQueue.IsEmpty() {
+		return "The queue is empty."
+	}
+	lines := []string{fmt.Sprintf("%d track(s) queued:", len(l.TrackQueue))}
+	for i, track := range l.TrackQueue {
+		if i == CHAT_QUEUE_LISTED {
+			lines = append(lines, fmt.Sprintf("...and %d more.", len(l.TrackQueue)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s - %s", i+1, track.Name, track.Artist))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendPrivateMessage sends a server message to a single user.
+func (l *Lobby) sendPrivateMessage(username string, msg string, a ...interface{}) {
+	if c, ok := l.Clients[username]; ok {
+		c.Send(Message{UserMsg: fmt.Sprintf(msg, a...)})
+	}
+}
+
+// kick disconnects a member from the lobby. Only the admin can kick members.
+func (l *Lobby) kick(username string, target string) error {
+	if username != l.Admin {
+		return errors.New("only the admin can kick members")
+	}
+	if target == username {
+		return errors.New("you cannot kick yourself")
+	}
+	c, ok := l.Clients[target]
+	if !ok {
+		return fmt.Errorf("%s is not a lobby member", target)
+	}
+	l.sendServerMessageAndLog("%s was kicked by %s.", target, username)
+	// Closing the connection ends the client's reader, which disconnects it from the lobby.
+	c.Close()
+	return nil
+}
+
+// persistChatMessage asynchronously writes a chat message to the database.
+func (l *Lobby) persistChatMessage(msg ChatMessage) {
+	goPersist(func() {
+		if err := timePersist("chat", func() error { return insertChatMessage(l.ID, msg) }); err != nil {
+			l.log().Error("Failed to persist chat message", "error", err)
+			return
+		}
+		l.log().Debug("Chat message written to db")
+	})
+}
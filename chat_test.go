@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChatCommand(t *testing.T) {
+	testCases := []struct {
+		text    string
+		want    Message
+		wantErr bool
+	}{
+		{"/skip", Message{Command: Command(VOTE_SKIP)}, false},
+		{"/SKIP", Message{Command: Command(VOTE_SKIP)}, false},
+		{"/promote bob", Message{Command: Command(PROMOTE), Admin: "bob"}, false},
+		{"/kick bob", Message{Command: Command(KICK), Target: "bob"}, false},
+		{"/kick", Message{}, true},
+		{"/promote bob alice", Message{}, true},
+		{"/dance", Message{}, true},
+		{"/", Message{}, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseChatCommand(splitChatCommand(tc.text))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseChatCommand(%q) incorrect error, got: %v, want error: %t", tc.text, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && (got.Command != tc.want.Command || got.Admin != tc.want.Admin || got.Target != tc.want.Target) {
+			t.Errorf("parseChatCommand(%q), got: %s, want: %s", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestChat_RejectsLongMessages(t *testing.T) {
+	l := Lobby{}
+	if err := l.chat("a", strings.Repeat("x", MAX_CHAT_LENGTH+1)); err == nil {
+		t.Errorf("chat did not reject a message over the length limit")
+	}
+	if err := l.chat("a", "   "); err == nil {
+		t.Errorf("chat did not reject an empty message")
+	}
+	if len(l.ChatHistory) != 0 {
+		t.Errorf("Rejected messages added to the chat history, got: %v", l.ChatHistory)
+	}
+}
+
+func TestAddToChatHistory_Bounded(t *testing.T) {
+	l := Lobby{}
+	for i := 0; i < CHAT_HISTORY_SIZE+5; i++ {
+		l.addToChatHistory(ChatMessage{SentAt: int64(i)})
+	}
+	if len(l.ChatHistory) != CHAT_HISTORY_SIZE {
+		t.Fatalf("Incorrect chat history length, got: %d, want: %d", len(l.ChatHistory), CHAT_HISTORY_SIZE)
+	}
+	if l.ChatHistory[0].SentAt != 5 || l.ChatHistory[CHAT_HISTORY_SIZE-1].SentAt != CHAT_HISTORY_SIZE+4 {
+		t.Errorf("Oldest messages not forgotten, got first: %d, last: %d", l.ChatHistory[0].SentAt, l.ChatHistory[CHAT_HISTORY_SIZE-1].SentAt)
+	}
+}
+
+func TestQueueSummary(t *testing.T) {
+	l := Lobby{}
+	if got := l.queueSummary(); got != "The queue is empty." {
+		t.Errorf("Incorrect summary of an empty queue, got: %q", got)
+	}
+	for i := 0; i < CHAT_QUEUE_LISTED+2; i++ {
+		l.TrackQueue.Push(&Track{Name: "song", Artist: "artist"})
+	}
+	lines := strings.Split(l.queueSummary(), "\n")
+	if len(lines) != CHAT_QUEUE_LISTED+2 || lines[len(lines)-1] != "...and 2 more." {
+		t.Errorf("Incorrect queue summary, got: %v", lines)
+	}
+}
+
+func TestEnvelopesFromMessage_ChatHistory(t *testing.T) {
+	envelopes := envelopesFromMessage(Message{ChatHistory: []ChatMessage{{Username: "a", Text: "hi"}}})
+	if len(envelopes) != 1 || envelopes[0].Type != TYPE_CHAT_HISTORY {
+		t.Fatalf("Incorrect envelopes for chat history, got: %v", envelopes)
+	}
+	if payload := envelopes[0].Payload.(ChatHistoryPayload); len(payload.Messages) != 1 {
+		t.Errorf("Chat history not carried in the payload, got: %#v", payload)
+	}
+}
@@ -1,54 +1,355 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// The maximum number of messages that can be waiting to be written to a client.
+const OUTBOX_SIZE = 32
+
+var errOutboxFull = errors.New("outbox full")
+var errClientClosed = errors.New("client connection closed")
+var errLobbyStopped = errors.New("lobby stopped")
+
+// How long to wait for a close frame to be written before closing the connection anyway.
+const CLOSE_WRITE_TIMEOUT = time.Second
+
+// How long a spectator's state request may wait for the lobby before it is dropped.
+const SPECTATOR_STATE_TIMEOUT = 5 * time.Second
+
+// Transport carries a client's encoded messages, either a websocket or one of the HTTP fallbacks.
+// Lobby logic only deals with Clients, so it can't tell which transport a member uses.
+type Transport interface {
+	// Subprotocol returns the subprotocol choosing the codec messages are encoded with.
+	Subprotocol() string
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	// WriteControl writes a control message, such as a close frame, before the deadline.
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
+// JoinOptions are the settings chosen by a client when it joins a lobby.
+type JoinOptions struct {
+	// Wire protocol version negotiated for the client.
+	Protocol int
+	// If true, broadcasts carry diffs since the client's last acknowledged state
+	// version instead of the full lobby state.
+	StateDiffs bool
+	// If true, the client only listens, and isn't a member of the lobby.
+	Spectator bool
+}
+
 // Client represents a single user who is connected to the server.
 type Client struct {
-	Conn     *websocket.Conn
+	Conn     Transport
 	Username string
 	Lobby    *Lobby
 	Latency  int64
 	// Offset is the time in millis by which the app is ahead, negative meaning it is behind.
 	// Stored as int64 to avoid the need to cast when adding to message timestamp.
-	Offset    int64
-	sendMutex sync.Mutex
+	Offset int64
+	// Protocol is the wire protocol version negotiated when the client joined.
+	Protocol int
+	// Codec encodes messages in the format chosen through the websocket subprotocol.
+	Codec Codec
+	// StateDiffs is true if the client would rather receive state diffs than full state.
+	StateDiffs bool
+	// Spectator is true if the client only listens. Anything it sends other than a state acknowledgement is refused.
+	Spectator bool
+	// Latest state version the client has told us it applied.
+	// Read when broadcasting from timers, so accessed atomically.
+	ackedVersion uint64
+
+	// Outgoing messages are buffered in the outbox and written by writeOutgoingMessages,
+	// so that a slow connection never blocks the lobby.
+	sendMutex   sync.Mutex
+	outbox      []Message
+	outboxReady chan struct{}
+	closed      bool
+	done        chan struct{}
+	closeOnce   sync.Once
+	// Close frame written once the outbox is empty, set when the client is being closed after sending.
+	closeFrame []byte
 }
 
 // NewClient is a convenience method for initialising a Client.
-func NewClient(conn *websocket.Conn, username string, lobby *Lobby) Client {
-	client := Client{
-		Conn:     conn,
-		Username: username,
-		Lobby:    lobby,
+// It performs the clock handshake and then starts writing outgoing messages.
+func NewClient(conn Transport, username string, lobby *Lobby, opts JoinOptions) *Client {
+	client := &Client{
+		Conn:        conn,
+		Username:    username,
+		Lobby:       lobby,
+		Protocol:    opts.Protocol,
+		Codec:       codecForSubprotocol(conn.Subprotocol()),
+		StateDiffs:  opts.StateDiffs,
+		Spectator:   opts.Spectator,
+		outboxReady: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	client.log().Debug("Starting handshake")
+	if err := performClockHandshake(client); err != nil {
+		client.log().Warn("Failed to perform clock handshake", "error", err)
 	}
+	client.log().Info("Handshake complete", "latency", client.Latency, "offset", client.Offset)
 
-	client.log("Starting handshake")
-	if err := performClockHandshake(&client); err != nil {
-		log.Printf("Failed to perform clock handshake: %s", err)
+	// Confirm the negotiated version to clients that asked for one.
+	if client.Protocol >= PROTOCOL_V2 {
+		welcome := newEnvelope(TYPE_EVENT, EventPayload{Event: EVENT_WELCOME, Version: client.Protocol})
+		if err := client.writeFrame(welcome); err != nil {
+			client.log().Warn("Failed to send welcome", "error", err)
+		}
 	}
-	client.log("Handshake complete: latency: %d, offset:%d", client.Latency, client.Offset)
+
+	go client.writeOutgoingMessages()
 
 	return client
 }
 
-// Send sends a message to this client using their websocket.
+// Send queues a message to be sent to this client. It never blocks on the network.
+// If the outbox is full, stale state messages are coalesced to make room. If there is
+// still no room, state and chat messages are dropped, while anything carrying a command
+// or a reply causes the client to be disconnected, since it would otherwise fall out of sync.
 func (c *Client) Send(msg Message) error {
 	c.sendMutex.Lock()
 	defer c.sendMutex.Unlock()
 
+	if c.closed || c.closeFrame != nil {
+		sendFailures.WithLabelValues("closed").Inc()
+		return errClientClosed
+	}
+
+	if len(c.outbox) >= OUTBOX_SIZE {
+		c.coalesceStateMessages(isStateOnly(msg))
+	}
+	if len(c.outbox) >= OUTBOX_SIZE {
+		if msg.Command == 0 && msg.RequestID == "" {
+			sendFailures.WithLabelValues("dropped").Inc()
+			return fmt.Errorf("dropped message: %s", errOutboxFull)
+		}
+		sendFailures.WithLabelValues("disconnected").Inc()
+		go c.Close()
+		return fmt.Errorf("disconnecting client: %s", errOutboxFull)
+	}
+
+	c.outbox = append(c.outbox, msg)
+	messagesOut.WithLabelValues(outCommandLabel(msg)).Inc()
+	// Wake the writer if it isn't already awake.
+	select {
+	case c.outboxReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// coalesceStateMessages removes state messages from the outbox that have been superseded
+// by a later state message. If dropAll is true, a newer state message is about to be queued
+// so every pending state message is stale. Must be called with sendMutex held.
+func (c *Client) coalesceStateMessages(dropAll bool) {
+	last := -1
+	if !dropAll {
+		for i := len(c.outbox) - 1; i >= 0; i-- {
+			if isStateOnly(c.outbox[i]) {
+				last = i
+				break
+			}
+		}
+	}
+
+	kept := c.outbox[:0]
+	for i, msg := range c.outbox {
+		if isStateOnly(msg) && i != last {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	c.outbox = kept
+}
+
+// isStateOnly returns true if the message only carries lobby state, meaning
+// it is made redundant by any newer state message.
+func isStateOnly(msg Message) bool {
+	return msg.hasState && msg.Command == 0 && msg.UserMsg == "" && msg.RequestID == "" && msg.Error == ""
+}
+
+// nextOutgoing pops the oldest message from the outbox.
+func (c *Client) nextOutgoing() (Message, bool) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if len(c.outbox) == 0 {
+		return Message{}, false
+	}
+	msg := c.outbox[0]
+	c.outbox = c.outbox[1:]
+	return msg, true
+}
+
+// writeOutgoingMessages loops until the client is closed, writing any messages
+// in the outbox to the client's connection.
+// Should be called asynchronously.
+func (c *Client) writeOutgoingMessages() {
+	for {
+		select {
+		case <-c.outboxReady:
+		case <-c.done:
+			return
+		}
+
+		for {
+			msg, ok := c.nextOutgoing()
+			if !ok {
+				break
+			}
+			if err := c.write(msg); err != nil {
+				c.log().Warn("Failed to write message, closing connection", "error", err)
+				c.Close()
+				return
+			}
+		}
+
+		if frame := c.closeFrameIfSent(); frame != nil {
+			if err := c.Conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(CLOSE_WRITE_TIMEOUT)); err != nil {
+				c.log().Warn("Failed to write close frame", "error", err)
+			}
+			c.Close()
+			return
+		}
+	}
+}
+
+// closeFrameIfSent returns the close frame if the client is being closed after sending
+// and every queued message has been written, otherwise nil.
+func (c *Client) closeFrameIfSent() []byte {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if len(c.outbox) > 0 {
+		return nil
+	}
+	return c.closeFrame
+}
+
+// write writes a message directly to this client's connection, blocking until it is sent.
+// Only the handshake and writeOutgoingMessages should call this.
+func (c *Client) write(msg Message) error {
 	// Update the timestamp based on this client's offset.
 	if ServerCommand(msg.Command) != S_HANDSHAKE && msg.Timestamp != 0 {
-		c.log(fmt.Sprintf("Modifying outgoing timestamp %d by %d", msg.Timestamp, c.Offset))
+		c.log().Debug("Modifying outgoing timestamp", "timestamp", msg.Timestamp, "offset", c.Offset)
 		msg.Timestamp += c.Offset
 	}
-	c.log("Sending message: %s", msg)
-	return c.Conn.WriteJSON(msg)
+	c.log().Debug("Sending message", "msg", msg)
+
+	if c.Protocol < PROTOCOL_V2 {
+		return c.writeFrame(msg)
+	}
+	for _, env := range envelopesFromMessage(msg) {
+		if err := c.writeFrame(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFrame encodes v with the client's codec and writes it as a single message.
+func (c *Client) writeFrame(v interface{}) error {
+	data, err := c.Codec.Encode(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %s", err)
+	}
+	return c.Conn.WriteMessage(c.Codec.FrameType(), data)
+}
+
+// readFrame reads a single message and decodes it into v with the client's codec.
+// A *protocolError is returned if the message could not be decoded.
+func (c *Client) readFrame(v interface{}) error {
+	_, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if err := c.Codec.Decode(data, v); err != nil {
+		return &protocolError{fmt.Sprintf("malformed message: %s", err)}
+	}
+	return nil
+}
+
+// read reads a single message from this client's connection, converting it from the
+// client's protocol version. A *protocolError is returned if the message was read
+// but could not be understood.
+func (c *Client) read(msg *Message) error {
+	if c.Protocol < PROTOCOL_V2 {
+		return c.readFrame(msg)
+	}
+	env := Envelope{}
+	if err := c.readFrame(&env); err != nil {
+		return err
+	}
+	converted, err := messageFromEnvelope(c.Codec, env)
+	if err != nil {
+		return err
+	}
+	*msg = converted
+	return nil
+}
+
+// Close stops the writer and closes the client's connection. Any queued messages are discarded.
+// Closing the connection also causes ReadIncomingMessages to return.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.sendMutex.Lock()
+		c.closed = true
+		c.outbox = nil
+		c.sendMutex.Unlock()
+
+		if c.done != nil {
+			close(c.done)
+		}
+		if c.Conn != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+// CloseAfterSending stops accepting messages, then writes a close frame with the provided
+// code and text once the messages already queued have been written, and closes the connection.
+// Returns a channel that is closed once the connection has been closed.
+func (c *Client) CloseAfterSending(code int, text string) <-chan struct{} {
+	c.sendMutex.Lock()
+	if !c.closed {
+		c.closeFrame = websocket.FormatCloseMessage(code, text)
+	}
+	c.sendMutex.Unlock()
+
+	// Wake the writer so it sees the close frame, even if nothing is queued.
+	select {
+	case c.outboxReady <- struct{}{}:
+	default:
+	}
+	return c.done
+}
+
+// AckState records that the client has applied the provided state version.
+func (c *Client) AckState(version uint64) {
+	for {
+		acked := atomic.LoadUint64(&c.ackedVersion)
+		if version <= acked || atomic.CompareAndSwapUint64(&c.ackedVersion, acked, version) {
+			return
+		}
+	}
+}
+
+// AckedState returns the latest state version the client has applied.
+func (c *Client) AckedState() uint64 {
+	return atomic.LoadUint64(&c.ackedVersion)
 }
 
 // ReadIncomingMessages loops forever, reading incoming messages from this client's connection,
@@ -57,15 +358,81 @@ func (c *Client) Send(msg Message) error {
 func (c *Client) ReadIncomingMessages() error {
 	for {
 		msg := Message{}
-		if err := c.Conn.ReadJSON(&msg); err != nil {
+		if err := c.read(&msg); err != nil {
+			// The connection is still usable, so let the client know what went wrong.
+			if perr, ok := err.(*protocolError); ok {
+				c.log().Warn("Received invalid message", "error", perr)
+				c.Send(Message{Error: perr.Error()})
+				continue
+			}
 			return fmt.Errorf("failed to read message: %s", err)
 		}
 		msg.Username = c.Username
-		c.log("Received message: %s", msg)
-		c.Lobby.InMsgs <- msg
+		c.log().Debug("Received message", "msg", msg)
+		// Spectators aren't members, so their messages never reach the lobby.
+		if c.Spectator {
+			c.receiveAsSpectator(msg)
+			continue
+		}
+		// Tracks are looked up over the network here, rather than holding up the lobby.
+		resolveRemote(msg.CurrentTrack)
+		resolveRemote(msg.TrackQueue...)
+		if !c.Lobby.receive(msg) {
+			return errLobbyStopped
+		}
+	}
+}
+
+// receiveAsSpectator handles a message from a spectator, which can only make read-only requests.
+// State acknowledgements are recorded, state requests answered and late clock handshake replies
+// ignored. Anything that would change the lobby is refused.
+func (c *Client) receiveAsSpectator(msg Message) {
+	if msg.StateVersion != 0 {
+		c.AckState(msg.StateVersion)
+	}
+	if msg.UserMsg == "" {
+		switch ClientCommand(msg.Command) {
+		case 0, C_HANDSHAKE:
+			return
+		case STATE:
+			c.sendStateAsSpectator(msg.RequestID)
+			return
+		}
+	}
+	c.log().Debug("Refused message from spectator", "msg", msg)
+	c.Send(Message{Result: RESULT_REJECTED, Error: "spectators can't send commands", RequestID: msg.RequestID})
+}
+
+// sendStateAsSpectator sends a spectator a full snapshot of the lobby's state, as the lobby does for a
+// member's state request. It's read on the lobby goroutine, as spectators' messages never reach the lobby.
+func (c *Client) sendStateAsSpectator(requestID string) {
+	l := c.Lobby
+	ctx, cancel := context.WithTimeout(context.Background(), SPECTATOR_STATE_TIMEOUT)
+	defer cancel()
+	// Give up early if the client goes away while waiting.
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ok := l.do(ctx, func() {
+		stateMsg := Message{RequestID: requestID}
+		l.setStateMessageWithCommand(&stateMsg)
+		stateMsg.Seq = l.currentSeq()
+		c.Send(stateMsg)
+	})
+	if !ok {
+		c.log().Debug("Dropped spectator state request", "request", requestID)
 	}
 }
 
-func (c *Client) log(msg string, a ...interface{}) {
-	c.Lobby.log(fmt.Sprintf("%s: %s", c.Username, msg), a...)
+// log returns a logger that adds the lobby ID and username to each log.
+func (c *Client) log() *slog.Logger {
+	l := log()
+	if c.Lobby != nil {
+		l = c.Lobby.log()
+	}
+	return l.With("username", c.Username)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func fullOutboxClient(fill func(i int) Message) *Client {
+	c := &Client{Lobby: &Lobby{}}
+	for i := 0; i < OUTBOX_SIZE; i++ {
+		c.outbox = append(c.outbox, fill(i))
+	}
+	return c
+}
+
+func TestSend_QueuesMessage(t *testing.T) {
+	c := &Client{Lobby: &Lobby{}, outboxReady: make(chan struct{}, 1)}
+	if err := c.Send(Message{UserMsg: "hi"}); err != nil {
+		t.Fatalf("Send returned error: %s", err)
+	}
+	if len(c.outbox) != 1 {
+		t.Errorf("Send did not queue message, outbox length: %d", len(c.outbox))
+	}
+	select {
+	case <-c.outboxReady:
+	default:
+		t.Errorf("Send did not wake the writer")
+	}
+}
+
+func TestSend_CoalescesStateWhenFull(t *testing.T) {
+	suppressLogging()
+	// Alternate state messages and commands.
+	c := fullOutboxClient(func(i int) Message {
+		if i%2 == 0 {
+			return Message{Admin: "a", hasState: true}
+		}
+		return Message{Command: Command(PLAY)}
+	})
+
+	if err := c.Send(Message{Command: Command(PAUSE)}); err != nil {
+		t.Fatalf("Send returned error: %s", err)
+	}
+
+	var states int
+	for _, msg := range c.outbox {
+		if isStateOnly(msg) {
+			states++
+		}
+	}
+	if states != 1 {
+		t.Errorf("Incorrect number of state messages after coalescing, got: %d, want: 1", states)
+	}
+	if last := c.outbox[len(c.outbox)-1]; ServerCommand(last.Command) != PAUSE {
+		t.Errorf("New message not queued last, got: %s", last)
+	}
+}
+
+func TestSend_NewStateReplacesPendingState(t *testing.T) {
+	c := fullOutboxClient(func(i int) Message {
+		if i == 0 {
+			return Message{Admin: "old", hasState: true}
+		}
+		return Message{Command: Command(PLAY)}
+	})
+
+	if err := c.Send(Message{Admin: "new", hasState: true}); err != nil {
+		t.Fatalf("Send returned error: %s", err)
+	}
+	for _, msg := range c.outbox {
+		if msg.Admin == "old" {
+			t.Errorf("Stale state message was not coalesced")
+		}
+	}
+	if len(c.outbox) != OUTBOX_SIZE {
+		t.Errorf("Incorrect outbox length, got: %d, want: %d", len(c.outbox), OUTBOX_SIZE)
+	}
+}
+
+func TestSend_DropsChatWhenFull(t *testing.T) {
+	c := fullOutboxClient(func(i int) Message { return Message{Command: Command(PLAY)} })
+
+	if err := c.Send(Message{UserMsg: "hi"}); err == nil {
+		t.Errorf("Send did not return an error for a dropped message")
+	}
+	if c.closed {
+		t.Errorf("Client was closed for a droppable message")
+	}
+}
+
+func TestSend_DisconnectsWhenCommandCannotBeQueued(t *testing.T) {
+	c := fullOutboxClient(func(i int) Message { return Message{Command: Command(PLAY)} })
+	c.done = make(chan struct{})
+
+	if err := c.Send(Message{Command: Command(PAUSE)}); err == nil {
+		t.Errorf("Send did not return an error when the outbox was full")
+	}
+	// Close happens asynchronously.
+	<-c.done
+	if err := c.Send(Message{UserMsg: "hi"}); err != errClientClosed {
+		t.Errorf("Send after disconnect, got: %v, want: %v", err, errClientClosed)
+	}
+}
+
+func TestSend_DisconnectsWhenReplyCannotBeQueued(t *testing.T) {
+	c := fullOutboxClient(func(i int) Message { return Message{Command: Command(PLAY)} })
+	c.done = make(chan struct{})
+
+	if err := c.Send(Message{RequestID: "1", Result: RESULT_OK}); err == nil {
+		t.Errorf("Send did not return an error when the outbox was full")
+	}
+	<-c.done
+}
+
+func TestReceiveAsSpectator(t *testing.T) {
+	suppressLogging()
+	c := &Client{Lobby: &Lobby{}, Spectator: true, outboxReady: make(chan struct{}, 1)}
+
+	c.receiveAsSpectator(Message{StateVersion: 3})
+	if c.AckedState() != 3 {
+		t.Errorf("State acknowledgement not recorded, got: %d", c.AckedState())
+	}
+	if len(c.outbox) != 0 {
+		t.Errorf("Reply sent to state acknowledgement")
+	}
+
+	c.receiveAsSpectator(Message{Command: Command(C_HANDSHAKE), Timestamp: 1})
+	if len(c.outbox) != 0 {
+		t.Errorf("Reply sent to late handshake")
+	}
+
+	c.receiveAsSpectator(Message{Command: Command(VOTE_SKIP), RequestID: "1"})
+	msg, ok := c.nextOutgoing()
+	if !ok || msg.Result != RESULT_REJECTED || msg.RequestID != "1" {
+		t.Errorf("Command from spectator not refused, got: %v", msg)
+	}
+}
+
+func TestReceiveAsSpectator_State(t *testing.T) {
+	suppressLogging()
+	l := NewLobby("SPEC", "lobby", FREE_FOR_ALL, "", true, "")
+	l.Admin = "admin"
+	c := &Client{Lobby: l, Spectator: true, outboxReady: make(chan struct{}, 1)}
+
+	c.receiveAsSpectator(Message{Command: Command(STATE), RequestID: "2"})
+	msg, ok := c.nextOutgoing()
+	if !ok || !msg.FullState || msg.Admin != "admin" || msg.RequestID != "2" || msg.Result == RESULT_REJECTED {
+		t.Errorf("State not sent to spectator, got: %+v", msg)
+	}
+}
+
+func TestSendStateAsSpectator_ClientGone(t *testing.T) {
+	suppressLogging()
+	// A lobby that never runs its tasks, as when its goroutine is saturated.
+	l := &Lobby{tasks: make(chan func()), done: make(chan struct{})}
+	c := &Client{Lobby: l, Spectator: true, outboxReady: make(chan struct{}, 1), done: make(chan struct{})}
+	close(c.done)
+
+	returned := make(chan struct{})
+	go func() {
+		c.sendStateAsSpectator("3")
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("State request not dropped after the client went away")
+	}
+	if _, ok := c.nextOutgoing(); ok {
+		t.Error("State sent although the request was dropped")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How often a node records that it's alive, and how long after its last heartbeat it's treated as stopped.
+const (
+	NODE_HEARTBEAT = 5 * time.Second
+	NODE_TIMEOUT   = 3 * NODE_HEARTBEAT
+)
+
+// How long to wait for another node to list its lobbies.
+const PEER_TIMEOUT = 2 * time.Second
+
+// Sent to clients of a lobby another node has adopted before their connection is closed.
+const LOBBY_MOVED_NOTICE = "Lobby moved to another server, reconnect in a moment."
+
+// Set on requests proxied to the node a lobby is homed on, so they are never proxied again.
+const FORWARDED_HEADER = "X-Sync-Song-Forwarded-By"
+
+// The most attempts made to find a lobby ID that no node is using.
+const MAX_ID_ATTEMPTS = 10
+
+var errLobbyNotFound = errors.New("lobby not found")
+var errLobbyIDTaken = errors.New("lobby ID already taken")
+var errLobbyMoved = errors.New("lobby was adopted by another node")
+
+// Node is a server instance that lobbies are homed on.
+type Node struct {
+	ID string
+	// URL other nodes reach the node's HTTP server at.
+	Address string
+	// When the node last recorded that it's alive, in millis.
+	HeartbeatAt int64
+}
+
+// alive returns true if the node has recorded a heartbeat recently enough to still be serving its lobbies.
+func (n Node) alive() bool {
+	return n.ID != "" && n.HeartbeatAt >= NowMillis()-NODE_TIMEOUT.Milliseconds()
+}
+
+// Directory records the nodes sharing the database and which of them each lobby is homed on.
+// A lobby is homed on the node that created it, and is only served by that node.
+type Directory interface {
+	// Heartbeat records that the node is alive and reachable at its address.
+	Heartbeat(node Node) error
+	// Leave removes the node, so its lobbies can be adopted straight away.
+	Leave(nodeID string) error
+	// Nodes returns the nodes that are alive.
+	Nodes() ([]Node, error)
+	// Owner returns the node the lobby is homed on, or errLobbyNotFound if there is no such lobby.
+	// The node's ID is empty if the lobby has never been homed on one.
+	Owner(lobbyID string) (Node, error)
+	// Orphaned returns the lobbies homed on nodes that are no longer alive, or on no node,
+	// mapped to the node each is homed on.
+	Orphaned() (map[string]string, error)
+	// Adopt homes the lobby on the node if the node it's homed on is no longer alive.
+	// Returns false if that node is still alive, or another node adopted the lobby first.
+	Adopt(lobbyID string, nodeID string) (bool, error)
+}
+
+// This server's node. Lobbies are only shared with other nodes once it has an address.
+var self = Node{ID: defaultNodeID()}
+
+// The directory of lobby ownership. Replaced with the database's when this node has an address.
+var directory Directory = newMemoryDirectory()
+
+// defaultNodeID returns the host name, which is unique to each container.
+func defaultNodeID() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "local"
+}
+
+// clustered returns true if lobbies are shared with other nodes.
+func clustered() bool {
+	return self.Address != ""
+}
+
+// memoryDirectory is a Directory kept in process, used when lobbies aren't shared with other nodes.
+type memoryDirectory struct {
+	mu     sync.Mutex
+	nodes  map[string]Node
+	owners map[string]string
+}
+
+func newMemoryDirectory() *memoryDirectory {
+	return &memoryDirectory{nodes: make(map[string]Node), owners: make(map[string]string)}
+}
+
+// home records that the lobby is homed on the node.
+func (d *memoryDirectory) home(lobbyID string, nodeID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.owners[lobbyID] = nodeID
+}
+
+func (d *memoryDirectory) Heartbeat(node Node) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodes[node.ID] = node
+	return nil
+}
+
+func (d *memoryDirectory) Leave(nodeID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes, nodeID)
+	return nil
+}
+
+func (d *memoryDirectory) Nodes() ([]Node, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var nodes []Node
+	for _, n := range d.nodes {
+		if n.alive() {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+func (d *memoryDirectory) Owner(lobbyID string) (Node, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nodeID, ok := d.owners[lobbyID]
+	if !ok {
+		return Node{}, errLobbyNotFound
+	}
+	if n, ok := d.nodes[nodeID]; ok {
+		return n, nil
+	}
+	return Node{ID: nodeID}, nil
+}
+
+func (d *memoryDirectory) Orphaned() (map[string]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lobbies := make(map[string]string)
+	for lobbyID, nodeID := range d.owners {
+		if !d.nodes[nodeID].alive() {
+			lobbies[lobbyID] = nodeID
+		}
+	}
+	return lobbies, nil
+}
+
+func (d *memoryDirectory) Adopt(lobbyID string, nodeID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	owner, ok := d.owners[lobbyID]
+	if !ok {
+		return false, errLobbyNotFound
+	}
+	if d.nodes[owner].alive() {
+		return false, nil
+	}
+	d.owners[lobbyID] = nodeID
+	return true, nil
+}
+
+// joinCluster records that this node is alive, then keeps doing so until it shuts down.
+func joinCluster() error {
+	self.HeartbeatAt = NowMillis()
+	if err := directory.Heartbeat(self); err != nil {
+		return fmt.Errorf("failed to record node heartbeat: %s", err)
+	}
+	log().Info("Joined cluster", "node", self.ID, "address", self.Address)
+	go func() {
+		ticker := time.NewTicker(NODE_HEARTBEAT)
+		defer ticker.Stop()
+		for range ticker.C {
+			if isShuttingDown() {
+				return
+			}
+			node := self
+			node.HeartbeatAt = NowMillis()
+			if err := directory.Heartbeat(node); err != nil {
+				log().Error("Failed to record node heartbeat", "error", err)
+			}
+			releaseLostLobbies()
+		}
+	}()
+	return nil
+}
+
+// leaveCluster removes this node, so other nodes adopt its lobbies as soon as they are next requested.
+func leaveCluster() {
+	if err := directory.Leave(self.ID); err != nil {
+		log().Warn("Failed to leave cluster", "error", err)
+		return
+	}
+	log().Info("Left cluster", "node", self.ID)
+}
+
+// storeLobby inserts a new lobby under a random ID, returning the ID. IDs are only checked against
+// this node's lobbies before inserting, so another ID is tried if a different node's lobby has it.
+func storeLobby(l *Lobby, insert func(*Lobby) error) (string, error) {
+	for attempt := 0; attempt < MAX_ID_ATTEMPTS; attempt++ {
+		l.ID = UniqueLobbyID()
+		err := insert(l)
+		if err != errLobbyIDTaken {
+			return l.ID, err
+		}
+		log().Debug("Lobby ID taken by another node, retrying", "lobby", l.ID)
+	}
+	return "", fmt.Errorf("no unused lobby ID found after %d attempts", MAX_ID_ATTEMPTS)
+}
+
+// routeToOwner serves requests for a lobby that isn't on this node from the node it's homed on,
+// adopting the lobby if that node has stopped. Requests for lobbies on this node are served as usual.
+func routeToOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routeLobby(w, r, mux.Vars(r)["id"], next)
+	})
+}
+
+// routeLobby serves a request for the lobby with the provided ID, see routeToOwner.
+func routeLobby(w http.ResponseWriter, r *http.Request, id string, next http.Handler) {
+	if _, ok := getLobby(id); ok || id == "" || isShuttingDown() {
+		next.ServeHTTP(w, r)
+		return
+	}
+	owner, err := directory.Owner(id)
+	if err == errLobbyNotFound {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		log().Error("Failed to find lobby's node", "lobby", id, "error", err)
+		http.Error(w, "Failed to find lobby", http.StatusServiceUnavailable)
+		return
+	}
+
+	if owner.ID != self.ID && owner.alive() {
+		// A request that was already forwarded arrived at a node other than the lobby's.
+		if r.Header.Get(FORWARDED_HEADER) != "" {
+			http.Error(w, "Lobby is moving, try again", http.StatusServiceUnavailable)
+			return
+		}
+		proxyTo(owner, w, r)
+		return
+	}
+	if err := adoptLobby(id, owner); err != nil {
+		log().Warn("Failed to adopt lobby", "lobby", id, "from", owner.ID, "error", err)
+		http.Error(w, "Lobby is moving, try again", http.StatusServiceUnavailable)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// proxyTo forwards a request to the node, including websocket upgrades.
+func proxyTo(node Node, w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(node.Address)
+	if err != nil {
+		log().Error("Invalid node address", "node", node.ID, "address", node.Address, "error", err)
+		http.Error(w, "Failed to reach lobby", http.StatusBadGateway)
+		return
+	}
+	log().Debug("Proxying request to lobby's node", "path", r.URL.Path, "node", node.ID)
+	r.Header.Set(FORWARDED_HEADER, self.ID)
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+}
+
+// Held while adopting a lobby, so concurrent requests for it only load it once.
+var adoptMu sync.Mutex
+
+// loadAdopted loads an adopted lobby into the lobbies map. Replaced in tests.
+var loadAdopted = loadLobbyFromDB
+
+// adoptLobby homes a lobby on this node in place of the node it was homed on, then loads it from
+// the database, resuming its current track from where that node left it.
+func adoptLobby(id string, owner Node) error {
+	adoptMu.Lock()
+	defer adoptMu.Unlock()
+	if _, ok := getLobby(id); ok {
+		return nil
+	}
+	if owner.ID != self.ID {
+		adopted, err := directory.Adopt(id, self.ID)
+		if err != nil {
+			return err
+		}
+		if !adopted {
+			return errLobbyMoved
+		}
+	}
+	lobbies := make(map[string]*Lobby)
+	if err := loadAdopted(&lobbies, id); err != nil {
+		return fmt.Errorf("failed to load lobby: %s", err)
+	}
+	for _, l := range lobbies {
+		putLobby(l)
+	}
+	log().Info("Lobby adopted", "lobby", id, "from", owner.ID)
+	return nil
+}
+
+// releaseLostLobbies drops the lobbies on this node that another node has adopted, which happens if this
+// node missed its heartbeats while still running. Their clients reconnect, and are routed to the adopting node.
+func releaseLostLobbies() {
+	adoptMu.Lock()
+	defer adoptMu.Unlock()
+	for id, l := range lobbySnapshot() {
+		owner, err := directory.Owner(id)
+		if err != nil {
+			log().Warn("Failed to check lobby's node", "lobby", id, "error", err)
+			continue
+		}
+		if owner.ID == self.ID {
+			continue
+		}
+		log().Warn("Lobby adopted by another node, releasing it", "lobby", id, "node", owner.ID)
+		deleteLobby(id)
+		l.release()
+	}
+}
+
+// release closes the lobby's clients' connections on the lobby goroutine, telling them to reconnect,
+// then stops the lobby. Nothing more is written, as the lobby is now served by another node.
+func (l *Lobby) release() {
+	go l.do(context.Background(), func() {
+		l.closeClients(LOBBY_MOVED_NOTICE)
+		l.stop()
+	})
+}
+
+// adoptOrphanedLobbies adopts the lobbies whose node has stopped, so they are listed with the others
+// rather than only once someone requests them.
+func adoptOrphanedLobbies() {
+	orphaned, err := directory.Orphaned()
+	if err != nil {
+		log().Error("Failed to list orphaned lobbies", "error", err)
+		return
+	}
+	for id, nodeID := range orphaned {
+		// Another node listing lobbies may adopt it first, in which case that node lists it.
+		if err := adoptLobby(id, Node{ID: nodeID}); err != nil && err != errLobbyMoved {
+			log().Warn("Failed to adopt lobby", "lobby", id, "from", nodeID, "error", err)
+		}
+	}
+}
+
+// peerLobbies returns the lobbies homed on the other nodes that are alive, encoded as each node listed them.
+// Nodes that can't be reached are left out.
+func peerLobbies() map[string]json.RawMessage {
+	lobbies := make(map[string]json.RawMessage)
+	nodes, err := directory.Nodes()
+	if err != nil {
+		log().Error("Failed to list nodes", "error", err)
+		return lobbies
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		if n.ID == self.ID {
+			continue
+		}
+		wg.Add(1)
+		go func(n Node) {
+			defer wg.Done()
+			nodeLobbies, err := fetchLobbies(n)
+			if err != nil {
+				log().Warn("Failed to list node's lobbies", "node", n.ID, "error", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for id, l := range nodeLobbies {
+				lobbies[id] = l
+			}
+		}(n)
+	}
+	wg.Wait()
+	return lobbies
+}
+
+// fetchLobbies returns the lobbies homed on the node.
+func fetchLobbies(n Node) (map[string]json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", n.Address+"/lobbies?local=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(FORWARDED_HEADER, self.ID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	lobbies := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(resp.Body).Decode(&lobbies); err != nil {
+		return nil, fmt.Errorf("failed to decode lobbies: %s", err)
+	}
+	return lobbies, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNodeAlive(t *testing.T) {
+	testCases := []struct {
+		name string
+		node Node
+		want bool
+	}{
+		{"recent heartbeat", Node{ID: "a", HeartbeatAt: NowMillis()}, true},
+		{"expired heartbeat", Node{ID: "a", HeartbeatAt: NowMillis() - NODE_TIMEOUT.Milliseconds() - 1}, false},
+		{"no node", Node{HeartbeatAt: NowMillis()}, false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.node.alive(); got != tc.want {
+			t.Errorf("%s: got: %t, want: %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryDirectory_Adopt(t *testing.T) {
+	d := newMemoryDirectory()
+	d.Heartbeat(Node{ID: "alive", HeartbeatAt: NowMillis()})
+	d.Heartbeat(Node{ID: "stopped", HeartbeatAt: 0})
+	d.home("AAAA", "alive")
+	d.home("BBBB", "stopped")
+	d.home("CCCC", "")
+
+	if adopted, _ := d.Adopt("AAAA", "me"); adopted {
+		t.Errorf("Lobby adopted from a node that is alive")
+	}
+	for _, id := range []string{"BBBB", "CCCC"} {
+		if adopted, _ := d.Adopt(id, "me"); !adopted {
+			t.Errorf("Lobby %s not adopted", id)
+		}
+		if owner, _ := d.Owner(id); owner.ID != "me" {
+			t.Errorf("Lobby %s not homed on adopting node, got: %s", id, owner.ID)
+		}
+	}
+	if _, err := d.Adopt("DDDD", "me"); err != errLobbyNotFound {
+		t.Errorf("Adopting missing lobby, got: %v, want: %v", err, errLobbyNotFound)
+	}
+	if nodes, _ := d.Nodes(); len(nodes) != 1 || nodes[0].ID != "alive" {
+		t.Errorf("Incorrect nodes, got: %v", nodes)
+	}
+}
+
+func TestStoreLobby(t *testing.T) {
+	suppressLogging()
+	attempts := 0
+	insert := func(l *Lobby) error {
+		attempts++
+		if attempts < 3 {
+			return errLobbyIDTaken
+		}
+		return nil
+	}
+	id, err := storeLobby(&Lobby{}, insert)
+	if err != nil || len(id) != ID_LENGTH || attempts != 3 {
+		t.Errorf("Taken IDs not retried, got id: %q, error: %v, attempts: %d", id, err, attempts)
+	}
+
+	failure := errors.New("failed")
+	if _, err := storeLobby(&Lobby{}, func(l *Lobby) error { return failure }); err != failure {
+		t.Errorf("Insert error not returned, got: %v", err)
+	}
+	if _, err := storeLobby(&Lobby{}, func(l *Lobby) error { return errLobbyIDTaken }); err == nil {
+		t.Errorf("No error returned when every ID is taken")
+	}
+}
+
+func TestRouteLobby(t *testing.T) {
+	suppressLogging()
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("peer " + r.Header.Get(FORWARDED_HEADER)))
+	}))
+	defer peer.Close()
+
+	d := newMemoryDirectory()
+	d.Heartbeat(Node{ID: "peer", Address: peer.URL, HeartbeatAt: NowMillis()})
+	d.Heartbeat(Node{ID: "stopped", Address: "http://stopped", HeartbeatAt: 0})
+	d.home("PEER", "peer")
+	d.home("STOP", "stopped")
+	d.home("HERE", self.ID)
+
+	defer func(original Directory) { directory = original }(directory)
+	directory = d
+	defer func() { loadAdopted = loadLobbyFromDB }()
+	loadAdopted = func(lobbies *map[string]*Lobby, id string) error {
+		(*lobbies)[id] = &Lobby{ID: id}
+		return nil
+	}
+	defer func() { Lobbies = make(map[string]*Lobby) }()
+	Lobbies = map[string]*Lobby{"LOCL": {ID: "LOCL"}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local"))
+	})
+
+	testCases := []struct {
+		name      string
+		id        string
+		forwarded bool
+		wantCode  int
+		wantBody  string
+	}{
+		{"on this node", "LOCL", false, http.StatusOK, "local"},
+		{"no lobby", "NONE", false, http.StatusOK, "local"},
+		{"on another node", "PEER", false, http.StatusOK, "peer " + self.ID},
+		{"forwarded again", "PEER", true, http.StatusServiceUnavailable, ""},
+		{"node stopped", "STOP", false, http.StatusOK, "local"},
+		{"homed here but not loaded", "HERE", false, http.StatusOK, "local"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/lobbies/"+tc.id, nil)
+		if tc.forwarded {
+			r.Header.Set(FORWARDED_HEADER, "other")
+		}
+		rec := httptest.NewRecorder()
+		routeLobby(rec, r, tc.id, next)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%s: incorrect code, got: %d, want: %d", tc.name, rec.Code, tc.wantCode)
+		}
+		if tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+			t.Errorf("%s: incorrect body, got: %q, want: %q", tc.name, rec.Body.String(), tc.wantBody)
+		}
+	}
+
+	for _, id := range []string{"STOP", "HERE"} {
+		if _, ok := Lobbies[id]; !ok {
+			t.Errorf("Lobby %s not loaded", id)
+		}
+	}
+	if owner, _ := d.Owner("STOP"); owner.ID != self.ID {
+		t.Errorf("Stopped node's lobby not adopted, homed on: %s", owner.ID)
+	}
+}
+
+func TestReleaseLostLobbies(t *testing.T) {
+	suppressLogging()
+	d := newMemoryDirectory()
+	d.Heartbeat(Node{ID: "other", HeartbeatAt: NowMillis()})
+	d.home("MINE", self.ID)
+	d.home("LOST", "other")
+
+	defer func(original Directory) { directory = original }(directory)
+	directory = d
+	defer func() { Lobbies = make(map[string]*Lobby) }()
+	lost := NewLobby("LOST", "lobby", FREE_FOR_ALL, "", true, "")
+	Lobbies = map[string]*Lobby{"MINE": {ID: "MINE"}, "LOST": lost}
+
+	releaseLostLobbies()
+	if _, ok := Lobbies["LOST"]; ok {
+		t.Errorf("Lobby adopted by another node not released")
+	}
+	select {
+	case <-lost.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Released lobby not stopped")
+	}
+	if !lost.isStopped() || lost.receive(Message{}) {
+		t.Errorf("Released lobby still playing or receiving messages")
+	}
+	if _, ok := Lobbies["MINE"]; !ok {
+		t.Errorf("Lobby homed on this node released")
+	}
+}
+
+func TestAdoptOrphanedLobbies(t *testing.T) {
+	suppressLogging()
+	d := newMemoryDirectory()
+	d.Heartbeat(Node{ID: "alive", HeartbeatAt: NowMillis()})
+	d.Heartbeat(Node{ID: "stopped", HeartbeatAt: 0})
+	d.home("ALIV", "alive")
+	d.home("STOP", "stopped")
+	d.home("NONE", "")
+
+	defer func(original Directory) { directory = original }(directory)
+	directory = d
+	defer func() { loadAdopted = loadLobbyFromDB }()
+	loadAdopted = func(lobbies *map[string]*Lobby, id string) error {
+		(*lobbies)[id] = &Lobby{ID: id}
+		return nil
+	}
+	defer func() { Lobbies = make(map[string]*Lobby) }()
+	Lobbies = make(map[string]*Lobby)
+
+	adoptOrphanedLobbies()
+	if len(Lobbies) != 2 || Lobbies["STOP"] == nil || Lobbies["NONE"] == nil {
+		t.Errorf("Orphaned lobbies not adopted, got: %v", Lobbies)
+	}
+	if owner, _ := d.Owner("ALIV"); owner.ID != "alive" {
+		t.Errorf("Lobby of node that is alive adopted, homed on: %s", owner.ID)
+	}
+}
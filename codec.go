@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Websocket subprotocols a client can request to choose how messages are encoded.
+// Clients that don't request one use JSON.
+const (
+	SUBPROTOCOL_JSON    = "syncsong.json"
+	SUBPROTOCOL_MSGPACK = "syncsong.msgpack"
+	SUBPROTOCOL_CBOR    = "syncsong.cbor"
+)
+
+// Codec encodes and decodes messages sent over a client's websocket.
+// Lobby logic only deals with Messages, so it doesn't need to know which codec a client uses.
+type Codec interface {
+	// Subprotocol returns the websocket subprotocol that selects this codec.
+	Subprotocol() string
+	// FrameType returns the websocket message type used for encoded messages.
+	FrameType() int
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+// Codecs in order of preference, used when a client offers more than one subprotocol.
+var codecs = []Codec{
+	binaryCodec{SUBPROTOCOL_MSGPACK, &codec.MsgpackHandle{}},
+	binaryCodec{SUBPROTOCOL_CBOR, &codec.CborHandle{}},
+	jsonCodec{},
+}
+
+// codecSubprotocols returns the subprotocols of all supported codecs.
+func codecSubprotocols() []string {
+	var subprotocols []string
+	for _, c := range codecs {
+		subprotocols = append(subprotocols, c.Subprotocol())
+	}
+	return subprotocols
+}
+
+// codecForSubprotocol returns the codec selected by the provided subprotocol, defaulting to JSON.
+func codecForSubprotocol(subprotocol string) Codec {
+	for _, c := range codecs {
+		if c.Subprotocol() == subprotocol {
+			return c
+		}
+	}
+	return jsonCodec{}
+}
+
+// jsonCodec encodes messages as JSON text frames.
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return SUBPROTOCOL_JSON
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// binaryCodec encodes messages as binary frames using one of the compact formats.
+// Field names are taken from the json struct tags, so they match the JSON encoding.
+type binaryCodec struct {
+	subprotocol string
+	handle      codec.Handle
+}
+
+func (c binaryCodec) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (binaryCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (c binaryCodec) Encode(v interface{}) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, c.handle).Encode(v)
+	return data, err
+}
+
+func (c binaryCodec) Decode(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, c.handle).Decode(v)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCodecForSubprotocol(t *testing.T) {
+	testCases := []struct {
+		subprotocol string
+		want        string
+	}{
+		{SUBPROTOCOL_MSGPACK, SUBPROTOCOL_MSGPACK},
+		{SUBPROTOCOL_CBOR, SUBPROTOCOL_CBOR},
+		{SUBPROTOCOL_JSON, SUBPROTOCOL_JSON},
+		// Clients that don't negotiate a subprotocol use JSON.
+		{"", SUBPROTOCOL_JSON},
+	}
+
+	for _, tc := range testCases {
+		got := codecForSubprotocol(tc.subprotocol).Subprotocol()
+		if got != tc.want {
+			t.Errorf("codecForSubprotocol(%q), got: %q, want: %q", tc.subprotocol, got, tc.want)
+		}
+	}
+}
+
+func TestCodecs_RoundTripMessage(t *testing.T) {
+	want := Message{
+		Username:     "a",
+		CurrentTrack: &Track{URI: "spotify:track:1", Name: "song", Duration: 1000},
+		ClientNames:  []string{"a", "b"},
+		Command:      Command(PLAY),
+		Timestamp:    123,
+	}
+
+	for _, c := range codecs {
+		data, err := c.Encode(want)
+		if err != nil {
+			t.Fatalf("%s: Encode returned error: %s", c.Subprotocol(), err)
+		}
+		got := Message{}
+		if err := c.Decode(data, &got); err != nil {
+			t.Fatalf("%s: Decode returned error: %s", c.Subprotocol(), err)
+		}
+		if got.Username != want.Username || got.Command != want.Command || got.Timestamp != want.Timestamp ||
+			len(got.ClientNames) != 2 || got.CurrentTrack == nil || *got.CurrentTrack != *want.CurrentTrack {
+			t.Errorf("%s: round trip, got: %s, want: %s", c.Subprotocol(), got, want)
+		}
+	}
+}
+
+func TestCodecs_DecodeEnvelopePayload(t *testing.T) {
+	for _, c := range codecs {
+		data, err := c.Encode(newEnvelope(TYPE_COMMAND, CommandPayload{Command: "ADD_SONG", Track: &Track{URI: "x"}}))
+		if err != nil {
+			t.Fatalf("%s: Encode returned error: %s", c.Subprotocol(), err)
+		}
+		env := Envelope{}
+		if err := c.Decode(data, &env); err != nil {
+			t.Fatalf("%s: Decode returned error: %s", c.Subprotocol(), err)
+		}
+		msg, err := messageFromEnvelope(c, env)
+		if err != nil {
+			t.Fatalf("%s: messageFromEnvelope returned error: %s", c.Subprotocol(), err)
+		}
+		if ClientCommand(msg.Command) != ADD_SONG || msg.CurrentTrack == nil || msg.CurrentTrack.URI != "x" {
+			t.Errorf("%s: incorrect message from envelope, got: %s", c.Subprotocol(), msg)
+		}
+	}
+}
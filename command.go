@@ -10,6 +10,15 @@ const (
 	VOTE_SKIP
 	PROMOTE
 	STATE
+	SET_AUTOPLAY
+	IMPORT
+	UPVOTE
+	DOWNVOTE
+	JOIN_WAITLIST
+	LEAVE_WAITLIST
+	VOTE_PASS_DJ
+	KICK
+	REACT
 )
 
 type ServerCommand Command
@@ -24,3 +33,56 @@ const (
 	SEEK_RELATIVE
 	QUEUE
 )
+
+// Names used for commands in version 2 of the protocol onwards.
+var clientCommandNames = map[ClientCommand]string{
+	C_HANDSHAKE:    "HANDSHAKE",
+	ADD_SONG:       "ADD_SONG",
+	VOTE_SKIP:      "VOTE_SKIP",
+	PROMOTE:        "PROMOTE",
+	STATE:          "STATE",
+	SET_AUTOPLAY:   "SET_AUTOPLAY",
+	IMPORT:         "IMPORT",
+	UPVOTE:         "UPVOTE",
+	DOWNVOTE:       "DOWNVOTE",
+	JOIN_WAITLIST:  "JOIN_WAITLIST",
+	LEAVE_WAITLIST: "LEAVE_WAITLIST",
+	VOTE_PASS_DJ:   "VOTE_PASS_DJ",
+	KICK:           "KICK",
+	REACT:          "REACT",
+}
+
+var serverCommandNames = map[ServerCommand]string{
+	S_HANDSHAKE:   "HANDSHAKE",
+	PLAY:          "PLAY",
+	PAUSE:         "PAUSE",
+	RESUME:        "RESUME",
+	SKIP:          "SKIP",
+	SEEK_TO:       "SEEK_TO",
+	SEEK_RELATIVE: "SEEK_RELATIVE",
+	QUEUE:         "QUEUE",
+}
+
+func (c ClientCommand) String() string {
+	if name, ok := clientCommandNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+func (c ServerCommand) String() string {
+	if name, ok := serverCommandNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// parseClientCommand returns the client command with the provided name.
+func parseClientCommand(name string) (ClientCommand, bool) {
+	for command, n := range clientCommandNames {
+		if n == name {
+			return command, true
+		}
+	}
+	return 0, false
+}
@@ -13,6 +13,15 @@ func TestClientCommands_CorrectOrdinals(t *testing.T) {
 		{VOTE_SKIP, "VOTE_SKIP", 3},
 		{PROMOTE, "PROMOTE", 4},
 		{STATE, "STATE", 5},
+		{SET_AUTOPLAY, "SET_AUTOPLAY", 6},
+		{IMPORT, "IMPORT", 7},
+		{UPVOTE, "UPVOTE", 8},
+		{DOWNVOTE, "DOWNVOTE", 9},
+		{JOIN_WAITLIST, "JOIN_WAITLIST", 10},
+		{LEAVE_WAITLIST, "LEAVE_WAITLIST", 11},
+		{VOTE_PASS_DJ, "VOTE_PASS_DJ", 12},
+		{KICK, "KICK", 13},
+		{REACT, "REACT", 14},
 	}
 
 	for _, tc := range testCases {
@@ -46,3 +55,18 @@ func TestServerCommands_CorrectOrdinals(t *testing.T) {
 		}
 	}
 }
+
+func TestParseClientCommand_RoundTrips(t *testing.T) {
+	for command, name := range clientCommandNames {
+		got, ok := parseClientCommand(command.String())
+		if !ok || got != command {
+			t.Errorf("parseClientCommand(%q), got: %d, %t, want: %d, true", name, got, ok, command)
+		}
+	}
+}
+
+func TestParseClientCommand_Unknown(t *testing.T) {
+	if _, ok := parseClientCommand("PLAY"); ok {
+		t.Errorf("parseClientCommand accepted a server command")
+	}
+}
@@ -1,26 +1,102 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
 )
 
-// dbConn returns a connection to the database.
+var errPlaylistNotFound = errors.New("playlist not found")
+
+// The database handle shared by the whole server, which pools its connections.
+var sharedDB struct {
+	sync.Mutex
+	db *sql.DB
+}
+
+// dbConn returns the database handle, opening it the first time it is needed.
+// The handle is shared, so it must not be closed.
 func dbConn() (*sql.DB, error) {
-    db, err := sql.Open("mysql", "root:sspassword@tcp(mysql:3306)/syncsong")
+	sharedDB.Lock()
+	defer sharedDB.Unlock()
+	if sharedDB.db == nil {
+		db, err := sql.Open(DB_DRIVER, "root:sspassword@tcp(mysql:3306)/syncsong")
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to database: %s", err)
+		}
+		sharedDB.db = db
+	}
+	return sharedDB.db, nil
+}
+
+// MySQL's error number for a row that would duplicate a unique key.
+const ER_DUP_ENTRY = 1062
+
+// MySQL's error numbers for a transaction that was rolled back to resolve a deadlock, or timed out waiting for a lock.
+const (
+	ER_LOCK_DEADLOCK     = 1213
+	ER_LOCK_WAIT_TIMEOUT = 1205
+)
+
+// isRetryable returns true if the error is from a lost connection or a lock conflict,
+// so the same write may succeed if it is tried again.
+func isRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == ER_LOCK_DEADLOCK || mysqlErr.Number == ER_LOCK_WAIT_TIMEOUT
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr)
+}
+
+// isDuplicateKey returns true if the error is from writing a row that would duplicate a unique key.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == ER_DUP_ENTRY
+}
+
+// pingDB returns an error if the database can't be reached.
+func pingDB() error {
+	db, err := dbConn()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %s", err)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DB_PING_TIMEOUT)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %s", err)
+	}
+	return nil
+}
+
+// loadFromDB loads the lobbies homed on the node into the map, or every lobby if the node is empty.
+func loadFromDB(lobbies *map[string]*Lobby, node string) error {
+	if node == "" {
+		return loadLobbiesWhere(lobbies, "true")
 	}
-	return db, nil
+	return loadLobbiesWhere(lobbies, "node=?", node)
+}
+
+// loadLobbyFromDB loads a single lobby into the map.
+func loadLobbyFromDB(lobbies *map[string]*Lobby, id string) error {
+	return loadLobbiesWhere(lobbies, "id=?", id)
 }
 
-func loadFromDB(lobbies *map[string]*Lobby) error {
+// loadLobbiesWhere loads the lobbies matching the condition into the map.
+func loadLobbiesWhere(lobbies *map[string]*Lobby, condition string, args ...interface{}) error {
 	db, err := dbConn()
 	if err != nil {
 		return fmt.Errorf("failed to connect to db: %s", err)
 	}
 
-	lobbyRows, err := db.Query("select id, name, mode, genre, public, currentUri from lobby")
+	lobbyRows, err := db.Query("select id, name, mode, genre, public, providers, autoplay, maxQueueLength, maxPerUser, repeatWindow, maxDuration, allowDuplicates, djTracksPerTurn, djMinutesPerTurn, currentUri, trackStartedAt, position from lobby where "+condition, args...)
 	if err != nil {
 		return fmt.Errorf("failed to query lobbies: %s", err)
 	}
@@ -33,40 +109,79 @@ func loadFromDB(lobbies *map[string]*Lobby) error {
 		var mode int
 		var genre string
 		var public bool
+		var lobbyProviders string
+		var autoplay string
+		var rules QueueRules
+		var rotation DJRotation
+		var provider string
 		var uri sql.NullString
 		var artist string
 		var duration int64
 		var currentTrack *Track
+		var startedAt int64
+		var position int64
 
-		if err := lobbyRows.Scan(&id, &lobbyName, &mode, &genre, &public, &uri); err != nil {
+		if err := lobbyRows.Scan(&id, &lobbyName, &mode, &genre, &public, &lobbyProviders, &autoplay,
+			&rules.MaxQueueLength, &rules.MaxPerUser, &rules.RepeatWindow, &rules.MaxDuration, &rules.AllowDuplicates,
+			&rotation.TracksPerTurn, &rotation.MinutesPerTurn, &uri, &startedAt, &position); err != nil {
 			return fmt.Errorf("failed to read lobby row: %s", err)
 		}
 		// Query for the current track.
 		if uri.Valid {
-			err := db.QueryRow("select uri, name, artist, duration from track where uri=?", uri).Scan(&uri, &trackName, &artist, &duration)
+			err := db.QueryRow("select uri, provider, name, artist, duration from track where uri=?", uri).Scan(&uri, &provider, &trackName, &artist, &duration)
 			if err != nil && err != sql.ErrNoRows {
 				return fmt.Errorf("failed to read current track: %s", err)
 			}
-			currentTrack = &Track{URI: uri.String, Name: trackName, Artist: artist, Duration: duration}
+			currentTrack = &Track{URI: uri.String, Provider: provider, Name: trackName, Artist: artist, Duration: duration}
+		}
+		lobby := NewLobby(id, lobbyName, LobbyMode(mode), genre, public, "")
+		if lobby.Providers, err = parseProviders(lobbyProviders); err != nil {
+			return fmt.Errorf("failed to read lobby providers: %s", err)
+		}
+		lobby.Autoplay = autoplay
+		lobby.Rules = rules
+		lobby.DJRotation = rotation
+		if lobby.History, err = selectHistory(db, id, HISTORY_SIZE); err != nil {
+			return fmt.Errorf("failed to read history: %s", err)
+		}
+		if lobby.FallbackPlaylist, err = selectFallback(db, id); err != nil {
+			return fmt.Errorf("failed to read fallback playlist: %s", err)
+		}
+		if lobby.ChatHistory, err = selectChatHistory(db, id, CHAT_HISTORY_SIZE); err != nil {
+			return fmt.Errorf("failed to read chat history: %s", err)
 		}
-		lobby := NewLobby(id, lobbyName, LobbyMode(mode), genre, public, "", currentTrack)
 
 		// Add the queue.
 		queue, err := db.Query(
-			`select trackURI, name, artist from queue
+			`select entry, _rank, trackURI, provider, name, artist, duration, username, addedAt from queue
             join track on(track.uri = queue.trackURI)
             where lobbyID=?
-            order by _rank asc`, id)
+            order by _rank asc, entry asc`, id)
 		if err != nil {
 			return fmt.Errorf("failed to query queue: %s", err)
 		}
 
 		for queue.Next() {
-			if err := queue.Scan(&uri, &trackName, &artist); err != nil {
+			track := Track{}
+			if err := queue.Scan(&track.entry, &track.rank, &track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration, &track.Username, &track.AddedAt); err != nil {
 				return fmt.Errorf("failed to read queue: %s", err)
 			}
 
-			lobby.TrackQueue.Push(&Track{URI: uri.String, Name: trackName, Artist: artist, Duration: duration})
+			lobby.TrackQueue.Push(&track)
+			if track.entry >= lobby.nextEntry {
+				lobby.nextEntry = track.entry + 1
+			}
+		}
+		if err := queue.Err(); err != nil {
+			return fmt.Errorf("failed to read queue: %s", err)
+		}
+		if err := selectQueueVotes(db, lobby); err != nil {
+			return fmt.Errorf("failed to read queue votes: %s", err)
+		}
+
+		// Continue the current track once the queue is loaded, as it may have ended while the server was down.
+		if currentTrack != nil {
+			lobby.resume(currentTrack, resumePosition(startedAt, position))
 		}
 
 		(*lobbies)[id] = lobby
@@ -74,6 +189,21 @@ func loadFromDB(lobbies *map[string]*Lobby) error {
 	return nil
 }
 
+// resumePosition returns the position in millis a restored lobby's current track continues from.
+// Playback is paused at the saved position if the server shut down cleanly, otherwise the track
+// is treated as having played on from its start time while the server was down.
+func resumePosition(startedAt int64, position int64) int64 {
+	if startedAt == 0 {
+		return position
+	}
+	if elapsed := NowMillis() - startedAt; elapsed > 0 {
+		return elapsed
+	}
+	return 0
+}
+
+// insertLobby stores a new lobby, homed on this node.
+// Returns errLobbyIDTaken if another lobby already has its ID.
 func insertLobby(lobby *Lobby) error {
 	db, err := dbConn()
 	if err != nil {
@@ -85,56 +215,48 @@ func insertLobby(lobby *Lobby) error {
 		return fmt.Errorf("failed to begin transaction: %s", err)
 	}
 	stmt, err := tx.Prepare(`
-        insert into lobby(id, name, mode, genre, public, currentUri)
-        values(?, ?, ?, ?, ?, null);`)
+        insert into lobby(id, name, mode, genre, public, node, providers, autoplay,
+            maxQueueLength, maxPerUser, repeatWindow, maxDuration, allowDuplicates,
+            djTracksPerTurn, djMinutesPerTurn, currentUri)
+        values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, null);`)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to prepare statement: %s", err)
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(lobby.ID, lobby.Name, lobby.LobbyMode, lobby.Genre, lobby.Public); err != nil {
+	if _, err := stmt.Exec(lobby.ID, lobby.Name, lobby.LobbyMode, lobby.Genre, lobby.Public, self.ID, strings.Join(lobby.Providers, ","), lobby.Autoplay,
+		lobby.Rules.MaxQueueLength, lobby.Rules.MaxPerUser, lobby.Rules.RepeatWindow, lobby.Rules.MaxDuration, lobby.Rules.AllowDuplicates,
+		lobby.DJRotation.TracksPerTurn, lobby.DJRotation.MinutesPerTurn); err != nil {
 		tx.Rollback()
+		if isDuplicateKey(err) {
+			return errLobbyIDTaken
+		}
 		return fmt.Errorf("failed to execute statement: %s", err)
 	}
 
 	return tx.Commit()
 }
 
-func persistQueue(lobby *Lobby) error {
-	// Connect to db.
-	db, err := dbConn()
-	if err != nil {
-		return fmt.Errorf("failed to get database connection: %s", err)
+// lockOwnedLobby locks the lobby's row until the transaction ends, returning errLobbyMoved if another
+// node has adopted the lobby. Adopting updates the row, so it waits for the write to finish, and a node
+// that missed its heartbeats can't overwrite a lobby another node now serves.
+func lockOwnedLobby(tx *sql.Tx, lobbyID string) error {
+	// Lobbies are only homed on nodes when they are shared.
+	if !clustered() {
+		return nil
 	}
-
-	// Begin transaction.
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %s", err)
+	var node string
+	err := tx.QueryRow(`select node from lobby where id=? for update`, lobbyID).Scan(&node)
+	if err == sql.ErrNoRows {
+		return errLobbyNotFound
 	}
-
-	// Delete the old queue for this lobby.
-	// Since removing the first song from the queue will result in every
-	// song needing to be updated in the db, it is easier to simplye remove
-	// them all and reinsert then to figure out which need to be changed.
-	if err := deleteQueue(tx, lobby.ID); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to delete lobby queue: %s", err)
+	if err != nil {
+		return fmt.Errorf("failed to lock lobby: %w", err)
 	}
-
-	// Insert queued tracks.
-	for rank, track := range lobby.TrackQueue {
-		if err := insertTrack(tx, track); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to insert queued track: %s", err)
-		}
-		if err := queueTrack(tx, lobby.ID, track.URI, rank); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to queue track: %s", err)
-		}
+	if node != self.ID {
+		return errLobbyMoved
 	}
-
-	return tx.Commit()
+	return nil
 }
 
 func persistCurrentTrack(lobby *Lobby) error {
@@ -149,10 +271,14 @@ func persistCurrentTrack(lobby *Lobby) error {
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %s", err)
 	}
+	// Releases the lobby's row lock on any error. Does nothing once committed.
+	defer tx.Rollback()
+	if err := lockOwnedLobby(tx, lobby.ID); err != nil {
+		return err
+	}
 
 	// Insert current track and update lobby's current track.
-	if err := insertTrack(tx, lobby.CurrentTrack); err != nil {
-		tx.Rollback()
+	if err := insertTrack(tx, lobby.CurrentTrack, lobby.Genre); err != nil {
 		return fmt.Errorf("failed to insert current track: %s", err)
 	}
 	var uri sql.NullString
@@ -160,59 +286,681 @@ func persistCurrentTrack(lobby *Lobby) error {
 		uri.Valid = true
 		uri.String = lobby.CurrentTrack.URI
 	}
-	stmt, err := tx.Prepare(`update lobby set currentUri=? where id=?`)
+	// The start time is saved rather than the position, so it doesn't need updating as the track plays.
+	stmt, err := tx.Prepare(`update lobby set currentUri=?, trackStartedAt=?, position=0 where id=?`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare update current track statement: %s", err)
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(uri, lobby.ID); err != nil {
+	if _, err := stmt.Exec(uri, lobby.trackStartedAt, lobby.ID); err != nil {
 		return fmt.Errorf("failed to execute update current track statement: %s", err)
 	}
 
 	return tx.Commit()
 }
 
-func deleteQueue(tx *sql.Tx, lobbyID string) error {
-	stmt, err := tx.Prepare(`delete from queue where lobbyID=?`)
+// persistPosition records how far into its current track a lobby is, in millis.
+// The start time is cleared, as playback is paused at the position until the lobby is resumed.
+func persistPosition(lobbyID string, position int64) error {
+	db, err := dbConn()
 	if err != nil {
-		return fmt.Errorf("failed prepare delete statement: %s", err)
+		return fmt.Errorf("failed to get database connection: %s", err)
 	}
-	defer stmt.Close()
-	if _, err := stmt.Exec(lobbyID); err != nil {
-		return fmt.Errorf("failed to execute track statement: %s", err)
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	if err := lockOwnedLobby(tx, lobbyID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`update lobby set position=?, trackStartedAt=0 where id=?`, position, lobbyID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update position: %s", err)
+	}
+	return tx.Commit()
+}
+
+// writeQueueChanges writes changes to the rows of a lobby's queued tracks in a single transaction.
+// The genre is used for any tracks not already stored. Errors are wrapped, so the queue writer
+// can tell whether the write is worth retrying.
+func writeQueueChanges(lobbyID string, genre string, changes map[int64]*queueChange) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := lockOwnedLobby(tx, lobbyID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for entry, c := range changes {
+		if err := writeQueueChange(tx, lobbyID, genre, entry, c); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to write queue entry %d: %w", entry, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// writeQueueChange writes a change to the row of a queued track. Votes are removed with the row.
+func writeQueueChange(tx *sql.Tx, lobbyID string, genre string, entry int64, c *queueChange) error {
+	if c.remove {
+		if _, err := tx.Exec(`delete from queue where lobbyID=? and entry=?`, lobbyID, entry); err != nil {
+			return fmt.Errorf("failed to delete queued track: %w", err)
+		}
+		return nil
+	}
+
+	if c.insert {
+		if err := insertTrack(tx, &c.track, genre); err != nil {
+			return fmt.Errorf("failed to insert queued track: %w", err)
+		}
+		// The row may exist if a commit succeeded but reported an error, and is being retried.
+		if _, err := tx.Exec(`
+            insert into queue(lobbyID, entry, trackURI, _rank, username, addedAt)
+            values(?, ?, ?, ?, ?, ?)
+            on duplicate key update _rank=values(_rank)`,
+			lobbyID, entry, c.track.URI, c.rank, c.track.Username, c.track.AddedAt); err != nil {
+			return fmt.Errorf("failed to queue track: %w", err)
+		}
+	} else if c.moved {
+		if _, err := tx.Exec(`update queue set _rank=? where lobbyID=? and entry=?`, c.rank, lobbyID, entry); err != nil {
+			return fmt.Errorf("failed to move queued track: %w", err)
+		}
+	}
+
+	if c.voted {
+		if _, err := tx.Exec(`delete from queue_vote where lobbyID=? and entry=?`, lobbyID, entry); err != nil {
+			return fmt.Errorf("failed to delete votes: %w", err)
+		}
+		for username, value := range c.votes {
+			if _, err := tx.Exec(`
+                insert into queue_vote(lobbyID, entry, username, value)
+                values(?, ?, ?, ?)`, lobbyID, entry, username, value); err != nil {
+				return fmt.Errorf("failed to insert vote by %s: %w", username, err)
+			}
+		}
 	}
 	return nil
 }
 
+// selectQueueVotes reads the votes on a lobby's queued tracks and sets the tracks' scores.
+func selectQueueVotes(db *sql.DB, lobby *Lobby) error {
+	rows, err := db.Query(`select entry, username, value from queue_vote where lobbyID=?`, lobby.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query votes: %s", err)
+	}
+	defer rows.Close()
+	byEntry := make(map[int64]*Track, len(lobby.TrackQueue))
+	for _, track := range lobby.TrackQueue {
+		byEntry[track.entry] = track
+	}
+	queueVotes := make(map[*Track]map[string]int)
+	for rows.Next() {
+		var entry int64
+		var username string
+		var value int
+		if err := rows.Scan(&entry, &username, &value); err != nil {
+			return fmt.Errorf("failed to read vote: %s", err)
+		}
+		track, ok := byEntry[entry]
+		if !ok {
+			continue
+		}
+		if queueVotes[track] == nil {
+			queueVotes[track] = make(map[string]int)
+		}
+		queueVotes[track][username] = value
+		track.Score = sumVotes(queueVotes[track])
+	}
+	lobby.QueueVotes = queueVotes
+	return rows.Err()
+}
+
 // insertTrack inserts a track if it doesn't exist, otherwise does nothing.
-func insertTrack(tx *sql.Tx, track *Track) error {
+// The genre is that of the lobby the track is being played in.
+func insertTrack(tx *sql.Tx, track *Track, genre string) error {
 	if track == nil {
 		return nil
 	}
 	stmt, err := tx.Prepare(`
-        insert ignore into track(uri, name, artist, duration)
-        values(?, ?, ?, ?);`)
+        insert ignore into track(uri, provider, name, artist, duration, genre)
+        values(?, ?, ?, ?, ?, ?);`)
 	if err != nil {
-		return fmt.Errorf("failed to prepare track statement: %s", err)
+		return fmt.Errorf("failed to prepare track statement: %w", err)
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(track.URI, track.Name, track.Artist, track.Duration); err != nil {
-		return fmt.Errorf("failed to execute track statement: %s", err)
+	if _, err := stmt.Exec(track.URI, track.Provider, track.Name, track.Artist, track.Duration, genre); err != nil {
+		return fmt.Errorf("failed to execute track statement: %w", err)
 	}
 	return nil
 }
 
-// queueTrack inserts a row to the Queue table with the provided values.
-func queueTrack(tx *sql.Tx, lobbyID string, uri string, rank int) error {
+// selectResolvedTrack returns a track previously cached by storeResolvedTrack,
+// or errTrackNotFound if the track hasn't been resolved.
+func selectResolvedTrack(uri string) (*Track, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	track := Track{}
+	err = db.QueryRow("select uri, provider, name, artist, duration from track where uri=? and resolved", uri).
+		Scan(&track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration)
+	if err == sql.ErrNoRows {
+		return nil, errTrackNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolved track: %s", err)
+	}
+	return &track, nil
+}
+
+// storeResolvedTrack caches a resolved track, replacing any details previously stored from a client.
+func storeResolvedTrack(track *Track) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	stmt, err := db.Prepare(`
+        insert into track(uri, provider, name, artist, duration, resolved)
+        values(?, ?, ?, ?, ?, true)
+        on duplicate key update name=values(name), artist=values(artist), duration=values(duration), resolved=true;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare resolved track statement: %s", err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(track.URI, track.Provider, track.Name, track.Artist, track.Duration); err != nil {
+		return fmt.Errorf("failed to execute resolved track statement: %s", err)
+	}
+	return nil
+}
+
+// insertPlay records that a track was played in a lobby at the provided time in millis.
+func insertPlay(lobbyID string, genre string, track *Track, playedAt int64) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	if err := lockOwnedLobby(tx, lobbyID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := insertTrack(tx, track, genre); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to insert played track: %s", err)
+	}
 	stmt, err := tx.Prepare(`
-        insert into queue(lobbyID, trackURI, _rank)
-        values(?, ?, ?)`)
+        insert into history(lobbyID, trackURI, playedAt, autoplayed)
+        values(?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prepare history statement: %s", err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(lobbyID, track.URI, playedAt, track.Autoplayed); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to execute history statement: %s", err)
+	}
+
+	return tx.Commit()
+}
+
+// insertReaction records a member's reaction to a play of a track.
+func insertReaction(lobbyID string, playedAt int64, uri string, username string, reaction string) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+	if _, err := db.Exec(`
+        insert ignore into reaction(lobbyID, playedAt, trackURI, username, reaction)
+        values(?, ?, ?, ?, ?)`, lobbyID, playedAt, uri, username, reaction); err != nil {
+		return fmt.Errorf("failed to insert reaction: %s", err)
+	}
+	return nil
+}
+
+// deleteReaction removes a member's reaction to a play of a track.
+func deleteReaction(lobbyID string, playedAt int64, username string, reaction string) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+	if _, err := db.Exec(`
+        delete from reaction
+        where lobbyID=? and playedAt=? and username=? and reaction=?`, lobbyID, playedAt, username, reaction); err != nil {
+		return fmt.Errorf("failed to delete reaction: %s", err)
+	}
+	return nil
+}
+
+// selectMostLoved returns up to limit of the tracks with the most likes in a lobby, most liked first.
+func selectMostLoved(lobbyID string, limit int) ([]LovedTrack, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	rows, err := db.Query(
+		`select uri, provider, name, artist, duration, count(*) as likes from reaction
+        join track on(track.uri = reaction.trackURI)
+        where lobbyID=? and reaction=?
+        group by uri, provider, name, artist, duration
+        order by likes desc
+        limit ?`, lobbyID, REACTION_LIKE, limit)
 	if err != nil {
-		return fmt.Errorf("failed to prepare queue statement: %s", err)
+		return nil, fmt.Errorf("failed to query most loved tracks: %s", err)
+	}
+	defer rows.Close()
+
+	var loved []LovedTrack
+	for rows.Next() {
+		track := Track{}
+		var likes int
+		if err := rows.Scan(&track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration, &likes); err != nil {
+			return nil, fmt.Errorf("failed to read most loved tracks: %s", err)
+		}
+		loved = append(loved, LovedTrack{Track: &track, Likes: likes})
+	}
+	return loved, rows.Err()
+}
+
+// selectHistory returns up to limit of the most recently played tracks in a lobby, oldest first.
+func selectHistory(db *sql.DB, lobbyID string, limit int) ([]*Track, error) {
+	rows, err := db.Query(
+		`select uri, provider, name, artist, duration, autoplayed from history
+        join track on(track.uri = history.trackURI)
+        where lobbyID=?
+        order by playedAt desc, id desc
+        limit ?`, lobbyID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %s", err)
+	}
+	defer rows.Close()
+
+	var history []*Track
+	for rows.Next() {
+		track := Track{}
+		if err := rows.Scan(&track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration, &track.Autoplayed); err != nil {
+			return nil, fmt.Errorf("failed to read history: %s", err)
+		}
+		// Rows are newest first, so prepend to get them oldest first.
+		history = append([]*Track{&track}, history...)
+	}
+	return history, rows.Err()
+}
+
+// insertChatMessage records a chat message sent in a lobby.
+func insertChatMessage(lobbyID string, msg ChatMessage) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+	if _, err := db.Exec(`
+        insert into chat(lobbyID, username, text, sentAt)
+        values(?, ?, ?, ?)`, lobbyID, msg.Username, msg.Text, msg.SentAt); err != nil {
+		return fmt.Errorf("failed to insert chat message: %s", err)
+	}
+	return nil
+}
+
+// selectChatHistory returns the most recent chat messages of a lobby, oldest first.
+func selectChatHistory(db *sql.DB, lobbyID string, limit int) ([]ChatMessage, error) {
+	rows, err := db.Query(
+		`select username, text, sentAt from chat
+        where lobbyID=?
+        order by sentAt desc, id desc
+        limit ?`, lobbyID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat: %s", err)
+	}
+	defer rows.Close()
+
+	var history []ChatMessage
+	for rows.Next() {
+		msg := ChatMessage{}
+		if err := rows.Scan(&msg.Username, &msg.Text, &msg.SentAt); err != nil {
+			return nil, fmt.Errorf("failed to read chat: %s", err)
+		}
+		// Rows are newest first, so prepend to get them oldest first.
+		history = append([]ChatMessage{msg}, history...)
+	}
+	return history, rows.Err()
+}
+
+// selectFallback returns the fallback playlist of a lobby.
+func selectFallback(db *sql.DB, lobbyID string) ([]*Track, error) {
+	rows, err := db.Query(
+		`select uri, provider, name, artist, duration from fallback
+        join track on(track.uri = fallback.trackURI)
+        where lobbyID=?
+        order by _rank asc`, lobbyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fallback playlist: %s", err)
+	}
+	defer rows.Close()
+
+	var playlist []*Track
+	for rows.Next() {
+		track := Track{}
+		if err := rows.Scan(&track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration); err != nil {
+			return nil, fmt.Errorf("failed to read fallback playlist: %s", err)
+		}
+		playlist = append(playlist, &track)
+	}
+	return playlist, rows.Err()
+}
+
+// selectTrackByGenre returns a random track of the genre, other than the excluded URI.
+func selectTrackByGenre(genre string, excludeURI string) (*Track, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	track := Track{}
+	err = db.QueryRow(
+		`select uri, provider, name, artist, duration from track
+        where genre=? and uri<>?
+        order by rand()
+        limit 1`, genre, excludeURI).Scan(&track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration)
+	if err == sql.ErrNoRows {
+		return nil, errNoRecommendation
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read track by genre: %s", err)
+	}
+	return &track, nil
+}
+
+// persistAutoplay writes the autoplay strategy and fallback playlist of a lobby.
+func persistAutoplay(lobby *Lobby) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	if err := lockOwnedLobby(tx, lobby.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	stmt, err := tx.Prepare(`update lobby set autoplay=? where id=?`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prepare autoplay statement: %s", err)
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(lobbyID, uri, rank); err != nil {
-		return fmt.Errorf("failed to execute queue statement id:%s uri:%s: %s", lobbyID, uri, err)
+	if _, err := stmt.Exec(lobby.Autoplay, lobby.ID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to execute autoplay statement: %s", err)
+	}
+
+	// As with the queue, the whole playlist is replaced.
+	if _, err := tx.Exec(`delete from fallback where lobbyID=?`, lobby.ID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete fallback playlist: %s", err)
+	}
+	for rank, track := range lobby.FallbackPlaylist {
+		if err := insertTrack(tx, track, lobby.Genre); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert fallback track: %s", err)
+		}
+		if _, err := tx.Exec(`insert into fallback(lobbyID, trackURI, _rank) values(?, ?, ?)`, lobby.ID, track.URI, rank); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert fallback playlist row: %s", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// selectFullHistory returns up to limit of the most recently played tracks in a lobby, oldest first.
+func selectFullHistory(lobbyID string, limit int) ([]*Track, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	return selectHistory(db, lobbyID, limit)
+}
+
+// insertPlaylist saves a playlist and its tracks, returning the ID of the new playlist.
+// The genre is used for any tracks not already stored.
+func insertPlaylist(playlist *Playlist, genre string) (int64, error) {
+	db, err := dbConn()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %s", err)
+	}
+
+	var lobbyID sql.NullString
+	if playlist.LobbyID != "" {
+		lobbyID.Valid = true
+		lobbyID.String = playlist.LobbyID
+	}
+	res, err := tx.Exec(`
+        insert into playlist(name, owner, lobbyID, createdAt)
+        values(?, ?, ?, ?)`, playlist.Name, playlist.Owner, lobbyID, playlist.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to insert playlist: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to get playlist id: %s", err)
+	}
+
+	for rank, track := range playlist.Tracks {
+		if err := insertTrack(tx, track, genre); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to insert playlist track: %s", err)
+		}
+		if _, err := tx.Exec(`insert into playlist_track(playlistID, _rank, trackURI) values(?, ?, ?)`, id, rank, track.URI); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to insert playlist row: %s", err)
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// selectPlaylist returns the saved playlist with its tracks, or errPlaylistNotFound.
+func selectPlaylist(id int64) (*Playlist, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	playlist := Playlist{}
+	var lobbyID sql.NullString
+	err = db.QueryRow("select id, name, owner, lobbyID, createdAt from playlist where id=?", id).
+		Scan(&playlist.ID, &playlist.Name, &playlist.Owner, &lobbyID, &playlist.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errPlaylistNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playlist: %s", err)
+	}
+	playlist.LobbyID = lobbyID.String
+
+	rows, err := db.Query(
+		`select uri, provider, name, artist, duration from playlist_track
+        join track on(track.uri = playlist_track.trackURI)
+        where playlistID=?
+        order by _rank asc`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlist tracks: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		track := Track{}
+		if err := rows.Scan(&track.URI, &track.Provider, &track.Name, &track.Artist, &track.Duration); err != nil {
+			return nil, fmt.Errorf("failed to read playlist track: %s", err)
+		}
+		playlist.Tracks = append(playlist.Tracks, &track)
+	}
+	return &playlist, rows.Err()
+}
+
+// selectPlaylists returns the saved playlists, without their tracks, belonging to
+// the owner if provided, otherwise to the lobby.
+func selectPlaylists(owner string, lobbyID string) ([]*Playlist, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+
+	var rows *sql.Rows
+	if owner != "" {
+		rows, err = db.Query("select id, name, owner, lobbyID, createdAt from playlist where owner=? order by createdAt desc", owner)
+	} else {
+		rows, err = db.Query("select id, name, owner, lobbyID, createdAt from playlist where owner='' and lobbyID=? order by createdAt desc", lobbyID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlists: %s", err)
+	}
+	defer rows.Close()
+
+	var playlists []*Playlist
+	for rows.Next() {
+		playlist := Playlist{}
+		var lobbyID sql.NullString
+		if err := rows.Scan(&playlist.ID, &playlist.Name, &playlist.Owner, &lobbyID, &playlist.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read playlist: %s", err)
+		}
+		playlist.LobbyID = lobbyID.String
+		playlists = append(playlists, &playlist)
+	}
+	return playlists, rows.Err()
+}
+
+// dbDirectory is a Directory stored in the database, shared by every node using it.
+type dbDirectory struct{}
+
+func (dbDirectory) Heartbeat(node Node) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+	if _, err := db.Exec(`
+        insert into node(id, address, heartbeatAt) values(?, ?, ?)
+        on duplicate key update address=values(address), heartbeatAt=values(heartbeatAt)`,
+		node.ID, node.Address, node.HeartbeatAt); err != nil {
+		return fmt.Errorf("failed to update node: %s", err)
 	}
 	return nil
 }
+
+func (dbDirectory) Leave(nodeID string) error {
+	db, err := dbConn()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+	if _, err := db.Exec(`delete from node where id=?`, nodeID); err != nil {
+		return fmt.Errorf("failed to delete node: %s", err)
+	}
+	return nil
+}
+
+func (dbDirectory) Nodes() ([]Node, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	rows, err := db.Query(`select id, address, heartbeatAt from node where heartbeatAt>=?`, NowMillis()-NODE_TIMEOUT.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nodes: %s", err)
+	}
+	defer rows.Close()
+	var nodes []Node
+	for rows.Next() {
+		var n Node
+		if err := rows.Scan(&n.ID, &n.Address, &n.HeartbeatAt); err != nil {
+			return nil, fmt.Errorf("failed to read node: %s", err)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+func (dbDirectory) Owner(lobbyID string) (Node, error) {
+	db, err := dbConn()
+	if err != nil {
+		return Node{}, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	var n Node
+	err = db.QueryRow(`
+        select lobby.node, coalesce(node.address, ''), coalesce(node.heartbeatAt, 0) from lobby
+        left join node on(node.id = lobby.node)
+        where lobby.id=?`, lobbyID).Scan(&n.ID, &n.Address, &n.HeartbeatAt)
+	if err == sql.ErrNoRows {
+		return Node{}, errLobbyNotFound
+	}
+	if err != nil {
+		return Node{}, fmt.Errorf("failed to query lobby's node: %s", err)
+	}
+	return n, nil
+}
+
+func (dbDirectory) Orphaned() (map[string]string, error) {
+	db, err := dbConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	rows, err := db.Query(`
+        select id, node from lobby
+        where node not in (select id from node where heartbeatAt>=?)`,
+		NowMillis()-NODE_TIMEOUT.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orphaned lobbies: %s", err)
+	}
+	defer rows.Close()
+	lobbies := make(map[string]string)
+	for rows.Next() {
+		var id, node string
+		if err := rows.Scan(&id, &node); err != nil {
+			return nil, fmt.Errorf("failed to read orphaned lobby: %s", err)
+		}
+		lobbies[id] = node
+	}
+	return lobbies, rows.Err()
+}
+
+func (dbDirectory) Adopt(lobbyID string, nodeID string) (bool, error) {
+	db, err := dbConn()
+	if err != nil {
+		return false, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	// Only one node's update matches while the lobby's node is stopped, as the first makes the lobby its own.
+	res, err := db.Exec(`
+        update lobby set node=?
+        where id=? and node not in (select id from node where heartbeatAt>=?)`,
+		nodeID, lobbyID, NowMillis()-NODE_TIMEOUT.Milliseconds())
+	if err != nil {
+		return false, fmt.Errorf("failed to update lobby's node: %s", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read updated rows: %s", err)
+	}
+	return updated == 1, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Tracks scoring below this are removed from the queue of a democracy lobby.
+const DEMOCRACY_MIN_SCORE = -2
+
+// Values of a member's vote on a queued track.
+const (
+	UPVOTE_VALUE   = 1
+	DOWNVOTE_VALUE = -1
+)
+
+// ranksBefore returns true if track a belongs ahead of track b in a democracy queue.
+// Higher scores come first, with ties going to the track added first.
+func ranksBefore(a *Track, b *Track) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.AddedAt < b.AddedAt
+}
+
+// rankedIndex returns the position the track belongs at in a democracy queue that doesn't contain it.
+func (q TrackQueue) rankedIndex(t *Track) int {
+	for i, queued := range q {
+		if ranksBefore(t, queued) {
+			return i
+		}
+	}
+	return len(q)
+}
+
+// findQueued returns the index of the queued track matching the target, or -1 if it isn't queued.
+// As a track can be queued more than once, the time it was added is also matched if provided.
+func (q TrackQueue) findQueued(target *Track) int {
+	for i, queued := range q {
+		if queued.URI == target.URI && (target.AddedAt == 0 || queued.AddedAt == target.AddedAt) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sumVotes returns the score given by the votes on a track.
+func sumVotes(votes map[string]int) int {
+	score := 0
+	for _, vote := range votes {
+		score += vote
+	}
+	return score
+}
+
+// setVotes replaces the votes on a queued track, or forgets them if nil.
+// A new map is made each time, as the queue may be being written to the database.
+func (l *Lobby) setVotes(track *Track, votes map[string]int) {
+	queueVotes := make(map[*Track]map[string]int, len(l.QueueVotes)+1)
+	for t, v := range l.QueueVotes {
+		queueVotes[t] = v
+	}
+	if votes == nil {
+		delete(queueVotes, track)
+	} else {
+		queueVotes[track] = votes
+	}
+	l.QueueVotes = queueVotes
+}
+
+// forgetVotes removes the votes on a track that has left the queue.
+func (l *Lobby) forgetVotes(track *Track) {
+	if _, ok := l.QueueVotes[track]; ok {
+		l.setVotes(track, nil)
+	}
+}
+
+// voteOnTrack records the user's vote on a queued track, then moves the track to
+// its new position or removes it if it has scored too low.
+func (l *Lobby) voteOnTrack(username string, target *Track, value int) error {
+	if l.LobbyMode != DEMOCRACY {
+		return errors.New("tracks can only be voted on in democracy lobbies")
+	}
+	if target == nil {
+		return errors.New("no track provided")
+	}
+	i := l.TrackQueue.findQueued(target)
+	if i == -1 {
+		return fmt.Errorf("%s is not in the queue", target.URI)
+	}
+
+	track := l.TrackQueue[i]
+	if l.QueueVotes[track][username] == value {
+		return nil
+	}
+	votes := make(map[string]int, len(l.QueueVotes[track])+1)
+	for name, vote := range l.QueueVotes[track] {
+		votes[name] = vote
+	}
+	votes[username] = value
+	l.setVotes(track, votes)
+	track.Score = sumVotes(votes)
+	l.StateLog.Record(StateDiff{Op: DIFF_QUEUE_SCORE, Index: i, Track: track})
+
+	l.TrackQueue = l.TrackQueue.Remove(i)
+	if track.Score < DEMOCRACY_MIN_SCORE {
+		l.forgetVotes(track)
+		l.queueWriter.remove(track)
+		l.StateLog.Record(StateDiff{Op: DIFF_QUEUE_REMOVE, Index: i})
+		l.sendServerMessageAndLog("%s was voted out of the queue.", track.Name)
+		return nil
+	}
+	to := l.TrackQueue.rankedIndex(track)
+	l.TrackQueue = l.TrackQueue.Insert(to, track)
+	if to != i {
+		l.rankQueued(to)
+		l.queueWriter.move(track)
+		l.StateLog.Record(StateDiff{Op: DIFF_QUEUE_MOVE, Index: i, To: to})
+	}
+	l.queueWriter.setVotes(track, votes)
+	return nil
+}
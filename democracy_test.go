@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+// queueURIs returns the URIs of the queued tracks in order.
+func queueURIs(q TrackQueue) []string {
+	var uris []string
+	for _, track := range q {
+		uris = append(uris, track.URI)
+	}
+	return uris
+}
+
+func democracyLobby(uris ...string) *Lobby {
+	l := &Lobby{LobbyMode: DEMOCRACY, StateLog: &StateLog{}}
+	for i, uri := range uris {
+		l.TrackQueue.Push(&Track{URI: uri, AddedAt: int64(i + 1)})
+	}
+	return l
+}
+
+func TestVoteOnTrack_Reorders(t *testing.T) {
+	suppressLogging()
+	l := democracyLobby("a", "b", "c")
+
+	if err := l.voteOnTrack("alice", &Track{URI: "c"}, UPVOTE_VALUE); err != nil {
+		t.Fatalf("voteOnTrack returned error: %s", err)
+	}
+	if got := queueURIs(l.TrackQueue); got[0] != "c" || got[1] != "a" || got[2] != "b" {
+		t.Errorf("Upvoted track not moved to the front, got: %v", got)
+	}
+	if l.TrackQueue[0].Score != 1 {
+		t.Errorf("Incorrect score, got: %d, want: %d", l.TrackQueue[0].Score, 1)
+	}
+
+	// Changing a vote replaces it rather than adding to it.
+	if err := l.voteOnTrack("alice", &Track{URI: "c"}, DOWNVOTE_VALUE); err != nil {
+		t.Fatalf("voteOnTrack returned error: %s", err)
+	}
+	if got := queueURIs(l.TrackQueue); got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("Downvoted track not moved to the back, got: %v", got)
+	}
+	if l.TrackQueue[2].Score != -1 {
+		t.Errorf("Incorrect score, got: %d, want: %d", l.TrackQueue[2].Score, -1)
+	}
+}
+
+func TestVoteOnTrack_RemovesBelowThreshold(t *testing.T) {
+	suppressLogging()
+	l := democracyLobby("a", "b")
+
+	for _, user := range []string{"x", "y", "z"} {
+		if err := l.voteOnTrack(user, &Track{URI: "a"}, DOWNVOTE_VALUE); err != nil {
+			t.Fatalf("voteOnTrack returned error: %s", err)
+		}
+	}
+	if got := queueURIs(l.TrackQueue); len(got) != 1 || got[0] != "b" {
+		t.Errorf("Track below the minimum score not removed, got: %v", got)
+	}
+}
+
+func TestVoteOnTrack_Rejected(t *testing.T) {
+	testCases := []struct {
+		name   string
+		mode   LobbyMode
+		target *Track
+	}{
+		{"not a democracy", FREE_FOR_ALL, &Track{URI: "a"}},
+		{"no track", DEMOCRACY, nil},
+		{"not queued", DEMOCRACY, &Track{URI: "z"}},
+	}
+
+	for _, tc := range testCases {
+		l := democracyLobby("a")
+		l.LobbyMode = tc.mode
+		if err := l.voteOnTrack("alice", tc.target, UPVOTE_VALUE); err == nil {
+			t.Errorf("%s: voteOnTrack did not return an error", tc.name)
+		}
+	}
+}
+
+func TestPushToQueue_DemocracyIgnoresForgedScore(t *testing.T) {
+	suppressLogging()
+	l := democracyLobby("a", "b")
+	track := &Track{URI: "youtube:dQw4w9WgXcQ", Name: "song", Duration: 60000, Score: 1000000000, Autoplayed: true}
+	if err := l.checkTrack(track); err != nil {
+		t.Fatalf("checkTrack returned error: %s", err)
+	}
+	l.pushToQueue(track)
+
+	if got := queueURIs(l.TrackQueue); got[len(got)-1] != track.URI {
+		t.Errorf("Track with forged score jumped the queue, got: %v", got)
+	}
+	if track.Score != 0 || track.Autoplayed {
+		t.Errorf("Server owned fields kept from client, got score: %d, autoplayed: %t", track.Score, track.Autoplayed)
+	}
+}
+
+func TestPushToQueue_Democracy(t *testing.T) {
+	suppressLogging()
+	l := democracyLobby("a", "b")
+	l.TrackQueue[1].Score = -1
+
+	l.pushToQueue(&Track{URI: "c"})
+	if got := queueURIs(l.TrackQueue); got[2] != "b" {
+		t.Errorf("New track not placed ahead of negatively scored tracks, got: %v", got)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// DJRotation decides when the DJ seat passes to the next member on the waitlist.
+// The seat only passes between tracks. A zero limit means it isn't used.
+type DJRotation struct {
+	// Tracks the DJ plays before passing the seat on.
+	TracksPerTurn int `json:"tracksPerTurn"`
+	// Minutes the DJ holds the seat before passing it on.
+	MinutesPerTurn int `json:"minutesPerTurn"`
+}
+
+// parseDJRotation reads the DJ rotation from the form values of a create lobby request.
+func parseDJRotation(value func(string) string) (DJRotation, error) {
+	rotation := DJRotation{}
+	ints := []struct {
+		key string
+		dst *int
+	}{
+		{"djTracks", &rotation.TracksPerTurn},
+		{"djMinutes", &rotation.MinutesPerTurn},
+	}
+	for _, i := range ints {
+		if value(i.key) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value(i.key))
+		if err != nil || n < 0 {
+			return DJRotation{}, fmt.Errorf("%s must be a positive int", i.key)
+		}
+		*i.dst = n
+	}
+	return rotation, nil
+}
+
+// joinWaitlist adds the user to the end of the DJ waitlist.
+// If nobody is DJing, the user takes the seat straight away.
+func (l *Lobby) joinWaitlist(username string) error {
+	if l.LobbyMode != DJ_ROTATION {
+		return errors.New("there is no DJ waitlist in this lobby mode")
+	}
+	if username == l.DJ {
+		return errors.New("you are already the DJ")
+	}
+	if l.waitlistIndex(username) != -1 {
+		return errors.New("you are already on the waitlist")
+	}
+	if l.DJ == "" {
+		l.setDJ(username)
+		return nil
+	}
+	l.DJWaitlist = append(l.DJWaitlist, username)
+	l.sendServerMessageAndLog("%s joined the DJ waitlist.", username)
+	return nil
+}
+
+// leaveWaitlist removes the user from the DJ waitlist, or passes the seat on if they are the DJ.
+func (l *Lobby) leaveWaitlist(username string) error {
+	if username == l.DJ {
+		l.passDJ(false)
+		return nil
+	}
+	i := l.waitlistIndex(username)
+	if i == -1 {
+		return errors.New("you are not on the waitlist")
+	}
+	l.removeFromWaitlist(i)
+	return nil
+}
+
+// votePassDJ records the user's vote to pass the DJ seat on early, passing it if most members agree.
+func (l *Lobby) votePassDJ(username string) error {
+	if l.LobbyMode != DJ_ROTATION || l.DJ == "" {
+		return errors.New("there is no DJ to pass on")
+	}
+	if l.DJPassVotes[username] {
+		return nil
+	}
+	l.DJPassVotes[username] = true
+	l.sendServerMessage("%s voted to pass the DJ seat on.", username)
+
+	successful, required := l.votesPassed(len(l.DJPassVotes))
+	if successful {
+		l.sendServerMessageAndLog("Vote to pass the DJ seat passed.")
+		l.passDJ(false)
+	} else {
+		l.sendServerMessageAndLog("%d more vote(s) required to pass the DJ seat on.", required)
+	}
+	return nil
+}
+
+// rotateDJ is called when a track ends, counting it if the DJ chose it,
+// and passes the seat on if the DJ's turn is over.
+func (l *Lobby) rotateDJ(ended *Track) {
+	if l.LobbyMode != DJ_ROTATION || l.DJ == "" {
+		return
+	}
+	if ended != nil && ended.Username == l.DJ {
+		l.djTracksPlayed++
+	}
+	tracksDone := l.DJRotation.TracksPerTurn > 0 && l.djTracksPlayed >= l.DJRotation.TracksPerTurn
+	minutes := int64(l.DJRotation.MinutesPerTurn) * 60 * 1000
+	timeDone := minutes > 0 && NowMillis()-l.djTurnStart >= minutes
+	if tracksDone || timeDone {
+		l.passDJ(true)
+	}
+}
+
+// passDJ gives the seat to the first member on the waitlist. If requeue is set, the
+// outgoing DJ joins the back of the waitlist. If nobody is waiting, the DJ starts a new turn.
+func (l *Lobby) passDJ(requeue bool) {
+	outgoing := l.DJ
+	if len(l.DJWaitlist) == 0 {
+		if requeue {
+			l.djTracksPlayed = 0
+			l.djTurnStart = NowMillis()
+		} else {
+			l.setDJ("")
+		}
+		return
+	}
+	next := l.DJWaitlist[0]
+	l.removeFromWaitlist(0)
+	if requeue && outgoing != "" {
+		l.DJWaitlist = append(l.DJWaitlist, outgoing)
+	}
+	l.setDJ(next)
+}
+
+// setDJ gives the seat to the user, starting a new turn.
+func (l *Lobby) setDJ(username string) {
+	l.DJ = username
+	l.djTracksPlayed = 0
+	l.djTurnStart = NowMillis()
+	l.DJPassVotes = make(map[string]bool)
+	if username == "" {
+		l.sendServerMessageAndLog("Nobody is DJing, join the waitlist to take the seat.")
+	} else {
+		l.sendServerMessageAndLog("%s is now the DJ.", username)
+	}
+}
+
+// waitlistIndex returns the user's position on the DJ waitlist, or -1 if they aren't on it.
+func (l *Lobby) waitlistIndex(username string) int {
+	for i, name := range l.DJWaitlist {
+		if name == username {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeFromWaitlist removes the member at index i from the waitlist.
+// A new slice is made, as messages being sent may still reference the old one.
+func (l *Lobby) removeFromWaitlist(i int) {
+	waitlist := make([]string, 0, len(l.DJWaitlist))
+	waitlist = append(waitlist, l.DJWaitlist[:i]...)
+	l.DJWaitlist = append(waitlist, l.DJWaitlist[i+1:]...)
+}
+
+// leaveDJRotation removes a disconnected member from the DJ seat and waitlist.
+func (l *Lobby) leaveDJRotation(username string) {
+	delete(l.DJPassVotes, username)
+	if i := l.waitlistIndex(username); i != -1 {
+		l.removeFromWaitlist(i)
+	}
+	if username == l.DJ {
+		l.passDJ(false)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func djLobby(dj string, waitlist ...string) *Lobby {
+	return &Lobby{
+		LobbyMode:   DJ_ROTATION,
+		DJ:          dj,
+		DJWaitlist:  waitlist,
+		DJPassVotes: make(map[string]bool),
+		NumMembers:  len(waitlist) + 1,
+		djTurnStart: NowMillis(),
+	}
+}
+
+func TestJoinWaitlist(t *testing.T) {
+	suppressLogging()
+	l := djLobby("")
+
+	if err := l.joinWaitlist("a"); err != nil || l.DJ != "a" {
+		t.Fatalf("First member to join did not take the empty seat, got DJ: %q, err: %v", l.DJ, err)
+	}
+	if err := l.joinWaitlist("b"); err != nil || len(l.DJWaitlist) != 1 {
+		t.Fatalf("Member not added to the waitlist, got: %v, err: %v", l.DJWaitlist, err)
+	}
+	if err := l.joinWaitlist("b"); err == nil {
+		t.Errorf("joinWaitlist did not reject a member already waiting")
+	}
+	if err := l.joinWaitlist("a"); err == nil {
+		t.Errorf("joinWaitlist did not reject the DJ")
+	}
+}
+
+func TestRotateDJ_AfterTracks(t *testing.T) {
+	suppressLogging()
+	l := djLobby("a", "b", "c")
+	l.DJRotation = DJRotation{TracksPerTurn: 2}
+
+	l.rotateDJ(&Track{Username: "a"})
+	if l.DJ != "a" {
+		t.Fatalf("DJ rotated before their turn was over, got: %q", l.DJ)
+	}
+	// Tracks the DJ didn't choose don't count towards their turn.
+	l.rotateDJ(&Track{Autoplayed: true})
+	l.rotateDJ(&Track{Username: "a"})
+	if l.DJ != "b" {
+		t.Errorf("Seat not passed to the next member, got: %q, want: %q", l.DJ, "b")
+	}
+	if len(l.DJWaitlist) != 2 || l.DJWaitlist[1] != "a" {
+		t.Errorf("Outgoing DJ not moved to the back of the waitlist, got: %v", l.DJWaitlist)
+	}
+}
+
+func TestRotateDJ_NobodyWaiting(t *testing.T) {
+	suppressLogging()
+	l := djLobby("a")
+	l.DJRotation = DJRotation{TracksPerTurn: 1}
+
+	l.rotateDJ(&Track{Username: "a"})
+	if l.DJ != "a" || l.djTracksPlayed != 0 {
+		t.Errorf("DJ did not start a new turn, got DJ: %q, tracks played: %d", l.DJ, l.djTracksPlayed)
+	}
+}
+
+func TestVotePassDJ(t *testing.T) {
+	suppressLogging()
+	l := djLobby("a", "b", "c")
+
+	l.votePassDJ("b")
+	if l.DJ != "a" {
+		t.Fatalf("Seat passed without a majority")
+	}
+	l.votePassDJ("c")
+	if l.DJ != "b" {
+		t.Errorf("Seat not passed after a majority vote, got: %q, want: %q", l.DJ, "b")
+	}
+	// The outgoing DJ was voted off, so doesn't rejoin the waitlist.
+	if len(l.DJWaitlist) != 1 || l.DJWaitlist[0] != "c" {
+		t.Errorf("Incorrect waitlist, got: %v", l.DJWaitlist)
+	}
+}
+
+func TestLeaveDJRotation(t *testing.T) {
+	suppressLogging()
+	l := djLobby("a", "b", "c")
+
+	l.leaveDJRotation("c")
+	l.leaveDJRotation("a")
+	if l.DJ != "b" || len(l.DJWaitlist) != 0 {
+		t.Errorf("Incorrect DJ after members left, got DJ: %q, waitlist: %v", l.DJ, l.DJWaitlist)
+	}
+}
+
+func TestCanAddSongs_DJRotation(t *testing.T) {
+	l := djLobby("a", "b")
+	if err := l.canAddSongs("a"); err != nil {
+		t.Errorf("DJ cannot add songs: %s", err)
+	}
+	if err := l.canAddSongs("b"); err == nil {
+		t.Errorf("Member who isn't the DJ can add songs")
+	}
+}
@@ -16,24 +16,25 @@ type HandshakeResponse struct {
 // to determine the latency and clock offset for this client.
 func performClockHandshake(c *Client) error {
 	// We need to send the "end handshake" message no matter how the function exits.
-	defer c.Send(Message{Command: Command(S_HANDSHAKE), Timestamp: 0})
+	// The handshake happens before the client's writer is started, so messages are written directly.
+	defer c.write(Message{Command: Command(S_HANDSHAKE), Timestamp: 0})
 
 	var responses []HandshakeResponse
 	for i := 1; i <= 5; i++ {
 		// Send handshake.
 		serverBefore := NowMillis()
-		c.Send(Message{Command: Command(S_HANDSHAKE), Timestamp: serverBefore})
+		c.write(Message{Command: Command(S_HANDSHAKE), Timestamp: serverBefore})
 
 		// Receive handshake ack.
 		msg := Message{}
-		if err := c.Conn.ReadJSON(&msg); err != nil {
+		if err := c.read(&msg); err != nil {
 			return fmt.Errorf("failed to read message: %s", err)
 		}
 		serverAfter := NowMillis()
 		if ClientCommand(msg.Command) != C_HANDSHAKE {
 			return fmt.Errorf("handshake not completed, received instead: %#v", msg)
 		}
-		c.log("Received handshake ack: %#v", msg)
+		c.log().Debug("Received handshake ack", "msg", msg)
 
 		// Calculate latency and offset for this particular message.
 		appTime := msg.Timestamp
@@ -45,6 +46,8 @@ func performClockHandshake(c *Client) error {
 	latency, offset := determineLatencyAndOffset(c, responses)
 	c.Latency = int64(latency)
 	c.Offset = int64(offset)
+	handshakeLatency.Observe(float64(latency))
+	handshakeOffset.Observe(float64(offset))
 	return nil
 }
 
@@ -57,9 +60,9 @@ func determineLatencyAndOffset(c *Client, responses []HandshakeResponse) (int, i
 	for _, v := range responses {
 		if v.latency <= upperOutlier && v.latency >= lowerOutlier {
 			usable = append(usable, v)
-			c.log(fmt.Sprintf("Using: latency: %d, offset:%d", v.latency, v.offset))
+			c.log().Debug("Using handshake response", "latency", v.latency, "offset", v.offset)
 		} else {
-			c.log(fmt.Sprintf("Discarding: latency: %d, offset:%d", v.latency, v.offset))
+			c.log().Debug("Discarding handshake response", "latency", v.latency, "offset", v.offset)
 		}
 	}
 
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"log"
-	"os"
+	"io"
+	"log/slog"
 	"testing"
 )
 
-// Outputs logs to /dev/null during testing.
+// Discards logs during testing.
 func suppressLogging() {
-	f, _ := os.OpenFile("/dev/null", os.O_WRONLY|os.O_APPEND, 0666)
-	log.SetOutput(f)
+	setLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
 }
 
 var testClient = &Client{Lobby: &Lobby{}}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Bounds of the wait between attempts to reach the database at startup.
+const (
+	DB_RETRY_MIN = 500 * time.Millisecond
+	DB_RETRY_MAX = 30 * time.Second
+)
+
+// How long a readiness check waits for the database to respond.
+const DB_PING_TIMEOUT = 2 * time.Second
+
+// Routes that are served before stored lobbies have been loaded.
+var startupRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// pingStorage checks the storage backend is reachable.
+var pingStorage = pingDB
+
+// startup records the progress of loading stored lobbies.
+var startup struct {
+	sync.Mutex
+	loaded  bool
+	loadErr error
+}
+
+// Readiness is the body of a readiness check.
+type Readiness struct {
+	Ready         bool   `json:"ready"`
+	Storage       string `json:"storage"`
+	LobbiesLoaded bool   `json:"lobbiesLoaded"`
+	LoadError     string `json:"loadError,omitempty"`
+	ShuttingDown  bool   `json:"shuttingDown,omitempty"`
+	Lobbies       int    `json:"lobbies"`
+	Goroutines    int    `json:"goroutines"`
+}
+
+// backoff returns how long to wait before the next attempt, doubling after each failed attempt.
+func backoff(attempt int) time.Duration {
+	wait := DB_RETRY_MIN
+	for i := 0; i < attempt && wait < DB_RETRY_MAX; i++ {
+		wait *= 2
+	}
+	if wait > DB_RETRY_MAX {
+		wait = DB_RETRY_MAX
+	}
+	return wait
+}
+
+// waitForDB blocks until the database responds, retrying with backoff.
+func waitForDB(ping func() error) {
+	for attempt := 0; ; attempt++ {
+		err := ping()
+		if err == nil {
+			return
+		}
+		wait := backoff(attempt)
+		log().Warn("Database not ready, retrying", "error", err, "attempt", attempt+1, "wait", wait)
+		time.Sleep(wait)
+	}
+}
+
+// loadLobbies waits for the database and applies any pending migrations, joins the cluster
+// if lobbies are shared with other nodes, then loads the stored lobbies and records the outcome.
+func loadLobbies() {
+	waitForDB(pingStorage)
+	var err error
+	if autoMigrate {
+		var version int
+		if version, err = migrateDB(); err != nil {
+			log().Error("Failed to migrate database", "error", err)
+			err = fmt.Errorf("failed to migrate database: %s", err)
+		} else {
+			log().Info("Database schema up to date", "version", version)
+		}
+	}
+	if err == nil && clustered() {
+		err = joinCluster()
+	}
+	if err == nil {
+		// A node only loads its own lobbies, others are adopted when they are requested.
+		node := ""
+		if clustered() {
+			node = self.ID
+		}
+		log().Info("Loading stored lobby states", "node", node)
+		lobbies := make(map[string]*Lobby)
+		err = loadFromDB(&lobbies, node)
+		// Lobbies loaded before any failure are still served.
+		for _, l := range lobbies {
+			putLobby(l)
+		}
+		if err != nil {
+			log().Error("Failed to load lobbies from db", "error", err)
+		} else {
+			log().Info("Lobby states loaded", "lobbies", lobbyCount())
+		}
+	}
+
+	startup.Lock()
+	startup.loaded = true
+	startup.loadErr = err
+	startup.Unlock()
+}
+
+// lobbiesLoaded returns true once loading stored lobbies has finished, along with any error.
+func lobbiesLoaded() (bool, error) {
+	startup.Lock()
+	defer startup.Unlock()
+	return startup.loaded, startup.loadErr
+}
+
+// requireLoaded rejects requests until stored lobbies have been loaded,
+// apart from the health, readiness and metrics endpoints.
+func requireLoaded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if loaded, _ := lobbiesLoaded(); !loaded && !startupRoutes[r.URL.Path] {
+			http.Error(w, "Server is starting", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Healthz reports that the process is running.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// Readyz reports whether the server can serve lobbies: the database is reachable,
+// stored lobbies loaded without error and the server isn't shutting down.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	loaded, loadErr := lobbiesLoaded()
+	readiness := Readiness{
+		Storage:       "ok",
+		LobbiesLoaded: loaded,
+		ShuttingDown:  isShuttingDown(),
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	if loaded {
+		readiness.Lobbies = lobbyCount()
+	}
+	if loadErr != nil {
+		readiness.LoadError = loadErr.Error()
+	}
+	storageErr := pingStorage()
+	if storageErr != nil {
+		readiness.Storage = storageErr.Error()
+	}
+	readiness.Ready = loaded && loadErr == nil && storageErr == nil && !readiness.ShuttingDown
+
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, DB_RETRY_MIN},
+		{1, 2 * DB_RETRY_MIN},
+		{3, 8 * DB_RETRY_MIN},
+		{100, DB_RETRY_MAX},
+	}
+
+	for _, tc := range testCases {
+		if got := backoff(tc.attempt); got != tc.want {
+			t.Errorf("backoff(%d), got: %s, want: %s", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+// setStartup sets the progress of loading lobbies, returning a function to reset it.
+func setStartup(loaded bool, err error) func() {
+	startup.Lock()
+	startup.loaded, startup.loadErr = loaded, err
+	startup.Unlock()
+	return func() { setStartup(false, nil) }
+}
+
+func TestReadyz(t *testing.T) {
+	defer func() { pingStorage = pingDB }()
+
+	testCases := []struct {
+		name     string
+		loaded   bool
+		loadErr  error
+		pingErr  error
+		wantCode int
+	}{
+		{"ready", true, nil, nil, http.StatusOK},
+		{"loading", false, nil, nil, http.StatusServiceUnavailable},
+		{"load failed", true, errors.New("bad row"), nil, http.StatusServiceUnavailable},
+		{"storage down", true, nil, errors.New("refused"), http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		reset := setStartup(tc.loaded, tc.loadErr)
+		pingStorage = func() error { return tc.pingErr }
+
+		rec := httptest.NewRecorder()
+		Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+		readiness := Readiness{}
+		if err := json.NewDecoder(rec.Body).Decode(&readiness); err != nil {
+			t.Fatalf("%s: failed to decode readiness: %s", tc.name, err)
+		}
+		if rec.Code != tc.wantCode || readiness.Ready != (tc.wantCode == http.StatusOK) {
+			t.Errorf("%s: got code: %d, ready: %t, want code: %d", tc.name, rec.Code, readiness.Ready, tc.wantCode)
+		}
+		if readiness.Goroutines == 0 {
+			t.Errorf("%s: goroutine count missing", tc.name)
+		}
+		reset()
+	}
+}
+
+func TestRequireLoaded(t *testing.T) {
+	handler := requireLoaded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	testCases := []struct {
+		path     string
+		loaded   bool
+		wantCode int
+	}{
+		{"/lobbies", false, http.StatusServiceUnavailable},
+		{"/healthz", false, http.StatusOK},
+		{"/lobbies", true, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		reset := setStartup(tc.loaded, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.wantCode {
+			t.Errorf("%s when loaded is %t, got: %d, want: %d", tc.path, tc.loaded, rec.Code, tc.wantCode)
+		}
+		reset()
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Events sent to clients over the HTTP transports.
+const (
+	EVENT_SESSION = "session"
+	EVENT_MESSAGE = "message"
+	EVENT_CLOSE   = "close"
+)
+
+// The maximum number of events waiting to be fetched by an HTTP client.
+const HTTP_OUTBOX_SIZE = 64
+
+// How long writing an event waits for room in a full outbox before giving up on the client.
+const HTTP_WRITE_TIMEOUT = 10 * time.Second
+
+// How long a poll waits for an event before returning none.
+const POLL_WAIT = 25 * time.Second
+
+// Long-poll sessions that haven't polled for this long are closed.
+const SESSION_IDLE_TIMEOUT = 60 * time.Second
+
+// How often a comment is sent on an idle event stream, so proxies don't close it.
+const SSE_KEEPALIVE = 15 * time.Second
+
+// The largest command a client can post.
+const MAX_COMMAND_BYTES = 64 << 10
+
+var errTransportClosed = errors.New("transport closed")
+
+// httpEvent is a message or notice sent to a client over one of the HTTP transports.
+type httpEvent struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// httpClose is the data of a close event, matching a websocket close frame.
+type httpClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// httpConn is a Transport for clients that can't open a websocket. Messages are sent to the
+// client as events, either streamed with Server-Sent Events or fetched by long-polling,
+// and the client posts its messages. Messages are always encoded as JSON.
+type httpConn struct {
+	session string
+	// ID of the lobby the session joined. Sessions are only reached through their lobby's URL,
+	// which routes requests to the node holding the session.
+	lobbyID string
+	events  chan httpEvent
+	inbox   chan []byte
+	closed  chan struct{}
+	// Time in millis the client last polled, unused when events are streamed.
+	lastPoll  int64
+	closeOnce sync.Once
+}
+
+// The HTTP transports' connections by session ID, which clients use to post messages and poll.
+var httpSessions = struct {
+	sync.Mutex
+	conns map[string]*httpConn
+}{conns: make(map[string]*httpConn)}
+
+// newHTTPConn opens a connection to the lobby under a new session ID.
+func newHTTPConn(lobbyID string) (*httpConn, error) {
+	// Session IDs are all that's needed to post as the client, so they mustn't be guessable.
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %s", err)
+	}
+	conn := &httpConn{
+		session:  hex.EncodeToString(b),
+		lobbyID:  lobbyID,
+		events:   make(chan httpEvent, HTTP_OUTBOX_SIZE),
+		inbox:    make(chan []byte),
+		closed:   make(chan struct{}),
+		lastPoll: NowMillis(),
+	}
+	httpSessions.Lock()
+	httpSessions.conns[conn.session] = conn
+	httpSessions.Unlock()
+	return conn, nil
+}
+
+// httpSession returns the connection of the session.
+func httpSession(session string) (*httpConn, bool) {
+	httpSessions.Lock()
+	defer httpSessions.Unlock()
+	conn, ok := httpSessions.conns[session]
+	return conn, ok
+}
+
+// lobbySession returns the connection of the session if it joined the lobby, otherwise writes a 404 response.
+func lobbySession(w http.ResponseWriter, lobbyID string, session string) (*httpConn, bool) {
+	conn, ok := httpSession(session)
+	if !ok || conn.lobbyID != lobbyID {
+		http.Error(w, "Session does not exist", http.StatusNotFound)
+		return nil, false
+	}
+	return conn, true
+}
+
+// dropSession forgets the session, once the client has been sent every event or has gone.
+func dropSession(session string) {
+	httpSessions.Lock()
+	defer httpSessions.Unlock()
+	delete(httpSessions.conns, session)
+}
+
+// Subprotocol returns the JSON subprotocol, as events are text.
+func (c *httpConn) Subprotocol() string {
+	return SUBPROTOCOL_JSON
+}
+
+// ReadMessage waits for the client to post a message.
+func (c *httpConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-c.inbox:
+		return websocket.TextMessage, data, nil
+	case <-c.closed:
+		return 0, nil, errTransportClosed
+	}
+}
+
+// WriteMessage queues a message event for the client.
+func (c *httpConn) WriteMessage(messageType int, data []byte) error {
+	return c.queue(httpEvent{Event: EVENT_MESSAGE, Data: data}, time.Now().Add(HTTP_WRITE_TIMEOUT))
+}
+
+// WriteControl queues a close event for the client if the message is a close frame.
+// Other control messages are only needed by websockets, so are ignored.
+func (c *httpConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != websocket.CloseMessage {
+		return nil
+	}
+	closing := httpClose{Code: websocket.CloseNormalClosure}
+	if len(data) >= 2 {
+		closing.Code = int(binary.BigEndian.Uint16(data))
+		closing.Reason = string(data[2:])
+	}
+	encoded, err := json.Marshal(closing)
+	if err != nil {
+		return err
+	}
+	return c.queue(httpEvent{Event: EVENT_CLOSE, Data: encoded}, deadline)
+}
+
+// queue adds the event to the events waiting to be fetched, waiting until the deadline if there are too many.
+func (c *httpConn) queue(e httpEvent, deadline time.Time) error {
+	if c.isClosed() {
+		return errTransportClosed
+	}
+	select {
+	case c.events <- e:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case c.events <- e:
+		return nil
+	case <-c.closed:
+		return errTransportClosed
+	case <-timer.C:
+		return errors.New("timed out waiting for client to fetch events")
+	}
+}
+
+// deliver passes a message posted by the client to the reader.
+func (c *httpConn) deliver(data []byte) error {
+	select {
+	case c.inbox <- data:
+		return nil
+	case <-c.closed:
+		return errTransportClosed
+	}
+}
+
+// Close ends the connection. Events already queued can still be fetched.
+func (c *httpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// isClosed returns true once the connection has been closed.
+func (c *httpConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextEvents waits up to the provided time for an event, then returns every event waiting.
+func (c *httpConn) nextEvents(wait time.Duration) []httpEvent {
+	if events := c.waitingEvents(); len(events) > 0 || wait <= 0 {
+		return events
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case e := <-c.events:
+		return append([]httpEvent{e}, c.waitingEvents()...)
+	case <-c.closed:
+		return c.waitingEvents()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitingEvents returns the events already waiting, without waiting for more.
+func (c *httpConn) waitingEvents() []httpEvent {
+	var events []httpEvent
+	for {
+		select {
+		case e := <-c.events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+// watchIdle closes a long-poll session once the client stops polling.
+// Should be called asynchronously.
+func (c *httpConn) watchIdle() {
+	ticker := time.NewTicker(SESSION_IDLE_TIMEOUT / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if NowMillis()-atomic.LoadInt64(&c.lastPoll) > SESSION_IDLE_TIMEOUT.Milliseconds() {
+			c.Close()
+			dropSession(c.session)
+			return
+		}
+	}
+}
+
+// joinOverHTTP checks the lobby can be joined, then opens an HTTP connection and joins the lobby with it.
+// The join includes the clock handshake, which needs the client to fetch events and reply, so it
+// is performed in the background. Writes an error response and returns nil if the lobby can't be joined.
+func joinOverHTTP(w http.ResponseWriter, r *http.Request, transport string) *httpConn {
+	id := mux.Vars(r)["id"]
+	username := r.URL.Query().Get("username")
+	opts := joinOptions(r)
+	log().Info("JoinLobby request received", "lobby", id, "username", username, "protocol", opts.Protocol,
+		"stateDiffs", opts.StateDiffs, "spectator", opts.Spectator, "transport", transport)
+
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+	if strings.TrimSpace(username) == "" {
+		http.Error(w, "A username is required", http.StatusBadRequest)
+		return nil
+	}
+	lobby, ok := getLobby(id)
+	if !ok {
+		log().Warn("Lobby does not exist", "lobby", id)
+		http.Error(w, "Lobby does not exist", http.StatusNotFound)
+		return nil
+	}
+	conn, err := newHTTPConn(lobby.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	go func() {
+		client := lobby.join(conn, username, opts)
+		log().Info("Client joined lobby", "lobby", lobby.ID, "username", client.Username, "transport", transport)
+	}()
+	return conn
+}
+
+// StreamLobbyEvents joins a lobby and streams messages to the client with Server-Sent Events,
+// for clients that can't open a websocket. The first event carries the session ID, which the
+// client uses to post its messages. The client leaves the lobby when it closes the stream.
+func StreamLobbyEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	conn := joinOverHTTP(w, r, "sse")
+	if conn == nil {
+		return
+	}
+	defer dropSession(conn.session)
+	defer conn.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeSSE(w, sessionEvent(conn.session))
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-conn.events:
+			writeSSE(w, e)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-conn.closed:
+			// Send anything queued before the connection closed, such as a close event.
+			for _, e := range conn.waitingEvents() {
+				writeSSE(w, e)
+			}
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// CreatePollSession joins a lobby for a client that fetches messages by long-polling,
+// responding with the session ID the client polls and posts its messages with.
+func CreatePollSession(w http.ResponseWriter, r *http.Request) {
+	conn := joinOverHTTP(w, r, "poll")
+	if conn == nil {
+		return
+	}
+	go conn.watchIdle()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"session": conn.session})
+}
+
+// PollSession responds with the events waiting for a long-polling client, waiting for one if there are none.
+// Responds with 410 Gone once the session has closed and every event has been fetched.
+func PollSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	conn, ok := lobbySession(w, vars["id"], vars["sid"])
+	if !ok {
+		return
+	}
+	pollEvents(w, conn, POLL_WAIT)
+}
+
+// pollEvents writes the events waiting for the client, waiting up to the provided time for one.
+func pollEvents(w http.ResponseWriter, conn *httpConn, wait time.Duration) {
+	atomic.StoreInt64(&conn.lastPoll, NowMillis())
+	events := conn.nextEvents(wait)
+	atomic.StoreInt64(&conn.lastPoll, NowMillis())
+
+	if len(events) == 0 && conn.isClosed() {
+		dropSession(conn.session)
+		http.Error(w, "Session closed", http.StatusGone)
+		return
+	}
+	if events == nil {
+		events = []httpEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// PostSessionMessage passes a message from an HTTP client to its lobby, as if read from a websocket.
+// The body is a single message encoded as JSON, in the client's protocol version.
+func PostSessionMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	conn, ok := lobbySession(w, vars["id"], vars["sid"])
+	if !ok {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_COMMAND_BYTES))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read message: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := conn.deliver(data); err != nil {
+		http.Error(w, "Session closed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sessionEvent returns the event telling a client its session ID.
+func sessionEvent(session string) httpEvent {
+	data, _ := json.Marshal(map[string]string{"session": session})
+	return httpEvent{Event: EVENT_SESSION, Data: data}
+}
+
+// writeSSE writes the event in the Server-Sent Events format. The data is JSON, so is on a single line.
+func writeSSE(w http.ResponseWriter, e httpEvent) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, e.Data)
+}
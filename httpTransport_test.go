@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHTTPConn_CarriesClientMessages(t *testing.T) {
+	suppressLogging()
+	conn, err := newHTTPConn("LOBY")
+	if err != nil {
+		t.Fatalf("newHTTPConn returned error: %s", err)
+	}
+	defer dropSession(conn.session)
+	c := &Client{Conn: conn, Lobby: &Lobby{}, Codec: codecForSubprotocol(conn.Subprotocol()),
+		outboxReady: make(chan struct{}, 1), done: make(chan struct{})}
+	go c.writeOutgoingMessages()
+	defer c.Close()
+
+	c.Send(Message{UserMsg: "hello"})
+	rec := httptest.NewRecorder()
+	pollEvents(rec, conn, time.Second)
+	var events []httpEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatalf("Failed to decode events: %s", err)
+	}
+	if len(events) != 1 || events[0].Event != EVENT_MESSAGE || !strings.Contains(string(events[0].Data), "hello") {
+		t.Errorf("Incorrect events, got: %s", events)
+	}
+
+	go conn.deliver([]byte(`{"userMsg":"hi"}`))
+	msg := Message{}
+	if err := c.read(&msg); err != nil {
+		t.Fatalf("Failed to read posted message: %s", err)
+	}
+	if msg.UserMsg != "hi" {
+		t.Errorf("Incorrect message read, got: %#v", msg)
+	}
+}
+
+func TestHTTPConn_CloseEvent(t *testing.T) {
+	conn, _ := newHTTPConn("LOBY")
+	defer dropSession(conn.session)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, RESTART_NOTICE), time.Now())
+	conn.Close()
+
+	if _, _, err := conn.ReadMessage(); err != errTransportClosed {
+		t.Errorf("Read from closed connection, got: %v, want: %v", err, errTransportClosed)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{}")); err == nil {
+		t.Errorf("Write to closed connection not rejected")
+	}
+
+	// Events queued before closing can still be fetched.
+	rec := httptest.NewRecorder()
+	pollEvents(rec, conn, time.Second)
+	var events []httpEvent
+	json.NewDecoder(rec.Body).Decode(&events)
+	if len(events) != 1 || events[0].Event != EVENT_CLOSE {
+		t.Fatalf("Close event not returned, got: %s", events)
+	}
+	closing := httpClose{}
+	json.Unmarshal(events[0].Data, &closing)
+	if closing.Code != websocket.CloseServiceRestart || closing.Reason != RESTART_NOTICE {
+		t.Errorf("Incorrect close event, got: %+v", closing)
+	}
+
+	rec = httptest.NewRecorder()
+	pollEvents(rec, conn, time.Second)
+	if rec.Code != http.StatusGone {
+		t.Errorf("Poll of drained closed session, got: %d, want: %d", rec.Code, http.StatusGone)
+	}
+	if _, ok := httpSession(conn.session); ok {
+		t.Errorf("Drained closed session not dropped")
+	}
+}
+
+func TestPollEvents_NoneWaiting(t *testing.T) {
+	conn, _ := newHTTPConn("LOBY")
+	defer dropSession(conn.session)
+
+	rec := httptest.NewRecorder()
+	pollEvents(rec, conn, time.Millisecond)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("Incorrect empty poll, got code: %d, body: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWriteSSE(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeSSE(rec, sessionEvent("abc"))
+	want := "event: session\ndata: {\"session\":\"abc\"}\n\n"
+	if rec.Body.String() != want {
+		t.Errorf("Incorrect event, got: %q, want: %q", rec.Body.String(), want)
+	}
+}
+
+func TestLobbySession(t *testing.T) {
+	conn, _ := newHTTPConn("LOBY")
+	defer dropSession(conn.session)
+
+	testCases := []struct {
+		name     string
+		lobbyID  string
+		session  string
+		wantConn bool
+	}{
+		{"session of lobby", "LOBY", conn.session, true},
+		{"session of another lobby", "OTHR", conn.session, false},
+		{"no session", "LOBY", "none", false},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		got, ok := lobbySession(rec, tc.lobbyID, tc.session)
+		if ok != tc.wantConn || (ok && got != conn) {
+			t.Errorf("%s: got session: %t, want: %t", tc.name, ok, tc.wantConn)
+		}
+		if !ok && rec.Code != http.StatusNotFound {
+			t.Errorf("%s: incorrect code, got: %d, want: %d", tc.name, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestJoinOverHTTP_RequiresUsername(t *testing.T) {
+	suppressLogging()
+	rec := httptest.NewRecorder()
+	if conn := joinOverHTTP(rec, httptest.NewRequest("POST", "/lobbies/LOBY/sessions?username=", nil), "poll"); conn != nil {
+		dropSession(conn.session)
+		t.Errorf("Session created without a username")
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Incorrect code, got: %d, want: %d", rec.Code, http.StatusBadRequest)
+	}
+}
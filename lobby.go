@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 // Go equivalent to enum.
@@ -15,6 +17,10 @@ const (
 	ADMIN_CONTROLLED LobbyMode = iota + 1
 	FREE_FOR_ALL
 	ROUND_ROBIN
+	// Members vote on queued tracks, and the queue is ordered by score.
+	DEMOCRACY
+	// Members take turns as the DJ, who alone chooses the tracks.
+	DJ_ROTATION
 )
 
 // The amount of delay in millis to be added to a command.
@@ -27,6 +33,8 @@ type Lobby struct {
 	LobbyMode    LobbyMode          `json:"lobbyMode"`
 	Genre        string             `json:"genre"`
 	Public       bool               `json:"public"`
+	Providers    []string           `json:"providers"`
+	Rules        QueueRules         `json:"rules"`
 	Admin        string             `json:"admin"`
 	CurrentTrack *Track             `json:"currentTrack"`
 	TrackQueue   TrackQueue         `json:"trackQueue"`
@@ -36,41 +44,117 @@ type Lobby struct {
 	ClientNames []string
 	SkipVotes   map[string]bool `json"-"`
 	NumMembers  int             `json:"numMembers"`
-	InMsgs      chan Message    `json:"-"`
-	TrackTimer  *MillisTimer    `json:"-"`
+	// Clients that only listen. They aren't members, so have no say in the lobby and aren't listed as users.
+	Spectators    map[*Client]bool `json:"-"`
+	NumSpectators int              `json:"numSpectators"`
+	InMsgs        chan Message     `json:"-"`
+	TrackTimer    *MillisTimer     `json:"-"`
+	// Functions run on the lobby goroutine between client messages, see do.
+	tasks chan func()
+	// Closed once the lobby has stopped for good, ending its goroutine, see stop.
+	done chan struct{}
+	// Starts the track timer once clients begin playing the current track.
+	trackStart *time.Timer
+	// Set once the lobby stops playing, for shutdown or because another node adopted it.
+	// Timers run off the lobby goroutine, so it is read and written atomically.
+	stopped int32
+	// Votes of each member on queued tracks in a democracy lobby.
+	// Replaced rather than updated, as the queue may be being written to the database.
+	QueueVotes map[*Track]map[string]int `json:"-"`
+	// Strategy used to pick tracks when the queue is empty, off if empty.
+	Autoplay string `json:"autoplay"`
+	// Most recently played tracks, oldest first.
+	History []*Track `json:"-"`
+	// Most recent chat messages, oldest first.
+	ChatHistory []ChatMessage `json:"-"`
+	// Tracks played in order by the playlist autoplay strategy.
+	FallbackPlaylist []*Track `json:"-"`
+	fallbackIndex    int
+	// Member currently choosing the tracks in a DJ rotation lobby.
+	DJ string `json:"dj"`
+	// Members waiting for a turn as DJ, in order.
+	DJWaitlist []string   `json:"djWaitlist"`
+	DJRotation DJRotation `json:"djRotation"`
+	// Members who gave each reaction to the current track.
+	// Replaced rather than updated, as the counts may be being sent.
+	Reactions map[string]map[string]bool `json:"-"`
+	// Time the current track started playing, identifying the play in the history.
+	playedAt int64
+	// Time in millis the current track started from its beginning, or would have
+	// if it was resumed part way through. Saved so playback can resume after a restart.
+	trackStartedAt int64
+	// Millis into the current track it was started from, non-zero if it was resumed.
+	trackOffset int64
+	// Members who have voted to pass the DJ seat on early.
+	DJPassVotes    map[string]bool `json:"-"`
+	djTracksPlayed int
+	djTurnStart    int64
+	// Writes changes to the queue to the database, in order.
+	queueWriter *queueWriter
+	// Writes of the current track in progress, which the position saved at shutdown must follow.
+	currentTrackWrites sync.WaitGroup
+	// Writes reactions to the current track to the database, in order.
+	reactionWriter *reactionWriter
+	// Entry ID given to the next queued track.
+	nextEntry int64
+	// Versions the state sent to clients, so that clients can be sent only what changed.
+	StateLog *StateLog `json:"-"`
+	// Sequence number of the last broadcast.
+	// Broadcasts happen from timers as well as the lobby goroutine, so it is updated atomically.
+	seq uint64
 }
 
-func NewLobby(id string, name string, lobbyMode LobbyMode, genre string, public bool, admin string, track *Track) *Lobby {
+func NewLobby(id string, name string, lobbyMode LobbyMode, genre string, public bool, admin string) *Lobby {
 	lobby := Lobby{
-		ID:         id,
-		Name:       name,
-		LobbyMode:  lobbyMode,
-		Genre:      genre,
-		Public:     public,
-		Admin:      admin,
-		TrackQueue: TrackQueue{},
-		Clients:    make(map[string]*Client),
-		SkipVotes:  make(map[string]bool),
-		NumMembers: 0,
-		InMsgs:     make(chan Message, 10),
+		ID:             id,
+		Name:           name,
+		LobbyMode:      lobbyMode,
+		Genre:          genre,
+		Public:         public,
+		Admin:          admin,
+		TrackQueue:     TrackQueue{},
+		Clients:        make(map[string]*Client),
+		SkipVotes:      make(map[string]bool),
+		DJPassVotes:    make(map[string]bool),
+		StateLog:       &StateLog{},
+		NumMembers:     0,
+		Spectators:     make(map[*Client]bool),
+		InMsgs:         make(chan Message, 10),
+		tasks:          make(chan func()),
+		done:           make(chan struct{}),
+		queueWriter:    newQueueWriter(id, genre),
+		reactionWriter: newReactionWriter(id),
 	}
 
 	// TODO maybe this should be moved to where lobbies are created
 	go lobby.listenForClientMsgs()
 
-	// Check if we are resuming a lobby with an existing track.
-	if track != nil {
-		msg := Message{}
-		lobby.playTrack(&msg, track)
-		lobby.sendToAll(msg)
-	}
 	return &lobby
 }
 
-func (l *Lobby) join(conn *websocket.Conn, username string) Client {
+// resume continues playing a track restored from the database, from the provided position in millis.
+// If the track would have ended while the server was down, the next track is played instead.
+func (l *Lobby) resume(track *Track, position int64) {
+	msg := Message{}
+	if position >= track.Duration-1000 {
+		l.log().Info("Restored track has ended, playing next track", "track", track.URI, "position", position)
+		l.playNext(&msg)
+	} else {
+		l.log().Info("Resuming track", "track", track.URI, "position", position)
+		l.playTrackFrom(&msg, track, position)
+	}
+	l.sendToAll(msg)
+}
+
+func (l *Lobby) join(conn Transport, username string, opts JoinOptions) *Client {
 	// Each client shares the same InMsg channel, allowing the server to
 	// conveniently read from all clients.
-	client := NewClient(conn, username, l)
+	client := NewClient(conn, username, l, opts)
+	if client.Spectator {
+		l.spectate(client)
+		return client
+	}
+	l.sendChatHistory(client)
 
 	// Inform clients that a new user has joined.
 	l.sendServerMessage(fmt.Sprintf("%s has joined the lobby.", username))
@@ -78,23 +162,29 @@ func (l *Lobby) join(conn *websocket.Conn, username string) Client {
 	// Read messages from the new client.
 	go func() {
 		err := client.ReadIncomingMessages()
-		l.log(fmt.Sprintf("%s disconnected: %s", client.Username, err))
+		l.log().Info("Client disconnected", "username", client.Username, "error", err)
 		l.sendServerMessage(fmt.Sprintf("%s disconnected.", client.Username))
-		l.disconnect(&client)
+		l.disconnect(client)
 	}()
 
 	l.NumMembers++
-	l.Clients[username] = &client
+	connectedClients.Inc()
+	l.Clients[username] = client
 	l.ClientNames = append(l.ClientNames, username)
+	l.StateLog.Record(StateDiff{Op: DIFF_MEMBER_JOIN, Username: username})
 
 	// Make this user the admin if there is none.
 	if l.Admin == "" {
 		l.promoteToAdmin(username)
 	}
+	// Likewise give the DJ seat to this user if nobody has it.
+	if l.LobbyMode == DJ_ROTATION && l.DJ == "" {
+		l.setDJ(username)
+	}
 
 	// Send the initial state of the lobby to the client.
 	// Disabled for now, as the client requests state instead.
-	//l.sendInitialState(&client)
+	//l.sendInitialState(client)
 
 	// Update all clients' state to inform them of the new client.
 	l.sendStateToAll()
@@ -102,8 +192,42 @@ func (l *Lobby) join(conn *websocket.Conn, username string) Client {
 	return client
 }
 
+// spectate adds a client that only listens to the lobby, then sends it the current state with the
+// command to start playing, as a spectator may not be able to request state itself.
+// Members aren't told, as spectators aren't members.
+func (l *Lobby) spectate(client *Client) {
+	go func() {
+		err := client.ReadIncomingMessages()
+		l.log().Info("Spectator disconnected", "username", client.Username, "error", err)
+		l.stopSpectating(client)
+	}()
+
+	l.Spectators[client] = true
+	l.NumSpectators++
+	connectedClients.Inc()
+
+	stateMsg := Message{}
+	l.setStateMessageWithCommand(&stateMsg)
+	stateMsg.Seq = l.currentSeq()
+	client.Send(stateMsg)
+}
+
+// stopSpectating removes a spectator from the lobby.
+func (l *Lobby) stopSpectating(client *Client) {
+	if l.Spectators[client] {
+		delete(l.Spectators, client)
+		l.NumSpectators--
+		connectedClients.Dec()
+	}
+	// Stop the client's writer, discarding anything left in its outbox.
+	client.Close()
+}
+
 // Remove the client from the active lobby clients and update state for other clients.
 func (l *Lobby) disconnect(client *Client) {
+	// Stop the client's writer, discarding anything left in its outbox.
+	client.Close()
+
 	delete(l.Clients, client.Username)
 	// Find and delete the users name from ClientNames.
 	for i, name := range l.ClientNames {
@@ -112,17 +236,21 @@ func (l *Lobby) disconnect(client *Client) {
 			break
 		}
 	}
+	l.StateLog.Record(StateDiff{Op: DIFF_MEMBER_LEAVE, Username: client.Username})
 	l.NumMembers--
+	connectedClients.Dec()
 
 	// Remove any outstanding votes for this client.
 	delete(l.SkipVotes, client.Username)
+	l.leaveDJRotation(client.Username)
 
 	// Check if we need to promote someone to admin.
 	if client.Username == l.Admin {
 		// No clients left in the lobby, clear the admin spot.
 		if len(l.Clients) == 0 {
-			l.log("Lobby empty, clearing admin spot")
+			l.log().Info("Lobby empty, clearing admin spot")
 			l.Admin = ""
+			l.StateLog.Record(StateDiff{Op: DIFF_ADMIN})
 		} else {
 			// Go maps are randomly ordered, so this will select a random client.
 			for newAdmin := range l.Clients {
@@ -139,33 +267,119 @@ func (l *Lobby) disconnect(client *Client) {
 // and performs actions based on their content.
 func (l *Lobby) listenForClientMsgs() {
 	for {
-		l.log("Waiting for client message")
-		inMsg := <-l.InMsgs
+		l.log().Debug("Waiting for client message")
+		var inMsg Message
+		select {
+		case task := <-l.tasks:
+			task()
+			continue
+		case inMsg = <-l.InMsgs:
+		case <-l.done:
+			return
+		}
+		messagesIn.WithLabelValues(inCommandLabel(inMsg)).Inc()
+		inMsgsDepth.WithLabelValues(l.ID).Set(float64(len(l.InMsgs)))
 		// TODO could do all this inside of a goroutine, otherwise a single thread is dealing with all user requests.
 		// Though maybe its better not to, to avoid race conditions.
 		outMsg := Message{Username: inMsg.Username}
 
-		// Send a user message to all users if exists.
-		if inMsg.UserMsg != "" {
-			l.sendUserMessage(inMsg.Username, inMsg.UserMsg)
+		// Record any state acknowledgement. A bare acknowledgement needs no response.
+		if inMsg.StateVersion != 0 {
+			if c, ok := l.Clients[inMsg.Username]; ok {
+				c.AckState(inMsg.StateVersion)
+			}
+			if inMsg.Command == 0 && inMsg.UserMsg == "" {
+				continue
+			}
+		}
+
+		// Clients that supplied a request ID receive a direct reply with the outcome.
+		// Chat commands are typed by hand, so their failures are also sent as a private message.
+		reply := Message{RequestID: inMsg.RequestID, Result: RESULT_OK}
+		fromChat := isChatCommand(inMsg.UserMsg)
+		respond := func() {
+			if fromChat && reply.Error != "" {
+				l.sendPrivateMessage(inMsg.Username, "%s", reply.Error)
+			}
+			l.reply(inMsg.Username, reply)
+		}
+
+		// Run a chat command as the command it stands for, otherwise send a user message to all users if exists.
+		var err error
+		if fromChat {
+			err = l.runChatCommand(&inMsg)
+		} else if inMsg.UserMsg != "" {
+			err = l.chat(inMsg.Username, inMsg.UserMsg)
+		}
+		if err != nil {
+			reply.Result = RESULT_REJECTED
+			reply.Error = err.Error()
+			// Chat usually has no request ID, so the user is told privately why it wasn't sent.
+			l.sendPrivateMessage(inMsg.Username, "%s", reply.Error)
+			l.reply(inMsg.Username, reply)
+			continue
 		}
 
 		// Parse the command and perform any necessary actions.
 		command := ClientCommand(inMsg.Command)
 		switch command {
 		case ADD_SONG:
-			switch l.LobbyMode {
-			case FREE_FOR_ALL:
-				l.queueOrPlay(&outMsg, inMsg.CurrentTrack)
-			case ADMIN_CONTROLLED:
-				// TODO return an error here if the user isn't an admin.
-				if inMsg.Username == l.Admin {
-					l.queueOrPlay(&outMsg, inMsg.CurrentTrack)
-				}
+			if err := l.canAddSongs(inMsg.Username); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			} else if err := l.checkTrack(inMsg.CurrentTrack); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			} else if err := l.checkQueueRules(inMsg.Username, []*Track{inMsg.CurrentTrack}); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			} else {
+				inMsg.CurrentTrack.Username = inMsg.Username
+				reply.Result = l.queueOrPlay(&outMsg, inMsg.CurrentTrack)
+			}
+		case IMPORT:
+			if err := l.canAddSongs(inMsg.Username); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			} else if result, err := l.importTracks(&outMsg, inMsg.Username, inMsg.TrackQueue); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			} else {
+				reply.Result = result
+			}
+		case UPVOTE, DOWNVOTE:
+			value := UPVOTE_VALUE
+			if command == DOWNVOTE {
+				value = DOWNVOTE_VALUE
+			}
+			if err := l.voteOnTrack(inMsg.Username, inMsg.CurrentTrack, value); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			}
+		case JOIN_WAITLIST:
+			if err := l.joinWaitlist(inMsg.Username); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			}
+		case LEAVE_WAITLIST:
+			if err := l.leaveWaitlist(inMsg.Username); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			}
+		case VOTE_PASS_DJ:
+			if err := l.votePassDJ(inMsg.Username); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
 			}
 		case VOTE_SKIP:
-			// Vote to skip works the same in all lobby modes.
-			l.log(fmt.Sprintf("Skip vote received from %s", inMsg.Username))
+			// The DJ controls playback, so can skip without a vote.
+			if l.LobbyMode == DJ_ROTATION && inMsg.Username == l.DJ {
+				l.sendServerMessageAndLog("%s skipped the track.", inMsg.Username)
+				l.playNext(&outMsg)
+				break
+			}
+			// Otherwise vote to skip works the same in all lobby modes.
+			l.log().Info("Skip vote received", "username", inMsg.Username)
 
 			// Only inform the lobby if this is a new vote.
 			var newVote bool
@@ -182,6 +396,8 @@ func (l *Lobby) listenForClientMsgs() {
 			if successful {
 				// Inform all users that the vote passed.
 				l.sendServerMessageAndLog("Skip vote passed.")
+				skipVotes.WithLabelValues(SKIP_PASSED).Inc()
+				l.SkipVotes = make(map[string]bool)
 				// Skip to the next song
 				l.playNext(&outMsg)
 			} else if newVote {
@@ -189,16 +405,49 @@ func (l *Lobby) listenForClientMsgs() {
 			}
 		case PROMOTE:
 			// TODO update this to not continue, and instead send from within this function.
-			if inMsg.Username == l.Admin {
-				l.promoteToAdmin(inMsg.Admin)
+			if inMsg.Username != l.Admin {
+				reply.Result = RESULT_REJECTED
+				reply.Error = "only the admin can promote other users"
+			} else if err := l.promoteToAdmin(inMsg.Admin); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
 			}
+			respond()
 			continue
+		case REACT:
+			if err := l.react(inMsg.Username, inMsg.Reaction); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			}
+		case KICK:
+			if err := l.kick(inMsg.Username, inMsg.Target); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			}
 		case STATE:
 			// For a state command, we only want to send the state to the client who requested it.
+			// The state is the reply, and carries the latest sequence number so the client
+			// can resynchronise after missing broadcasts.
+			// A full snapshot is always sent, as clients request state when they are out of sync.
 			l.setStateMessageWithCommand(&outMsg)
+			outMsg.RequestID = inMsg.RequestID
+			outMsg.Seq = l.currentSeq()
 			l.Clients[inMsg.Username].Send(outMsg)
 			continue
+		case SET_AUTOPLAY:
+			if inMsg.Username != l.Admin {
+				reply.Result = RESULT_REJECTED
+				reply.Error = "only the admin can change autoplay"
+			} else if err := l.setAutoplay(inMsg.Autoplay, inMsg.TrackQueue); err != nil {
+				reply.Result = RESULT_REJECTED
+				reply.Error = err.Error()
+			} else if l.Autoplay == AUTOPLAY_OFF {
+				l.sendServerMessageAndLog("Autoplay turned off.")
+			} else {
+				l.sendServerMessageAndLog("Autoplay set to %s.", l.Autoplay)
+			}
 		}
+		respond()
 
 		// No harm in always sending the current lobby state to ensure clients stay in sync with it.
 		l.setStateMessage(&outMsg)
@@ -208,10 +457,60 @@ func (l *Lobby) listenForClientMsgs() {
 	}
 }
 
+// receive passes a message from a client to the lobby goroutine.
+// Returns false if the lobby has stopped, as nothing will handle the message.
+func (l *Lobby) receive(msg Message) bool {
+	// InMsgs is buffered, so would still accept the message.
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	select {
+	case l.InMsgs <- msg:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// do runs the function on the lobby goroutine between client messages, so it can safely use the lobby's
+// state, and waits for it to finish. Returns false if the lobby has stopped or the context is done first,
+// in which case the function may still run later.
+func (l *Lobby) do(ctx context.Context, f func()) bool {
+	done := make(chan struct{})
+	select {
+	case l.tasks <- func() { f(); close(done) }:
+	case <-l.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reply sends the outcome of a request directly to the user who made it.
+// Nothing is sent if the request had no ID, as the client isn't expecting a reply.
+func (l *Lobby) reply(username string, msg Message) {
+	if msg.RequestID == "" {
+		return
+	}
+	if c, ok := l.Clients[username]; ok {
+		if err := c.Send(msg); err != nil {
+			l.log().Warn("Failed to send reply", "username", username, "msg", msg, "error", err)
+		}
+	}
+}
+
 // sendServerMessageAndLog sends the provided message to all users and logs it.
 func (l *Lobby) sendServerMessageAndLog(fmtMsg string, a ...interface{}) {
 	msg := fmt.Sprintf(fmtMsg, a...)
-	l.log(msg)
+	l.log().Info("Server message sent", "text", msg)
 	l.sendServerMessage(msg)
 }
 
@@ -230,8 +529,12 @@ func (l *Lobby) sendUserMessage(username string, msg string, a ...interface{}) {
 func (l *Lobby) SetCurrentTrack(track *Track) {
 	l.CurrentTrack = track
 
-	// Clear any outstanding votes to skip the previous track.
+	// Clear any outstanding votes to skip the previous track, and reactions to it.
+	if len(l.SkipVotes) > 0 {
+		skipVotes.WithLabelValues(SKIP_EXPIRED).Inc()
+	}
 	l.SkipVotes = make(map[string]bool)
+	l.Reactions = nil
 
 	// Update the database.
 	l.persistCurrentTrackState()
@@ -240,7 +543,18 @@ func (l *Lobby) SetCurrentTrack(track *Track) {
 // playTrack adds the track and PLAY command to the message struct, and calls SetCurrentTrack.
 // It then starts a timer to keep track of when the song will end.
 func (l *Lobby) playTrack(msg *Message, track *Track) {
-	l.log("Playing %#v", track)
+	l.playTrackFrom(msg, track, 0)
+}
+
+// playTrackFrom is playTrack, but starts the track the provided number of millis in.
+func (l *Lobby) playTrackFrom(msg *Message, track *Track, position int64) {
+	l.log().Info("Playing track", "track", track, "position", position)
+	// Clients start playing after the command delay, so that is when the track starts.
+	l.trackOffset = position
+	l.trackStartedAt = 0
+	if track != nil {
+		l.trackStartedAt = NowMillis() + COMMAND_DELAY - position
+	}
 	// Update lobby state with regards to the current track.
 	l.SetCurrentTrack(track)
 
@@ -254,6 +568,7 @@ func (l *Lobby) playTrack(msg *Message, track *Track) {
 	// Inform lobby that new track is playing.
 	l.sendServerMessage("Now playing: %s - %s", track.Name, track.Artist)
 
+	track.Position = position
 	msg.CurrentTrack = track
 	msg.Command = Command(PLAY)
 	msg.Timestamp = NowMillis() + COMMAND_DELAY
@@ -264,15 +579,25 @@ func (l *Lobby) playTrack(msg *Message, track *Track) {
 	}
 	// The track timer isn't started for 500ms, since clients won't start
 	// playing the song until that time.
-	l.log("Starting timer timer")
-	time.AfterFunc(millisToDuration(COMMAND_DELAY), func() {
-		l.log("Starting track timer: %s: %d", track.Name, track.Duration)
+	if l.trackStart != nil {
+		l.trackStart.Stop()
+	}
+	l.log().Debug("Starting timer timer")
+	l.trackStart = time.AfterFunc(millisToDuration(COMMAND_DELAY), func() {
+		// The lobby may have stopped before the timer could be cancelled.
+		if l.isStopped() {
+			return
+		}
+		l.log().Debug("Starting track timer", "track", track.URI, "duration", track.Duration)
 		// Set the timer for one second before the end of the song.
 		// This will hopefully allow the command for the next song to arrive
 		// before the song ends, preventing Spotify from issuing its own
 		// play command.
-		l.TrackTimer = NewMillisTimer(track.Duration-1000, func() {
-			l.log("Timer ended for %s, starting next song", track.Name)
+		l.TrackTimer = NewMillisTimer(track.Duration-position-1000, func() {
+			if l.isStopped() {
+				return
+			}
+			l.log().Debug("Track timer ended, starting next song", "track", track.URI)
 			l.TrackTimer = nil
 			msg := Message{}
 			l.playNext(&msg)
@@ -281,72 +606,261 @@ func (l *Lobby) playTrack(msg *Message, track *Track) {
 		})
 
 		// Re-send the server state 5 seconds after a song has started.
-		l.log("Starting state refresh timer")
+		l.log().Debug("Starting state refresh timer")
 		time.AfterFunc(millisToDuration(5000), func() {
-			l.log("Delayed state time expired")
+			if l.isStopped() {
+				return
+			}
+			l.log().Debug("Delayed state time expired")
 			l.sendStateToAll()
 		})
 	})
 }
 
-// playNext pops the next track from the queue, updates the database, and calls playTrack.
+// playNext pops the next track from the queue, records its removal, and calls playTrack.
+// If the queue is empty, a track is picked by the lobby's autoplay strategy instead.
 func (l *Lobby) playNext(msg *Message) {
+	l.rotateDJ(l.CurrentTrack)
 	var nextTrack *Track = nil
 	if !l.TrackQueue.IsEmpty() {
 		nextTrack = l.TrackQueue.Pop()
-		l.persistQueueState()
+		l.forgetVotes(nextTrack)
+		l.StateLog.Record(StateDiff{Op: DIFF_QUEUE_REMOVE, Index: 0})
+		l.queueWriter.remove(nextTrack)
+	} else {
+		nextTrack = l.nextAutoplayTrack()
+	}
+	if nextTrack != nil {
+		l.addToHistory(nextTrack)
 	}
 	l.playTrack(msg, nextTrack)
 }
 
+// canAddSongs returns an error if the user isn't allowed to add songs in this lobby's mode.
+func (l *Lobby) canAddSongs(username string) error {
+	switch l.LobbyMode {
+	case FREE_FOR_ALL, DEMOCRACY:
+		return nil
+	case DJ_ROTATION:
+		if username != l.DJ {
+			return errors.New("only the DJ can add songs in this lobby")
+		}
+		return nil
+	case ADMIN_CONTROLLED:
+		if username != l.Admin {
+			return errors.New("only the admin can add songs in this lobby")
+		}
+		return nil
+	}
+	return errors.New("adding songs is not supported in this lobby mode")
+}
+
+// checkTrack returns an error if the track can't be played in this lobby,
+// otherwise normalises it using the provider it belongs to and resolves its details.
+func (l *Lobby) checkTrack(track *Track) error {
+	if track == nil {
+		return errors.New("no track provided")
+	}
+	// Only the server sets these, so whatever the client sent is ignored.
+	track.Score = 0
+	track.Autoplayed = false
+	track.Position = 0
+	track.AddedAt = 0
+	provider, ok := providerForURI(track.URI)
+	if !ok {
+		return fmt.Errorf("%q is not from a supported provider", track.URI)
+	}
+	if !l.acceptsProvider(provider.Name()) {
+		return fmt.Errorf("this lobby does not accept %s tracks", provider.Name())
+	}
+	if err := provider.Validate(track.URI); err != nil {
+		return err
+	}
+	provider.Normalise(track)
+	// Checked once normalised, as that is the URI stored.
+	if len(track.URI) > MAX_URI_LENGTH {
+		return fmt.Errorf("track URIs can't be longer than %d characters", MAX_URI_LENGTH)
+	}
+	return resolveTrack(Resolver, track)
+}
+
+// acceptsProvider returns true if the lobby plays tracks from the named provider.
+// Lobbies without a list of providers accept all of them.
+func (l *Lobby) acceptsProvider(name string) bool {
+	if len(l.Providers) == 0 {
+		return true
+	}
+	for _, p := range l.Providers {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
 // queueOrPlay queues the track if another track is already playing, otherwise
-// plays it immediately.
-func (l *Lobby) queueOrPlay(msg *Message, track *Track) {
+// plays it immediately. Returns which of the two happened.
+func (l *Lobby) queueOrPlay(msg *Message, track *Track) string {
 	if l.CurrentTrack == nil {
+		l.addToHistory(track)
 		l.playTrack(msg, track)
-	} else {
-		l.addToQueue(track)
-		msg.Command = Command(QUEUE)
-		// This is redundant as the queue is currently always added, but that may be changed in future.
-		msg.TrackQueue = l.TrackQueue
+		return RESULT_PLAYED
 	}
+	l.addToQueue(track)
+	msg.Command = Command(QUEUE)
+	// This is redundant as the queue is currently always added, but that may be changed in future.
+	msg.TrackQueue = l.TrackQueue
+	return RESULT_QUEUED
 }
 
-func (l *Lobby) promoteToAdmin(newAdmin string) {
+func (l *Lobby) promoteToAdmin(newAdmin string) error {
 	// Check that the the user being promoted is actually a lobby member.
 	if _, ok := l.Clients[newAdmin]; !ok {
-		l.log(fmt.Sprintf("Failed to promote %s to admin, not a lobby member"))
-		return
+		l.log().Warn("Failed to promote to admin, not a lobby member", "username", newAdmin)
+		return fmt.Errorf("%s is not a lobby member", newAdmin)
 	}
 
 	l.Admin = newAdmin
+	l.StateLog.Record(StateDiff{Op: DIFF_ADMIN, Username: newAdmin})
 	l.sendServerMessageAndLog("%s promoted to admin", newAdmin)
 	l.sendStateToAll()
+	return nil
 }
 
 // addToQueue adds the provided track to the track queue.
 func (l *Lobby) addToQueue(track *Track) {
-	l.log(fmt.Sprintf("Adding track to queue: %#v", track))
-	l.TrackQueue.Push(track)
-	l.persistQueueState()
+	l.pushToQueue(track)
+}
+
+// pushToQueue adds the provided track to the track queue, and records it to be written to the database.
+// In a democracy lobby, the track is placed by its score rather than at the end.
+func (l *Lobby) pushToQueue(track *Track) {
+	l.log().Info("Adding track to queue", "track", track)
+	track.AddedAt = NowMillis()
+	// A newly queued track has no votes, so is ranked by its score of zero.
+	track.Score = 0
+	track.entry = l.nextEntry
+	l.nextEntry++
+	index := len(l.TrackQueue)
+	if l.LobbyMode == DEMOCRACY {
+		index = l.TrackQueue.rankedIndex(track)
+		l.TrackQueue = l.TrackQueue.Insert(index, track)
+	} else {
+		l.TrackQueue.Push(track)
+	}
+	l.rankQueued(index)
+	l.queueWriter.insert(track)
+	l.StateLog.Record(StateDiff{Op: DIFF_QUEUE_INSERT, Index: index, Track: track})
+}
+
+// rankQueued gives the track at index i a rank between those of its neighbours, so that
+// only its row needs writing to keep the stored queue in order. If there is no room
+// between them, the rest of the queue is given new ranks as well.
+func (l *Lobby) rankQueued(i int) {
+	if rank, ok := l.TrackQueue.rankAt(i); ok {
+		l.TrackQueue[i].rank = rank
+		return
+	}
+	l.log().Debug("Reranking queue", "length", len(l.TrackQueue))
+	for j, t := range l.TrackQueue {
+		t.rank = float64(j)
+		if j != i {
+			l.queueWriter.move(t)
+		}
+	}
+}
+
+// importTracks adds all the provided tracks to the queue.
+// Tracks are only added if every one of them is valid. If nothing is playing, the first
+// track is played straight away. Returns whether a track was played or they were all queued.
+func (l *Lobby) importTracks(msg *Message, username string, tracks []*Track) (string, error) {
+	if len(tracks) == 0 {
+		return "", errors.New("no tracks to import")
+	}
+	if len(tracks) > MAX_IMPORT_TRACKS {
+		return "", fmt.Errorf("cannot import more than %d tracks at once", MAX_IMPORT_TRACKS)
+	}
+	for i, track := range tracks {
+		if err := l.checkTrack(track); err != nil {
+			return "", fmt.Errorf("track %d: %s", i+1, err)
+		}
+		track.Username = username
+	}
+	if err := l.checkQueueRules(username, tracks); err != nil {
+		return "", err
+	}
+
+	result := RESULT_QUEUED
+	queued := tracks
+	if l.CurrentTrack == nil {
+		l.addToHistory(tracks[0])
+		l.playTrack(msg, tracks[0])
+		queued = tracks[1:]
+		result = RESULT_PLAYED
+	} else {
+		msg.Command = Command(QUEUE)
+	}
+	for _, track := range queued {
+		l.pushToQueue(track)
+	}
+
+	l.sendServerMessageAndLog("%s imported %d track(s).", username, len(tracks))
+	return result, nil
 }
 
 // Returns true if more than half the lobby members have voted to skip, otherwise false.
 func (l *Lobby) countVotes() (bool, int) {
-	successful := len(l.SkipVotes) > (l.NumMembers / 2)
-	required := (l.NumMembers / 2) + 1 - len(l.SkipVotes)
+	return l.votesPassed(len(l.SkipVotes))
+}
+
+// votesPassed returns true if the votes are from more than half the lobby members,
+// along with the number of further votes required otherwise.
+func (l *Lobby) votesPassed(votes int) (bool, int) {
+	successful := votes > (l.NumMembers / 2)
+	required := (l.NumMembers / 2) + 1 - votes
 	return successful, required
 }
 
-// sendToAll sends the provided message to all this lobby's clients.
+// sendToAll sends the provided message to all this lobby's clients, including spectators.
+// Each broadcast is given the next sequence number, allowing clients to detect missed messages.
 func (l *Lobby) sendToAll(msg Message) {
+	msg.Seq = atomic.AddUint64(&l.seq, 1)
 	for _, c := range l.Clients {
-		if err := c.Send(msg); err != nil {
-			l.log(fmt.Sprintf("Failed to send message %#v to %s: %s", msg, c.Username, err))
+		if err := c.Send(l.stateFor(c, msg)); err != nil {
+			l.log().Warn("Failed to send message", "username", c.Username, "msg", msg, "error", err)
+		}
+	}
+	for c := range l.Spectators {
+		if err := c.Send(l.stateFor(c, msg)); err != nil {
+			l.log().Warn("Failed to send message to spectator", "username", c.Username, "msg", msg, "error", err)
 		}
 	}
 }
 
+// stateFor tailors a broadcast to a client that receives state diffs, replacing the
+// queue, member list and admin with the changes since the client's acknowledged version.
+// Clients that haven't acknowledged a version recent enough still receive the full state.
+func (l *Lobby) stateFor(c *Client, msg Message) Message {
+	if !c.StateDiffs || !msg.hasState {
+		return msg
+	}
+	diffs, ok := l.StateLog.Since(c.AckedState(), msg.StateVersion)
+	if !ok {
+		return msg
+	}
+	msg.FullState = false
+	msg.TrackQueue = nil
+	msg.ClientNames = nil
+	msg.Admin = ""
+	msg.StateDiffs = diffs
+	return msg
+}
+
+// currentSeq returns the sequence number of the most recent broadcast.
+func (l *Lobby) currentSeq() uint64 {
+	return atomic.LoadUint64(&l.seq)
+}
+
 // setStateMessageWithCommand calls setStateMessage, but also
 // adds the relevant command to update play position.
 func (l *Lobby) setStateMessageWithCommand(msg *Message) {
@@ -365,18 +879,25 @@ func (l *Lobby) setStateMessage(msg *Message) {
 	// If there is a track timer running, add the position and a timestamp
 	// to the message.
 	if l.TrackTimer != nil && msg.CurrentTrack != nil {
-		msg.CurrentTrack.Position = l.TrackTimer.TimePassed(COMMAND_DELAY)
+		msg.CurrentTrack.Position = l.TrackTimer.TimePassed(COMMAND_DELAY + l.trackOffset)
 		msg.Timestamp = NowMillis() + COMMAND_DELAY
 	}
 	msg.TrackQueue = l.TrackQueue
 	msg.Admin = l.Admin
 	msg.ClientNames = l.ClientNames
+	msg.Autoplay = l.Autoplay
+	msg.DJ = l.DJ
+	msg.DJWaitlist = l.DJWaitlist
+	msg.Reactions = l.reactionCounts()
+	msg.StateVersion = l.StateLog.Version()
+	msg.FullState = true
+	msg.hasState = true
 }
 
 // sendStateWithCommandToAll sends the current state of the lobby to a client with
 // the relevant command to update play position.
 func (l *Lobby) sendStateWithCommandToAll() {
-	l.log("Sending state with command to all clients")
+	l.log().Debug("Sending state with command to all clients")
 	stateMsg := Message{}
 	l.setStateMessageWithCommand(&stateMsg)
 	l.sendToAll(stateMsg)
@@ -385,7 +906,7 @@ func (l *Lobby) sendStateWithCommandToAll() {
 // sendStateToAll sends the current state of the lobby to a client with no
 // commands attached.
 func (l *Lobby) sendStateToAll() {
-	l.log("Sending state to all clients")
+	l.log().Debug("Sending state to all clients")
 	stateMsg := Message{}
 	l.setStateMessage(&stateMsg)
 	l.sendToAll(stateMsg)
@@ -398,33 +919,49 @@ func (l *Lobby) sendInitialState(c *Client) {
 	if l.CurrentTrack != nil {
 		stateMsg.Command = Command(PLAY)
 	}
-	l.log(fmt.Sprintf("Sending lobby state to %s", c.Username))
+	l.log().Debug("Sending lobby state", "username", c.Username)
 	c.Send(stateMsg)
 }
 
 // persistCurrentTrackState asynchronously writes the current track to the database.
 func (l *Lobby) persistCurrentTrackState() {
-	go func() {
-		if err := persistCurrentTrack(l); err != nil {
-			l.log(fmt.Sprintf("Failed to persist current track: %s", err))
+	l.currentTrackWrites.Add(1)
+	goPersist(func() {
+		defer l.currentTrackWrites.Done()
+		if err := timePersist("current_track", func() error { return persistCurrentTrack(l) }); err != nil {
+			l.log().Error("Failed to persist current track", "error", err)
 			return
 		}
-		l.log("Current track state written to db")
-	}()
+		l.log().Debug("Current track state written to db")
+	})
 }
 
-// persistQueueState asynchronously writes the queue to the database.
-func (l *Lobby) persistQueueState() {
-	go func() {
-		if err := persistQueue(l); err != nil {
-			l.log(fmt.Sprintf("Failed to persist queue: %s", err))
+// persistPlay asynchronously records a play of the track in the database.
+// The time of the play is kept so reactions can be recorded against it.
+func (l *Lobby) persistPlay(track *Track) {
+	playedAt := NowMillis()
+	l.playedAt = playedAt
+	goPersist(func() {
+		if err := timePersist("play", func() error { return insertPlay(l.ID, l.Genre, track, playedAt) }); err != nil {
+			l.log().Error("Failed to persist play", "error", err)
 			return
 		}
-		l.log("Queue state written to db")
-	}()
+		l.log().Debug("Play written to db")
+	})
+}
+
+// persistAutoplayState asynchronously writes the autoplay strategy and fallback playlist to the database.
+func (l *Lobby) persistAutoplayState() {
+	goPersist(func() {
+		if err := timePersist("autoplay", func() error { return persistAutoplay(l) }); err != nil {
+			l.log().Error("Failed to persist autoplay", "error", err)
+			return
+		}
+		l.log().Debug("Autoplay state written to db")
+	})
 }
 
-// log logs a message with the lobby ID prefixed.
-func (l *Lobby) log(msg string, a ...interface{}) {
-	log.Printf(fmt.Sprintf("%s: %s", l.ID, msg), a...)
+// log returns a logger that adds the lobby ID to each log.
+func (l *Lobby) log() *slog.Logger {
+	return log().With("lobby", l.ID)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -59,3 +60,186 @@ func TestCountVotes(t *testing.T) {
 		}
 	}
 }
+
+func TestSendToAll_IncrementsSeq(t *testing.T) {
+	l := Lobby{}
+	l.sendToAll(Message{})
+	l.sendToAll(Message{})
+	if got := l.currentSeq(); got != 2 {
+		t.Errorf("Incorrect sequence number after two broadcasts, got: %d, want: %d", got, 2)
+	}
+}
+
+func TestStateFor(t *testing.T) {
+	l := Lobby{StateLog: &StateLog{}, Admin: "a", ClientNames: []string{"a"}}
+	l.StateLog.Record(StateDiff{Op: DIFF_MEMBER_JOIN, Username: "a"})
+	l.StateLog.Record(StateDiff{Op: DIFF_ADMIN, Username: "a"})
+	msg := Message{}
+	l.setStateMessage(&msg)
+
+	testCases := []struct {
+		name          string
+		client        *Client
+		wantFullState bool
+		wantDiffs     int
+	}{
+		{"full state client", &Client{ackedVersion: 1}, true, 0},
+		{"diff client without state", &Client{StateDiffs: true}, true, 0},
+		{"diff client behind", &Client{StateDiffs: true, ackedVersion: 1}, false, 1},
+	}
+
+	for _, tc := range testCases {
+		got := l.stateFor(tc.client, msg)
+		if got.FullState != tc.wantFullState || len(got.StateDiffs) != tc.wantDiffs {
+			t.Errorf("%s: got full state: %t, diffs: %d, want: %t, %d", tc.name, got.FullState, len(got.StateDiffs), tc.wantFullState, tc.wantDiffs)
+		}
+		if !got.FullState && (got.Admin != "" || got.ClientNames != nil) {
+			t.Errorf("%s: diff message still carries full state", tc.name)
+		}
+	}
+}
+
+func TestCheckTrack(t *testing.T) {
+	testCases := []struct {
+		name      string
+		providers []string
+		track     *Track
+		wantErr   bool
+	}{
+		{"no track", nil, nil, true},
+		{"any provider", nil, &Track{URI: "youtube:dQw4w9WgXcQ", Name: "song", Duration: 60000}, false},
+		{"allowed provider", []string{PROVIDER_YOUTUBE}, &Track{URI: "youtube:dQw4w9WgXcQ", Name: "song", Duration: 60000}, false},
+		{"disallowed provider", []string{PROVIDER_SPOTIFY}, &Track{URI: "youtube:dQw4w9WgXcQ", Name: "song", Duration: 60000}, true},
+		{"unknown provider", nil, &Track{URI: "tidal:123"}, true},
+		{"invalid uri", nil, &Track{URI: "spotify:track:x"}, true},
+		{"invalid duration", nil, &Track{URI: "youtube:dQw4w9WgXcQ", Name: "song"}, true},
+		{"uri too long", nil, &Track{URI: "https://example.com/" + strings.Repeat("a", MAX_URI_LENGTH) + ".mp3", Name: "song", Duration: 60000}, true},
+	}
+
+	for _, tc := range testCases {
+		l := Lobby{Providers: tc.providers}
+		err := l.checkTrack(tc.track)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: checkTrack, got: %v, want error: %t", tc.name, err, tc.wantErr)
+		}
+		if err == nil && tc.track.Provider == "" {
+			t.Errorf("%s: checkTrack did not set the provider", tc.name)
+		}
+	}
+}
+
+func TestImportTracks_RejectsInvalidPlaylist(t *testing.T) {
+	suppressLogging()
+	l := Lobby{StateLog: &StateLog{}, CurrentTrack: &Track{URI: "a"}}
+	tracks := []*Track{
+		{URI: "youtube:dQw4w9WgXcQ", Name: "song", Duration: 60000},
+		{URI: "tidal:123", Name: "song", Duration: 60000},
+	}
+
+	if _, err := l.importTracks(&Message{}, "a", tracks); err == nil {
+		t.Errorf("importTracks did not return an error for an invalid track")
+	}
+	if !l.TrackQueue.IsEmpty() {
+		t.Errorf("importTracks queued tracks from an invalid playlist")
+	}
+}
+
+func TestImportTracks_QueuesAll(t *testing.T) {
+	suppressLogging()
+	l := Lobby{StateLog: &StateLog{}, CurrentTrack: &Track{URI: "a"}}
+	tracks := []*Track{
+		{URI: "youtube:dQw4w9WgXcQ", Name: "one", Duration: 60000},
+		{URI: "https://example.com/two.mp3", Name: "two", Duration: 60000},
+	}
+
+	msg := Message{}
+	result, err := l.importTracks(&msg, "bob", tracks)
+	if err != nil {
+		t.Fatalf("importTracks returned error: %s", err)
+	}
+	if result != RESULT_QUEUED || ServerCommand(msg.Command) != QUEUE {
+		t.Errorf("Incorrect outcome, got: %q, command: %d", result, msg.Command)
+	}
+	if len(l.TrackQueue) != 2 || l.TrackQueue[1].Username != "bob" {
+		t.Errorf("Tracks not queued for the importing user, got: %v", l.TrackQueue)
+	}
+	if l.StateLog.Version() != 2 {
+		t.Errorf("Incorrect state version after import, got: %d, want: %d", l.StateLog.Version(), 2)
+	}
+}
+
+func TestResumePosition(t *testing.T) {
+	now := NowMillis()
+	testCases := []struct {
+		name      string
+		startedAt int64
+		position  int64
+		want      int64
+	}{
+		{"paused", 0, 30000, 30000},
+		{"playing", now - 45000, 0, 45000},
+		{"not started", now + COMMAND_DELAY, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		if got := resumePosition(tc.startedAt, tc.position); got != tc.want {
+			t.Errorf("%s: incorrect position, got: %d, want: %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResume_ContinuesFromPosition(t *testing.T) {
+	suppressLogging()
+	l := Lobby{StateLog: &StateLog{}}
+	track := &Track{URI: "a", Duration: 60000}
+
+	l.resume(track, 20000)
+	if l.CurrentTrack != track || track.Position != 20000 {
+		t.Errorf("Track not resumed from position, got: %v at %d", l.CurrentTrack, track.Position)
+	}
+	if want := NowMillis() + COMMAND_DELAY - 20000; l.trackStartedAt != want {
+		t.Errorf("Incorrect start time, got: %d, want: %d", l.trackStartedAt, want)
+	}
+}
+
+func TestResume_PlaysNextIfEnded(t *testing.T) {
+	suppressLogging()
+	next := &Track{URI: "b", Duration: 60000}
+	l := Lobby{StateLog: &StateLog{}, TrackQueue: TrackQueue{next}}
+
+	l.resume(&Track{URI: "a", Duration: 60000}, 90000)
+	if l.CurrentTrack != next || next.Position != 0 {
+		t.Errorf("Next track not played from the start, got: %v", l.CurrentTrack)
+	}
+}
+
+func TestSpectate(t *testing.T) {
+	suppressLogging()
+	l := &Lobby{Clients: make(map[string]*Client), Spectators: make(map[*Client]bool), StateLog: &StateLog{}, NumMembers: 1}
+	conn, _ := newHTTPConn(l.ID)
+	defer dropSession(conn.session)
+	c := &Client{Conn: conn, Codec: jsonCodec{}, Username: "speaker", Lobby: l, Spectator: true,
+		outboxReady: make(chan struct{}, 1), done: make(chan struct{})}
+	l.spectate(c)
+
+	if l.NumSpectators != 1 || l.NumMembers != 1 || len(l.ClientNames) != 0 {
+		t.Errorf("Spectator counted as a member, got spectators: %d, members: %d, names: %v", l.NumSpectators, l.NumMembers, l.ClientNames)
+	}
+	if passed, _ := l.votesPassed(1); !passed {
+		t.Errorf("Spectator counted towards vote majority")
+	}
+	if msg, ok := c.nextOutgoing(); !ok || !msg.FullState {
+		t.Errorf("Spectator not sent state on joining, got: %v", msg)
+	}
+	l.sendServerMessage("hello")
+	if msg, ok := c.nextOutgoing(); !ok || msg.UserMsg != "hello" {
+		t.Errorf("Broadcast not sent to spectator, got: %v", msg)
+	}
+
+	// Closing the connection ends the spectator's reader, which removes it from the lobby.
+	conn.Close()
+	<-c.done
+	if l.NumSpectators != 0 || len(l.Spectators) != 0 {
+		t.Errorf("Spectator not removed after disconnecting, got: %d", l.NumSpectators)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Formats logs can be written in.
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// Replaces the text of chat messages in logs when redaction is on.
+const REDACTED = "[redacted]"
+
+// Writes the server's logs, see log. It is replaced by setupLogging at startup, and in tests while
+// goroutines of earlier tests may still be logging, so is read and written atomically.
+var logger atomic.Pointer[slog.Logger]
+
+// Whether the content of chat messages is left out of logs.
+var redactChat atomic.Bool
+
+func init() {
+	setLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+// log returns the logger that writes the server's logs.
+func log() *slog.Logger {
+	return logger.Load()
+}
+
+// setLogger replaces the logger that writes the server's logs.
+func setLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// setupLogging configures the logger to write to w in the provided format, skipping
+// anything below the provided level. Empty values keep the defaults of text at info level.
+func setupLogging(w io.Writer, format string, level string, redact bool) error {
+	lvl := slog.LevelInfo
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("unknown log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", LOG_FORMAT_TEXT:
+		handler = slog.NewTextHandler(w, opts)
+	case LOG_FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	setLogger(slog.New(handler))
+	redactChat.Store(redact)
+	return nil
+}
+
+// chatText returns the text of a chat message as it should appear in logs.
+func chatText(text string) string {
+	if redactChat.Load() && text != "" {
+		return REDACTED
+	}
+	return text
+}
+
+// LogValue logs the details of a track.
+func (t *Track) LogValue() slog.Value {
+	if t == nil {
+		return slog.StringValue("<nil>")
+	}
+	return slog.GroupValue(
+		slog.String("uri", t.URI),
+		slog.String("name", t.Name),
+		slog.String("artist", t.Artist),
+		slog.Int64("duration", t.Duration),
+		slog.String("username", t.Username),
+	)
+}
+
+// LogValue logs the fields of a message that are set, redacting chat if configured.
+func (m Message) LogValue() slog.Value {
+	var attrs []slog.Attr
+	if m.Username != "" {
+		attrs = append(attrs, slog.String("username", m.Username))
+	}
+	if m.Command != 0 {
+		attrs = append(attrs, slog.Int("command", int(m.Command)))
+	}
+	if m.UserMsg != "" {
+		attrs = append(attrs, slog.String("userMsg", chatText(m.UserMsg)))
+	}
+	if m.CurrentTrack != nil {
+		attrs = append(attrs, slog.String("track", m.CurrentTrack.URI))
+	}
+	if len(m.TrackQueue) > 0 {
+		attrs = append(attrs, slog.Int("queueLength", len(m.TrackQueue)))
+	}
+	if len(m.ChatHistory) > 0 {
+		attrs = append(attrs, slog.Int("chatHistory", len(m.ChatHistory)))
+	}
+	if m.Timestamp != 0 {
+		attrs = append(attrs, slog.Int64("timestamp", m.Timestamp))
+	}
+	if m.RequestID != "" {
+		attrs = append(attrs, slog.String("requestId", m.RequestID))
+	}
+	if m.Error != "" {
+		attrs = append(attrs, slog.String("error", m.Error))
+	}
+	if m.Seq != 0 {
+		attrs = append(attrs, slog.Uint64("seq", m.Seq))
+	}
+	if m.StateVersion != 0 {
+		attrs = append(attrs, slog.Uint64("stateVersion", m.StateVersion))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging_Invalid(t *testing.T) {
+	defer suppressLogging()
+	if err := setupLogging(io.Discard, "xml", "", false); err == nil {
+		t.Errorf("setupLogging did not reject an unknown format")
+	}
+	if err := setupLogging(io.Discard, "", "loud", false); err == nil {
+		t.Errorf("setupLogging did not reject an unknown level")
+	}
+}
+
+func TestLobbyLog_JSONFields(t *testing.T) {
+	defer suppressLogging()
+	buf := bytes.Buffer{}
+	if err := setupLogging(&buf, LOG_FORMAT_JSON, "info", false); err != nil {
+		t.Fatalf("setupLogging returned error: %s", err)
+	}
+	l := &Lobby{ID: "ABCD"}
+	c := &Client{Lobby: l, Username: "100%"}
+
+	c.log().Debug("Filtered out")
+	c.log().Info("Joined")
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Log is not a single JSON entry: %q", buf.String())
+	}
+	if entry["lobby"] != "ABCD" || entry["username"] != "100%" || entry["msg"] != "Joined" {
+		t.Errorf("Incorrect log fields, got: %v", entry)
+	}
+}
+
+func TestMessageLogValue_RedactsChat(t *testing.T) {
+	defer suppressLogging()
+	buf := bytes.Buffer{}
+	setupLogging(&buf, LOG_FORMAT_TEXT, "", true)
+
+	log().Info("Received message", "msg", Message{Username: "a", UserMsg: "secret plans"})
+	if strings.Contains(buf.String(), "secret") || !strings.Contains(buf.String(), REDACTED) {
+		t.Errorf("Chat not redacted, got: %q", buf.String())
+	}
+}
@@ -3,20 +3,70 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const ID_LENGTH = 4
 
 var Lobbies = make(map[string]*Lobby)
 
+// Guards Lobbies, which handlers and the cluster heartbeat use concurrently.
+// Lobbies is only used through the functions below.
+var lobbiesMu sync.RWMutex
+
+// getLobby returns the lobby with the provided ID if it's on this node.
+func getLobby(id string) (*Lobby, bool) {
+	lobbiesMu.RLock()
+	defer lobbiesMu.RUnlock()
+	l, ok := Lobbies[id]
+	return l, ok
+}
+
+// putLobby adds a lobby to the ones on this node.
+func putLobby(l *Lobby) {
+	lobbiesMu.Lock()
+	defer lobbiesMu.Unlock()
+	Lobbies[l.ID] = l
+	activeLobbies.Set(float64(len(Lobbies)))
+}
+
+// deleteLobby removes a lobby from the ones on this node.
+func deleteLobby(id string) {
+	lobbiesMu.Lock()
+	defer lobbiesMu.Unlock()
+	delete(Lobbies, id)
+	activeLobbies.Set(float64(len(Lobbies)))
+}
+
+// lobbySnapshot returns a copy of the lobbies on this node, which can be ranged over while they change.
+func lobbySnapshot() map[string]*Lobby {
+	lobbiesMu.RLock()
+	defer lobbiesMu.RUnlock()
+	lobbies := make(map[string]*Lobby, len(Lobbies))
+	for id, l := range Lobbies {
+		lobbies[id] = l
+	}
+	return lobbies
+}
+
+// lobbyCount returns the number of lobbies on this node.
+func lobbyCount() int {
+	lobbiesMu.RLock()
+	defer lobbiesMu.RUnlock()
+	return len(Lobbies)
+}
+
 // Courtesy of https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go/31832326#31832326
 const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
@@ -32,24 +82,47 @@ func RandStringBytes(n int) string {
 func UniqueLobbyID() string {
 	for {
 		id := RandStringBytes(ID_LENGTH)
-		if _, exists := Lobbies[id]; !exists {
+		if _, exists := getLobby(id); !exists {
 			return id
 		}
 	}
 }
 
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The subprotocol chooses the codec used for messages.
+	Subprotocols: codecSubprotocols(),
+	// Negotiate permessage-deflate with clients that support it.
+	EnableCompression: true,
+	// App clients don't send an Origin header, so accept any origin.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// GetLobbies lists the lobbies on every node, or only this node's if local is set.
+// Lobbies whose node has stopped are adopted by this node, so they are listed too.
 func GetLobbies(w http.ResponseWriter, r *http.Request) {
-	log.Print("GetLobbies request received")
+	log().Info("GetLobbies request received")
 
-	json.NewEncoder(w).Encode(Lobbies)
+	lobbies := make(map[string]interface{})
+	if local, _ := strconv.ParseBool(r.URL.Query().Get("local")); !local {
+		for id, l := range peerLobbies() {
+			lobbies[id] = l
+		}
+		adoptOrphanedLobbies()
+	}
+	for id, l := range lobbySnapshot() {
+		lobbies[id] = l
+	}
+	json.NewEncoder(w).Encode(lobbies)
 }
 
 func GetLobby(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GetLobby request received")
+	log().Info("GetLobby request received")
 
 	var params = mux.Vars(r)
 
-	for _, lobby := range Lobbies {
+	for _, lobby := range lobbySnapshot() {
 		if lobby.ID == params["id"] {
 			json.NewEncoder(w).Encode(lobby)
 		}
@@ -58,48 +131,128 @@ func GetLobby(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(Lobby{})
 }
 
+// GetLovedTracks lists the tracks liked most in a lobby.
+func GetLovedTracks(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log().Info("GetLovedTracks request received", "lobby", id)
+
+	if _, ok := getLobby(id); !ok {
+		http.Error(w, "Lobby does not exist", http.StatusNotFound)
+		return
+	}
+	limit := LOVED_TRACKS_LIMIT
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Limit must be a positive int", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	loved, err := selectMostLoved(id, limit)
+	if err != nil {
+		log().Error("Failed to read loved tracks", "lobby", id, "error", err)
+		http.Error(w, "Failed to read loved tracks", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(loved)
+}
+
 func CreateLobby(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	name := r.FormValue("name")
 	genre := r.FormValue("genre")
 	admin := r.FormValue("admin")
 	mode, err := strconv.Atoi(r.FormValue("mode"))
 	if err != nil {
-		log.Fatal("Lobby mode is not an int: %s", err)
+		http.Error(w, "Lobby mode is not an int", http.StatusBadRequest)
+		return
 	}
 	public, err := strconv.ParseBool(r.FormValue("public"))
 	if err != nil {
-		log.Fatal("Public bool formatted incorrectly: %s", err)
+		http.Error(w, "Public bool formatted incorrectly", http.StatusBadRequest)
+		return
+	}
+	providers, err := parseProviders(r.FormValue("providers"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	autoplay := r.FormValue("autoplay")
+	if autoplay != AUTOPLAY_OFF {
+		if _, err := recommendationSource(autoplay); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	rules, err := parseQueueRules(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rotation, err := parseDJRotation(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	log.Printf("CreateLobby request received: Name: %q, Mode: %d, Genre: %q, Public: %t, Admin: %q", name, mode, genre, public, admin)
+	log().Info("CreateLobby request received", "name", name, "mode", mode, "genre", genre, "public", public, "admin", admin,
+		"providers", providers, "autoplay", autoplay, "rules", rules, "djRotation", rotation)
 
-	id := UniqueLobbyID()
-	l := NewLobby(id, name, LobbyMode(mode), genre, public, admin, nil)
-	Lobbies[id] = l
-	// Persist the lobby in the db.
-	if err := insertLobby(l); err != nil {
-		panic(fmt.Sprintf("Failed to insert lobby: %s", err))
+	// Persist the lobby in the db. It's stored before being started, as its ID is only known
+	// to be unused by other nodes once stored.
+	settings := Lobby{Name: name, LobbyMode: LobbyMode(mode), Genre: genre, Public: public,
+		Providers: providers, Autoplay: autoplay, Rules: rules, DJRotation: rotation}
+	id, err := storeLobby(&settings, insertLobby)
+	if err != nil {
+		log().Error("Failed to insert lobby", "error", err)
+		http.Error(w, "Failed to create lobby", http.StatusInternalServerError)
+		return
 	}
-	log.Printf("Lobby %q has been created with ID %q", name, id)
+	l := NewLobby(id, name, LobbyMode(mode), genre, public, admin)
+	l.Providers = providers
+	l.Autoplay = autoplay
+	l.Rules = rules
+	l.DJRotation = rotation
+	putLobby(l)
+	log().Info("Lobby created", "lobby", id, "name", name)
 
 	w.Write([]byte(fmt.Sprintf("%s", id)))
 }
 
+// joinOptions reads the settings a client chose when joining from the request.
+func joinOptions(r *http.Request) JoinOptions {
+	// Clients that don't request a protocol version are older builds using version 1.
+	opts := JoinOptions{Protocol: negotiateProtocol(r.URL.Query().Get("protocol"))}
+	opts.StateDiffs, _ = strconv.ParseBool(r.URL.Query().Get("diffs"))
+	opts.Spectator, _ = strconv.ParseBool(r.URL.Query().Get("spectate"))
+	return opts
+}
+
 func JoinLobby(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	username := r.URL.Query()["username"][0]
-	log.Printf("JoinLobby request received: ID: %s, username: %s", id, username)
+	opts := joinOptions(r)
+	log().Info("JoinLobby request received", "lobby", id, "username", username, "protocol", opts.Protocol, "stateDiffs", opts.StateDiffs, "spectator", opts.Spectator)
 
-	conn, err := websocket.Upgrade(w, r, w.Header(), 1024, 1024)
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "Could not open websocket connection", http.StatusBadRequest)
 		return
 	}
 
-	if lobby, ok := Lobbies[id]; ok {
-		client := lobby.join(conn, username)
-		log.Printf("%s has joined lobby %q", client.Username, lobby.ID)
+	if lobby, ok := getLobby(id); ok {
+		client := lobby.join(conn, username, opts)
+		log().Info("Client joined lobby", "lobby", lobby.ID, "username", client.Username)
 	} else {
-		log.Printf("Lobby with ID %q does not exist", id)
+		log().Warn("Lobby does not exist", "lobby", id)
 		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "Lobby does not exist"))
 		conn.Close()
 		return
@@ -107,20 +260,88 @@ func JoinLobby(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	log.Printf("Starting server")
-	log.Printf("Loading stored lobby states")
-	if err := loadFromDB(&Lobbies); err != nil {
-		log.Printf("Failed to load lobbies from db: %s", err)
+	redact, _ := strconv.ParseBool(os.Getenv("LOG_REDACT_CHAT"))
+	if err := setupLogging(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"), redact); err != nil {
+		log().Error("Failed to set up logging", "error", err)
+		os.Exit(1)
+	}
+	// Migrations can be run on their own, without starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:], os.Stdout); err != nil {
+			log().Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if v := os.Getenv("AUTO_MIGRATE"); v != "" {
+		autoMigrate, _ = strconv.ParseBool(v)
+	}
+	// Lobbies are shared with other nodes using the same database if this node has an address they can reach.
+	if id := os.Getenv("NODE_ID"); id != "" {
+		self.ID = id
 	}
-	log.Printf("Lobby states loaded")
+	if addr := os.Getenv("NODE_ADDR"); addr != "" {
+		self.Address = addr
+		directory = dbDirectory{}
+	}
+	log().Info("Starting server")
+	// Track details are checked against a local catalogue if one is provided.
+	// It's held in memory, so needs no database cache.
+	if path := os.Getenv("TRACK_FIXTURES"); path != "" {
+		fixtures, err := loadFixtureResolver(path)
+		if err != nil {
+			log().Error("Failed to load track fixtures", "error", err)
+			os.Exit(1)
+		}
+		Resolver = fixtures
+		log().Info("Resolving tracks from fixtures", "path", path)
+	}
+	if url := os.Getenv("RESOLVER_URL"); url != "" {
+		RemoteResolver = newDBCachingResolver(newHTTPResolver(url))
+		log().Info("Resolving tracks from remote catalogue", "url", url)
+	}
+	// Lobbies are loaded once the database is reachable. Until then, only health checks are served.
+	go loadLobbies()
 
 	router := mux.NewRouter()
+	router.Use(requireLoaded, routeToOwner)
+
+	router.HandleFunc("/healthz", Healthz).Methods("GET")
+	router.HandleFunc("/readyz", Readyz).Methods("GET")
 
 	router.HandleFunc("/lobbies", GetLobbies).Methods("GET")
 	router.HandleFunc("/lobbies/{id}", GetLobby).Methods("GET")
 	router.HandleFunc("/lobbies/{id}/join", JoinLobby).Queries("username", "").Methods("GET")
 	router.HandleFunc("/lobbies/create", CreateLobby).Methods("POST")
+	// Fallbacks for networks that block websockets: messages are streamed or polled, and commands posted.
+	router.HandleFunc("/lobbies/{id}/events", StreamLobbyEvents).Queries("username", "").Methods("GET")
+	router.HandleFunc("/lobbies/{id}/sessions", CreatePollSession).Queries("username", "").Methods("POST")
+	router.HandleFunc("/lobbies/{id}/sessions/{sid}/poll", PollSession).Methods("GET")
+	router.HandleFunc("/lobbies/{id}/sessions/{sid}/messages", PostSessionMessage).Methods("POST")
+	router.HandleFunc("/lobbies/{id}/import", ImportPlaylist).Queries("username", "").Methods("POST")
+	router.HandleFunc("/lobbies/{id}/history", ExportHistory).Methods("GET")
+	router.HandleFunc("/lobbies/{id}/loved", GetLovedTracks).Methods("GET")
+	router.HandleFunc("/lobbies/{id}/queue", ExportQueue).Methods("GET")
+	router.HandleFunc("/lobbies/{id}/playlists", SavePlaylist).Methods("POST")
+	router.HandleFunc("/lobbies/{id}/playlists/{pid}/load", LoadPlaylist).Queries("username", "").Methods("POST")
+	router.HandleFunc("/playlists", GetPlaylists).Methods("GET")
+	router.HandleFunc("/playlists/{pid}", GetPlaylist).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log().Error("Server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+	log().Info("Server started")
 
-	log.Printf("Server started")
-	log.Fatal(http.ListenAndServe(":8080", router))
+	// Wait for a signal to stop, then let clients know before closing their connections.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	log().Info("Shutting down", "signal", sig.String())
+	shutdownServer(srv, SHUTDOWN_TIMEOUT)
+	log().Info("Server stopped")
 }
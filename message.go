@@ -2,6 +2,14 @@ package main
 
 import "fmt"
 
+// Outcomes of a client request, sent in a reply's Result.
+const (
+	RESULT_OK       = "ok"
+	RESULT_QUEUED   = "queued"
+	RESULT_PLAYED   = "played"
+	RESULT_REJECTED = "rejected"
+)
+
 type Message struct {
 	// Who the message originated from (empty string implies the server).
 	Username string `json:"username,omitempty"`
@@ -16,18 +24,65 @@ type Message struct {
 	// Clients connected to the lobby.
 	ClientNames []string `json:"clientNames,omitempty"`
 
+	// Member a command acts on, e.g. the member to kick.
+	Target string `json:"target,omitempty"`
+
 	// Current lobby admin.
 	Admin string `json:"admin,omitempty"`
 
+	// Member currently choosing the tracks in a DJ rotation lobby.
+	DJ string `json:"dj,omitempty"`
+
+	// Members waiting for a turn as DJ, in order.
+	DJWaitlist []string `json:"djWaitlist,omitempty"`
+
+	// Autoplay strategy of the lobby, or the strategy to change to.
+	Autoplay string `json:"autoplay,omitempty"`
+
 	// Command for the user to perform e.g. play/pause.
 	Command Command `json:"command,omitempty"`
 
 	// User messages.
 	UserMsg string `json:"userMsg,omitempty"`
 
+	// Reaction to the current track, e.g. like or an emoji.
+	Reaction string `json:"reaction,omitempty"`
+
+	// Number of members who gave each reaction to the current track.
+	Reactions map[string]int `json:"reactions,omitempty"`
+
+	// Recent chat messages, sent to members when they join.
+	ChatHistory []ChatMessage `json:"chatHistory,omitempty"`
+
 	// Time at which a command should be executed.
 	// Also used for the clock handshake.
 	Timestamp int64 `json:"timestamp,omitempty"`
+
+	// Reason a request from this user failed.
+	Error string `json:"error,omitempty"`
+
+	// Optional ID supplied by a client with a request, echoed on the direct reply to it.
+	RequestID string `json:"requestId,omitempty"`
+
+	// Outcome of the request identified by RequestID, e.g. queued or rejected.
+	Result string `json:"result,omitempty"`
+
+	// Sequence number of a broadcast. Increments by one for each broadcast in a lobby,
+	// so a gap means a message was missed and the client should request the state again.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Version of the lobby state carried by this message.
+	// When sent by a client, acknowledges that it has applied this version.
+	StateVersion uint64 `json:"stateVersion,omitempty"`
+
+	// True if this message carries the full lobby state rather than diffs.
+	FullState bool `json:"fullState,omitempty"`
+
+	// Changes to the lobby state since the client's last acknowledged version.
+	StateDiffs []StateDiff `json:"stateDiffs,omitempty"`
+
+	// Set when the lobby state has been loaded into this message.
+	hasState bool
 }
 
 // Implement stringer interface.
@@ -40,9 +95,12 @@ func (m Message) String() string {
 }
 
 type Track struct {
-	// Spotify URI for this track.
+	// URI for this track, in the canonical form of its provider.
 	URI string `json:"uri,omitempty"`
 
+	// Music provider that plays this track, e.g. spotify or youtube.
+	Provider string `json:"provider,omitempty"`
+
 	// Name of the track.
 	Name string `json:"name,omitempty"`
 
@@ -57,4 +115,17 @@ type Track struct {
 
 	// User who chose this song.
 	Username string `json:"username,omitempty"`
+
+	// True if the track was picked by autoplay rather than a user.
+	Autoplayed bool `json:"autoplayed,omitempty"`
+
+	// Time the track was queued in millis.
+	AddedAt int64 `json:"addedAt,omitempty"`
+
+	// Sum of the votes on this track in a democracy lobby.
+	Score int `json:"score,omitempty"`
+
+	// Identifies the track's row in the stored queue, and orders it within the queue.
+	entry int64
+	rank  float64
 }
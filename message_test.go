@@ -22,7 +22,7 @@ func TestMessageString_OmitsTrackWhenEmpty(t *testing.T) {
 				UserMsg:      "asdf",
 				CurrentTrack: &Track{URI: "123"},
 			},
-			`Username: "blah", Command: 0, Admin: "", Clients: [], UserMsg: "asdf", Timestamp: [], TrackQueue: %!p(MISSING), Track: main.Track{URI:"123", Name:"", Artist:"", Duration:0, Position:0, Username:""}`,
+			`Username: "blah", Command: 0, Admin: "", Clients: [], UserMsg: "asdf", Timestamp: [], TrackQueue: %!p(MISSING), Track: main.Track{URI:"123", Provider:"", Name:"", Artist:"", Duration:0, Position:0, Username:"", Autoplayed:false, AddedAt:0, Score:0, entry:0, rank:0}`,
 		},
 	}
 
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of a skip vote.
+const (
+	SKIP_PASSED  = "passed"
+	SKIP_EXPIRED = "expired"
+)
+
+var (
+	activeLobbies = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncsong_lobbies_active",
+		Help: "Number of lobbies on this server.",
+	})
+	connectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncsong_clients_connected",
+		Help: "Number of clients connected to a lobby.",
+	})
+	messagesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncsong_messages_in_total",
+		Help: "Messages received from clients, by command.",
+	}, []string{"command"})
+	messagesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncsong_messages_out_total",
+		Help: "Messages queued for sending to clients, by command.",
+	}, []string{"command"})
+	inMsgsDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncsong_lobby_inbox_depth",
+		Help: "Messages waiting in a lobby's InMsgs channel when it last received one.",
+	}, []string{"lobby"})
+	sendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncsong_send_failures_total",
+		Help: "Broadcasts that could not be queued for a client, by reason.",
+	}, []string{"reason"})
+	handshakeLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "syncsong_handshake_latency_millis",
+		Help:    "One way latency to clients measured by the clock handshake.",
+		Buckets: []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500},
+	})
+	handshakeOffset = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "syncsong_handshake_offset_millis",
+		Help:    "Clock offset of clients from the server measured by the clock handshake.",
+		Buckets: []float64{-10000, -1000, -250, -50, -10, 0, 10, 50, 250, 1000, 10000},
+	})
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "syncsong_db_persist_seconds",
+		Help:    "Time taken to write lobby state to the database, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncsong_db_persist_errors_total",
+		Help: "Failed writes of lobby state to the database, by operation.",
+	}, []string{"operation"})
+	skipVotes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncsong_skip_votes_total",
+		Help: "Skip votes by outcome, either passed or expired when the track changed.",
+	}, []string{"outcome"})
+)
+
+// inCommandLabel names the command of a message from a client for metrics.
+func inCommandLabel(msg Message) string {
+	if msg.Command != 0 {
+		return ClientCommand(msg.Command).String()
+	}
+	if msg.UserMsg != "" {
+		return "CHAT"
+	}
+	return "ACK"
+}
+
+// outCommandLabel names the command of a message to a client for metrics.
+func outCommandLabel(msg Message) string {
+	if msg.Command != 0 {
+		return ServerCommand(msg.Command).String()
+	}
+	if msg.hasState {
+		return "STATE"
+	}
+	if msg.RequestID != "" {
+		return "REPLY"
+	}
+	return "NOTICE"
+}
+
+// timePersist runs a database write, recording how long it took and whether it failed.
+func timePersist(operation string, persist func() error) error {
+	start := time.Now()
+	err := persist()
+	dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCommandLabels(t *testing.T) {
+	testCases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"client command", inCommandLabel(Message{Command: Command(ADD_SONG)}), "ADD_SONG"},
+		{"client chat", inCommandLabel(Message{UserMsg: "hi"}), "CHAT"},
+		{"client ack", inCommandLabel(Message{StateVersion: 1}), "ACK"},
+		{"server command", outCommandLabel(Message{Command: Command(PLAY)}), "PLAY"},
+		{"server state", outCommandLabel(Message{hasState: true}), "STATE"},
+		{"server reply", outCommandLabel(Message{RequestID: "1", Result: RESULT_OK}), "REPLY"},
+		{"server notice", outCommandLabel(Message{UserMsg: "hi"}), "NOTICE"},
+	}
+
+	for _, tc := range testCases {
+		if tc.got != tc.want {
+			t.Errorf("%s: incorrect label, got: %q, want: %q", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestTimePersist_CountsErrors(t *testing.T) {
+	before := testutil.ToFloat64(dbErrors.WithLabelValues("test"))
+	timePersist("test", func() error { return nil })
+	timePersist("test", func() error { return errors.New("failed") })
+	if got := testutil.ToFloat64(dbErrors.WithLabelValues("test")) - before; got != 1 {
+		t.Errorf("Incorrect number of errors recorded, got: %v, want: %v", got, 1)
+	}
+}
+
+func TestSend_CountsFailures(t *testing.T) {
+	c := &Client{outboxReady: make(chan struct{}, 1), closed: true}
+	before := testutil.ToFloat64(sendFailures.WithLabelValues("closed"))
+	c.Send(Message{})
+	if got := testutil.ToFloat64(sendFailures.WithLabelValues("closed")) - before; got != 1 {
+		t.Errorf("Send to a closed client not counted as a failure, got: %v", got)
+	}
+}
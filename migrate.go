@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether pending migrations are applied when the server starts.
+var autoMigrate = true
+
+// Driver of the database lobbies are stored in. Migrations are kept separately for each driver.
+const DB_DRIVER = "mysql"
+
+// Name of the lock held while migrating, so only one server migrates at a time.
+const MIGRATION_LOCK = "syncsong_migrate"
+
+// How long to wait for another server to finish migrating.
+const MIGRATION_LOCK_TIMEOUT = 60 * time.Second
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration files are named <version>_<name>.<up|down>.sql.
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration changes the schema from the previous version to its version, and back again.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes whether a migration has been applied to the database.
+type MigrationStatus struct {
+	Migration
+	AppliedAt int64
+}
+
+// loadMigrations reads the migrations for the driver from the files, ordered by version.
+// Every migration must have both an up and a down file, and versions must be numbered from 1 without gaps.
+func loadMigrations(files fs.FS, driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %s", driver, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		match := migrationName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %q is not named <version>_<name>.<up|down>.sql", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		data, err := fs.ReadFile(files, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %s", e.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", m.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements splits a migration into the statements it contains, as the driver runs one at a time.
+// Statements end with a semicolon at the end of a line, other than a comment. Anything that is only comments is left out.
+func splitStatements(sqlText string) []string {
+	var statements []string
+	var current []string
+	hasSQL := false
+	for _, line := range strings.Split(sqlText, "\n") {
+		trimmed := strings.TrimSpace(line)
+		current = append(current, line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		hasSQL = true
+		if strings.HasSuffix(trimmed, ";") {
+			if hasSQL {
+				statements = append(statements, strings.TrimSpace(strings.Join(current, "\n")))
+			}
+			current = nil
+			hasSQL = false
+		}
+	}
+	if hasSQL {
+		statements = append(statements, strings.TrimSpace(strings.Join(current, "\n")))
+	}
+	return statements
+}
+
+// migrator applies migrations to a database, recording the schema version in the schema_migrations table.
+type migrator struct {
+	conn       *sql.Conn
+	migrations []Migration
+}
+
+// newMigrator returns a migrator for the database with the embedded migrations for its driver.
+// It holds a lock until closed, so that servers starting together don't migrate at the same time.
+func newMigrator(ctx context.Context, db *sql.DB) (*migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, DB_DRIVER)
+	if err != nil {
+		return nil, err
+	}
+	// The lock belongs to a connection, so every statement runs on the same one.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %s", err)
+	}
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `select get_lock(?, ?)`, MIGRATION_LOCK, int(MIGRATION_LOCK_TIMEOUT.Seconds())).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to take migration lock: %s", err)
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, errors.New("timed out waiting for another server to finish migrating")
+	}
+	if _, err := conn.ExecContext(ctx, `
+        create table if not exists schema_migrations(
+            version int primary key,
+            name varchar(100) not null,
+            appliedAt bigint not null
+        )`); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create schema_migrations table: %s", err)
+	}
+	return &migrator{conn: conn, migrations: migrations}, nil
+}
+
+// Close releases the migration lock.
+func (m *migrator) Close() error {
+	m.conn.ExecContext(context.Background(), `select release_lock(?)`, MIGRATION_LOCK)
+	return m.conn.Close()
+}
+
+// version returns the latest migration applied to the database, zero if there are none.
+func (m *migrator) version(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	if err := m.conn.QueryRowContext(ctx, `select max(version) from schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %s", err)
+	}
+	return int(version.Int64), nil
+}
+
+// status returns every migration along with when it was applied, zero if it hasn't been.
+func (m *migrator) status(ctx context.Context) ([]MigrationStatus, error) {
+	rows, err := m.conn.QueryContext(ctx, `select version, appliedAt from schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %s", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %s", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range m.migrations {
+		statuses = append(statuses, MigrationStatus{Migration: migration, AppliedAt: applied[migration.Version]})
+	}
+	return statuses, nil
+}
+
+// up applies every migration newer than the database's version, returning the new version.
+func (m *migrator) up(ctx context.Context) (int, error) {
+	current, err := m.version(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current > len(m.migrations) {
+		return current, fmt.Errorf("database is at version %d, newer than this server's %d", current, len(m.migrations))
+	}
+	for _, migration := range m.migrations[current:] {
+		log().Info("Applying migration", "version", migration.Version, "name", migration.Name)
+		if err := m.run(ctx, migration.Up); err != nil {
+			return current, fmt.Errorf("migration %d %s failed: %s", migration.Version, migration.Name, err)
+		}
+		if _, err := m.conn.ExecContext(ctx, `insert into schema_migrations(version, name, appliedAt) values(?, ?, ?)`,
+			migration.Version, migration.Name, NowMillis()); err != nil {
+			return current, fmt.Errorf("failed to record migration %d: %s", migration.Version, err)
+		}
+		current = migration.Version
+	}
+	return current, nil
+}
+
+// down rolls back the provided number of the most recently applied migrations, returning the new version.
+func (m *migrator) down(ctx context.Context, steps int) (int, error) {
+	current, err := m.version(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current > len(m.migrations) {
+		return current, fmt.Errorf("database is at version %d, newer than this server's %d", current, len(m.migrations))
+	}
+	for ; steps > 0 && current > 0; steps-- {
+		migration := m.migrations[current-1]
+		log().Info("Rolling back migration", "version", migration.Version, "name", migration.Name)
+		if err := m.run(ctx, migration.Down); err != nil {
+			return current, fmt.Errorf("rollback of migration %d %s failed: %s", migration.Version, migration.Name, err)
+		}
+		if _, err := m.conn.ExecContext(ctx, `delete from schema_migrations where version=?`, migration.Version); err != nil {
+			return current, fmt.Errorf("failed to record rollback of migration %d: %s", migration.Version, err)
+		}
+		current--
+	}
+	return current, nil
+}
+
+// run executes each statement of a migration in turn.
+// MySQL commits schema changes straight away, so a failed migration isn't rolled back,
+// and must be written so that it can be run again once fixed.
+func (m *migrator) run(ctx context.Context, sqlText string) error {
+	for _, statement := range splitStatements(sqlText) {
+		if _, err := m.conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDB applies any pending migrations to the database, returning the schema version.
+func migrateDB() (int, error) {
+	db, err := dbConn()
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	m, err := newMigrator(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+	return m.up(ctx)
+}
+
+// migrateCommand runs the migrate subcommand. The up action applies pending migrations,
+// down rolls back the provided number of migrations, one by default, and status lists them.
+func migrateCommand(args []string, out io.Writer) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	steps := 1
+	switch action {
+	case "up", "status":
+	case "down":
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return errors.New("steps to roll back must be a positive int")
+			}
+			steps = n
+		}
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected up, down or status", action)
+	}
+
+	db, err := dbConn()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	m, err := newMigrator(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch action {
+	case "up", "down":
+		var version int
+		if action == "up" {
+			version, err = m.up(ctx)
+		} else {
+			version, err = m.down(ctx, steps)
+		}
+		fmt.Fprintf(out, "Schema at version %d\n", version)
+		return err
+	}
+	statuses, err := m.status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != 0 {
+			applied = "applied " + time.UnixMilli(s.AppliedAt).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%4d %-30s %s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, DB_DRIVER)
+	if err != nil {
+		t.Fatalf("Embedded migrations are invalid: %s", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("No embedded migrations")
+	}
+	for _, m := range migrations {
+		if len(splitStatements(m.Up)) == 0 || len(splitStatements(m.Down)) == 0 {
+			t.Errorf("Migration %d %s has no statements", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("select 1;")}
+	testCases := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{"no directory", fstest.MapFS{"migrations/other/0001_a.up.sql": file}},
+		{"bad name", fstest.MapFS{"migrations/mysql/a.sql": file}},
+		{"missing down", fstest.MapFS{"migrations/mysql/0001_a.up.sql": file}},
+		{"gap", fstest.MapFS{
+			"migrations/mysql/0001_a.up.sql":   file,
+			"migrations/mysql/0001_a.down.sql": file,
+			"migrations/mysql/0003_c.up.sql":   file,
+			"migrations/mysql/0003_c.down.sql": file,
+		}},
+		{"mismatched names", fstest.MapFS{
+			"migrations/mysql/0001_a.up.sql":   file,
+			"migrations/mysql/0001_b.down.sql": file,
+		}},
+	}
+
+	for _, tc := range testCases {
+		if _, err := loadMigrations(tc.files, "mysql"); err == nil {
+			t.Errorf("%s: no error returned", tc.name)
+		}
+	}
+}
+
+func TestLoadMigrations_Ordered(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("select 1;")}
+	files := fstest.MapFS{
+		"migrations/mysql/0002_b.up.sql":   file,
+		"migrations/mysql/0002_b.down.sql": file,
+		"migrations/mysql/0001_a.up.sql":   file,
+		"migrations/mysql/0001_a.down.sql": file,
+	}
+
+	migrations, err := loadMigrations(files, "mysql")
+	if err != nil {
+		t.Fatalf("loadMigrations returned error: %s", err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "a" || migrations[1].Version != 2 {
+		t.Errorf("Migrations not ordered by version, got: %v", migrations)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	sqlText := `# Leading comment.
+create table a(
+    # Comment inside a statement;
+    id int
+);
+
+alter table a add column b int;
+# Trailing comment.
+`
+	got := splitStatements(sqlText)
+	if len(got) != 2 {
+		t.Fatalf("Incorrect number of statements, got: %d, want: 2, %q", len(got), got)
+	}
+	if got[1] != "alter table a add column b int;" {
+		t.Errorf("Incorrect statement, got: %q", got[1])
+	}
+}
+
+func TestMigrateCommand_InvalidArgs(t *testing.T) {
+	testCases := [][]string{
+		{"sideways"},
+		{"down", "0"},
+		{"down", "x"},
+	}
+
+	for _, args := range testCases {
+		if err := migrateCommand(args, io.Discard); err == nil {
+			t.Errorf("No error returned for %v", args)
+		}
+	}
+}
+
+// The columns and primary key of each table once every migration is applied.
+var latestSchema = schemaModel{
+	"track":          {columns: []string{"uri", "provider", "name", "artist", "duration", "genre", "resolved"}, key: "uri"},
+	"lobby":          {columns: []string{"id", "name", "mode", "genre", "public", "node", "providers", "autoplay", "maxQueueLength", "maxPerUser", "repeatWindow", "maxDuration", "allowDuplicates", "djTracksPerTurn", "djMinutesPerTurn", "currentUri", "trackStartedAt", "position"}, key: "id"},
+	"queue":          {columns: []string{"lobbyID", "entry", "trackURI", "_rank", "username", "addedAt"}, key: "lobbyID,entry"},
+	"queue_vote":     {columns: []string{"lobbyID", "entry", "username", "value"}, key: "lobbyID,entry,username"},
+	"history":        {columns: []string{"id", "lobbyID", "trackURI", "playedAt", "autoplayed"}, key: "id"},
+	"fallback":       {columns: []string{"lobbyID", "trackURI", "_rank"}, key: "lobbyID,_rank"},
+	"playlist":       {columns: []string{"id", "name", "owner", "lobbyID", "createdAt"}, key: "id"},
+	"playlist_track": {columns: []string{"playlistID", "_rank", "trackURI"}, key: "playlistID,_rank"},
+	"chat":           {columns: []string{"id", "lobbyID", "username", "text", "sentAt"}, key: "id"},
+	"reaction":       {columns: []string{"lobbyID", "playedAt", "trackURI", "username", "reaction"}, key: "lobbyID,playedAt,username,reaction"},
+	"node":           {columns: []string{"id", "address", "heartbeatAt"}, key: "id"},
+}
+
+func TestMigrations_UpgradeBaselineSchema(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, DB_DRIVER)
+	if err != nil {
+		t.Fatalf("Embedded migrations are invalid: %s", err)
+	}
+	data, err := os.ReadFile("testdata/baseline_schema.sql")
+	if err != nil {
+		t.Fatalf("Failed to read baseline schema: %s", err)
+	}
+	baseline := schemaModel{}
+	if err := baseline.apply(string(data)); err != nil {
+		t.Fatalf("Failed to apply baseline schema: %s", err)
+	}
+
+	// A database set up from the baseline and a new database end up with the same schema.
+	for name, schema := range map[string]schemaModel{"baseline": baseline.copy(), "empty": {}} {
+		for _, m := range migrations {
+			if err := schema.apply(m.Up); err != nil {
+				t.Fatalf("%s: migration %d %s failed: %s", name, m.Version, m.Name, err)
+			}
+		}
+		if !reflect.DeepEqual(schema.normalised(), latestSchema.normalised()) {
+			t.Errorf("%s: incorrect schema after migrating, got: %v, want: %v", name, schema, latestSchema)
+		}
+	}
+
+	// Rolling back every migration but the first returns the baseline schema.
+	schema := baseline.copy()
+	for _, m := range migrations {
+		schema.apply(m.Up)
+	}
+	for i := len(migrations) - 1; i > 0; i-- {
+		if err := schema.apply(migrations[i].Down); err != nil {
+			t.Fatalf("Rollback of migration %d %s failed: %s", migrations[i].Version, migrations[i].Name, err)
+		}
+	}
+	if !reflect.DeepEqual(schema.normalised(), baseline.normalised()) {
+		t.Errorf("Incorrect schema after rolling back, got: %v, want: %v", schema, baseline)
+	}
+}
+
+// tableModel is the columns and primary key of a table, the key being its columns joined by commas.
+type tableModel struct {
+	columns []string
+	key     string
+}
+
+// schemaModel follows the tables a schema's statements create and alter, so that migrations can
+// be checked without a database. Only changes to tables, columns and primary keys are followed.
+type schemaModel map[string]tableModel
+
+var (
+	createTable = regexp.MustCompile(`(?is)^create table (if not exists )?(\w+)\s*\((.*)\)\s*;?$`)
+	dropTable   = regexp.MustCompile(`(?i)^drop table (if exists )?(\w+)`)
+	alterTable  = regexp.MustCompile(`(?is)^alter table (\w+)\s+(.*?);?$`)
+	keyColumns  = regexp.MustCompile(`\(([^)]*)\)`)
+)
+
+// apply follows each statement of the SQL, returning an error for any change MySQL would refuse.
+func (s schemaModel) apply(sqlText string) error {
+	for _, statement := range splitStatements(sqlText) {
+		statement = stripComments(statement)
+		if m := createTable.FindStringSubmatch(statement); m != nil {
+			if _, ok := s[m[2]]; ok {
+				if m[1] == "" {
+					return fmt.Errorf("table %s already exists", m[2])
+				}
+				continue
+			}
+			table := tableModel{}
+			for _, def := range splitDefinitions(m[3]) {
+				words := strings.Fields(def)
+				switch strings.ToLower(words[0]) {
+				case "primary":
+					table.key = primaryKey(def)
+				case "foreign", "index", "key", "unique", "constraint":
+				default:
+					table.columns = append(table.columns, words[0])
+					if strings.Contains(strings.ToLower(def), "primary key") {
+						table.key = words[0]
+					}
+				}
+			}
+			s[m[2]] = table
+		} else if m := dropTable.FindStringSubmatch(statement); m != nil {
+			if _, ok := s[m[2]]; !ok && m[1] == "" {
+				return fmt.Errorf("table %s does not exist", m[2])
+			}
+			delete(s, m[2])
+		} else if m := alterTable.FindStringSubmatch(statement); m != nil {
+			table, ok := s[m[1]]
+			if !ok {
+				return fmt.Errorf("table %s does not exist", m[1])
+			}
+			for _, clause := range splitDefinitions(m[2]) {
+				if err := table.alter(clause); err != nil {
+					return fmt.Errorf("table %s: %s", m[1], err)
+				}
+			}
+			s[m[1]] = table
+		}
+	}
+	return nil
+}
+
+// alter follows a single clause of an alter table statement.
+func (t *tableModel) alter(clause string) error {
+	words := strings.Fields(strings.ToLower(clause))
+	name := strings.Fields(clause)[len(words)-1]
+	if len(words) > 2 {
+		name = strings.Fields(clause)[2]
+	}
+	switch {
+	case len(words) >= 3 && words[0] == "add" && words[1] == "column":
+		if t.column(name) >= 0 {
+			return fmt.Errorf("column %s already exists", name)
+		}
+		t.columns = append(t.columns, name)
+	case len(words) >= 3 && words[0] == "drop" && words[1] == "column":
+		i := t.column(name)
+		if i < 0 {
+			return fmt.Errorf("column %s does not exist", name)
+		}
+		t.columns = append(t.columns[:i], t.columns[i+1:]...)
+	case len(words) >= 2 && words[0] == "modify":
+		if t.column(strings.Fields(clause)[1]) < 0 {
+			return fmt.Errorf("column %s does not exist", strings.Fields(clause)[1])
+		}
+	case strings.HasPrefix(strings.Join(words, " "), "drop primary key"):
+		t.key = ""
+	case strings.HasPrefix(strings.Join(words, " "), "add primary key"):
+		if t.key != "" {
+			return fmt.Errorf("primary key already exists")
+		}
+		t.key = primaryKey(clause)
+	}
+	return nil
+}
+
+// column returns the index of the column, -1 if the table doesn't have it.
+func (t *tableModel) column(name string) int {
+	for i, c := range t.columns {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// copy returns a copy of the schema that can be changed independently.
+func (s schemaModel) copy() schemaModel {
+	c := schemaModel{}
+	for name, table := range s {
+		c[name] = tableModel{columns: append([]string{}, table.columns...), key: table.key}
+	}
+	return c
+}
+
+// normalised returns the schema with columns sorted, as column order isn't followed exactly.
+func (s schemaModel) normalised() schemaModel {
+	n := s.copy()
+	for _, table := range n {
+		sort.Strings(table.columns)
+	}
+	return n
+}
+
+// primaryKey returns the columns in the parentheses of a primary key definition, joined by commas.
+func primaryKey(def string) string {
+	m := keyColumns.FindStringSubmatch(def)
+	if m == nil {
+		return ""
+	}
+	var columns []string
+	for _, c := range strings.Split(m[1], ",") {
+		columns = append(columns, strings.TrimSpace(c))
+	}
+	return strings.Join(columns, ",")
+}
+
+// splitDefinitions splits the text on commas outside of parentheses.
+func splitDefinitions(text string) []string {
+	var defs []string
+	depth, start := 0, 0
+	for i, r := range text {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, strings.TrimSpace(text[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" {
+		defs = append(defs, last)
+	}
+	return defs
+}
+
+// stripComments removes comment lines from a statement.
+func stripComments(statement string) string {
+	var lines []string
+	for _, line := range strings.Split(statement, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
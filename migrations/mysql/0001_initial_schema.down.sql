@@ -0,0 +1,3 @@
+drop table if exists queue;
+drop table if exists lobby;
+drop table if exists track;
@@ -0,0 +1,30 @@
+# The schema as it was before migrations were introduced, as created by the original sync-song.sql.
+# Tables are only created if missing, so databases set up from sync-song.sql are adopted as they are.
+
+create table if not exists track(
+    uri varchar(100) primary key,
+    name varchar(200) not null,
+    artist varchar(200) not null,
+    duration bigint not null
+);
+
+create table if not exists lobby(
+    id varchar(4) primary key,
+    name varchar(100) not null,
+    mode int(1) not null,
+    genre varchar(100) not null,
+    public bool not null,
+    currentUri varchar(100),
+
+    foreign key (currentUri) references track(uri)
+);
+
+create table if not exists queue(
+    lobbyID varchar(4),
+    trackURI varchar(100),
+    _rank int(3) not null,
+
+    primary key (lobbyID, trackURI),
+    foreign key (lobbyID) references lobby(id),
+    foreign key (trackURI) references track(uri)
+);
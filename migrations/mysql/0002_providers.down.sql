@@ -0,0 +1,2 @@
+alter table lobby drop column providers;
+alter table track drop column provider;
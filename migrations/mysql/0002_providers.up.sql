@@ -0,0 +1,3 @@
+# Tracks come from one of several music providers, and lobbies can be restricted to some of them.
+alter table track add column provider varchar(20) not null default 'spotify' after uri;
+alter table lobby add column providers varchar(200) not null default '' after public;
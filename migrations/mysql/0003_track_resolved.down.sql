@@ -0,0 +1 @@
+alter table track drop column resolved;
@@ -0,0 +1,2 @@
+# True if the details came from the metadata resolver rather than a client.
+alter table track add column resolved bool not null default false after duration;
@@ -0,0 +1,5 @@
+drop table fallback;
+drop table history;
+
+alter table lobby drop column autoplay;
+alter table track drop column genre;
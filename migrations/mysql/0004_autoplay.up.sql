@@ -0,0 +1,25 @@
+# Genre of the lobby the track was first played in, used by genre autoplay.
+alter table track add column genre varchar(100) not null default '' after duration;
+alter table lobby add column autoplay varchar(20) not null default '' after providers;
+
+create table history(
+    id bigint auto_increment primary key,
+    lobbyID varchar(4) not null,
+    trackURI varchar(100) not null,
+    playedAt bigint not null,
+    autoplayed bool not null,
+
+    index (lobbyID, playedAt),
+    foreign key (lobbyID) references lobby(id),
+    foreign key (trackURI) references track(uri)
+);
+
+create table fallback(
+    lobbyID varchar(4),
+    trackURI varchar(100),
+    _rank int(3) not null,
+
+    primary key (lobbyID, _rank),
+    foreign key (lobbyID) references lobby(id),
+    foreign key (trackURI) references track(uri)
+);
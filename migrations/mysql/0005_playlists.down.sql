@@ -0,0 +1,2 @@
+drop table playlist_track;
+drop table playlist;
@@ -0,0 +1,22 @@
+create table playlist(
+    id bigint auto_increment primary key,
+    name varchar(100) not null,
+    # Empty if the playlist belongs to the lobby rather than a user.
+    owner varchar(100) not null default '',
+    lobbyID varchar(4),
+    createdAt bigint not null,
+
+    index (owner),
+    index (lobbyID),
+    foreign key (lobbyID) references lobby(id)
+);
+
+create table playlist_track(
+    playlistID bigint,
+    _rank int not null,
+    trackURI varchar(100) not null,
+
+    primary key (playlistID, _rank),
+    foreign key (playlistID) references playlist(id),
+    foreign key (trackURI) references track(uri)
+);
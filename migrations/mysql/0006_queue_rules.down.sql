@@ -0,0 +1,13 @@
+# Tracks are keyed by track again, so only the first of any duplicates is kept.
+delete q from queue q
+join queue d on d.lobbyID = q.lobbyID and d.trackURI = q.trackURI and d._rank < q._rank;
+
+alter table queue drop primary key, add primary key (lobbyID, trackURI);
+alter table queue drop column username;
+
+alter table lobby
+    drop column maxQueueLength,
+    drop column maxPerUser,
+    drop column repeatWindow,
+    drop column maxDuration,
+    drop column allowDuplicates;
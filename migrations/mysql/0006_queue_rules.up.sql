@@ -0,0 +1,21 @@
+# Queue rules, zero means unlimited.
+alter table lobby
+    add column maxQueueLength int not null default 0 after autoplay,
+    add column maxPerUser int not null default 0 after maxQueueLength,
+    add column repeatWindow int not null default 0 after maxPerUser,
+    add column maxDuration bigint not null default 0 after repeatWindow,
+    add column allowDuplicates bool not null default false after maxDuration;
+
+# Member who queued the track, used by the per member queue limit.
+alter table queue add column username varchar(100) not null default '' after _rank;
+
+# Queued tracks are ranked rather than keyed by track, as lobbies can allow duplicates.
+# Ranks are renumbered in queue order first, so they are unique within each lobby.
+update queue q join (
+    select a.lobbyID, a.trackURI, count(b.trackURI) as position from queue a
+    left join queue b on b.lobbyID = a.lobbyID and (b._rank < a._rank or (b._rank = a._rank and b.trackURI < a.trackURI))
+    group by a.lobbyID, a.trackURI
+) ranked on ranked.lobbyID = q.lobbyID and ranked.trackURI = q.trackURI
+set q._rank = ranked.position;
+
+alter table queue drop primary key, add primary key (lobbyID, _rank);
@@ -0,0 +1,3 @@
+drop table queue_vote;
+
+alter table queue drop column addedAt;
@@ -0,0 +1,13 @@
+# Time the track was queued, breaking ties between equal scores in democracy lobbies.
+alter table queue add column addedAt bigint not null default 0 after username;
+
+# Votes on queued tracks in democracy lobbies, rewritten along with the queue.
+create table queue_vote(
+    lobbyID varchar(4),
+    _rank int(3) not null,
+    username varchar(100) not null,
+    value int(1) not null,
+
+    primary key (lobbyID, _rank, username),
+    foreign key (lobbyID, _rank) references queue(lobbyID, _rank)
+);
@@ -0,0 +1 @@
+alter table lobby drop column djTracksPerTurn, drop column djMinutesPerTurn;
@@ -0,0 +1,4 @@
+# DJ rotation, zero means the limit isn't used.
+alter table lobby
+    add column djTracksPerTurn int not null default 0 after allowDuplicates,
+    add column djMinutesPerTurn int not null default 0 after djTracksPerTurn;
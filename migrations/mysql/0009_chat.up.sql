@@ -0,0 +1,10 @@
+create table chat(
+    id bigint auto_increment primary key,
+    lobbyID varchar(4) not null,
+    username varchar(100) not null,
+    text varchar(2000) not null,
+    sentAt bigint not null,
+
+    index (lobbyID, sentAt),
+    foreign key (lobbyID) references lobby(id)
+);
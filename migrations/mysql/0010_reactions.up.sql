@@ -0,0 +1,13 @@
+# Reactions to a play of a track, identified by the time it was played.
+create table reaction(
+    lobbyID varchar(4),
+    playedAt bigint not null,
+    trackURI varchar(100) not null,
+    username varchar(100) not null,
+    reaction varchar(40) not null,
+
+    primary key (lobbyID, playedAt, username, reaction),
+    index (lobbyID, reaction),
+    foreign key (lobbyID) references lobby(id),
+    foreign key (trackURI) references track(uri)
+);
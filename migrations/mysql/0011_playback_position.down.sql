@@ -0,0 +1 @@
+alter table lobby drop column trackStartedAt, drop column position;
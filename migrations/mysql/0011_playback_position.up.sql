@@ -0,0 +1,5 @@
+alter table lobby
+    # Time in millis the current track started from its beginning, zero while paused.
+    add column trackStartedAt bigint not null default 0 after currentUri,
+    # Millis into the current track playback was paused at when the server shut down.
+    add column position bigint not null default 0 after trackStartedAt;
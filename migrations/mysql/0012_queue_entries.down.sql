@@ -0,0 +1,25 @@
+alter table queue_vote drop foreign key queue_vote_entry;
+
+# Ranks are renumbered in queue order, as they must be whole numbers again.
+update queue q join (
+    select a.lobbyID, a.entry, count(b.entry) as position from queue a
+    left join queue b on b.lobbyID = a.lobbyID and (b._rank < a._rank or (b._rank = a._rank and b.entry < a.entry))
+    group by a.lobbyID, a.entry
+) ranked on ranked.lobbyID = q.lobbyID and ranked.entry = q.entry
+set q._rank = ranked.position;
+
+alter table queue_vote add column _rank int(3) not null default 0 after lobbyID;
+update queue_vote v join queue q on q.lobbyID = v.lobbyID and q.entry = v.entry set v._rank = q._rank;
+
+alter table queue
+    drop index queue_rank,
+    drop primary key,
+    modify _rank int(3) not null,
+    add primary key (lobbyID, _rank),
+    drop column entry;
+
+alter table queue_vote
+    drop primary key,
+    drop column entry,
+    add primary key (lobbyID, _rank, username),
+    add constraint queue_vote_ibfk_1 foreign key (lobbyID, _rank) references queue(lobbyID, _rank);
@@ -0,0 +1,21 @@
+# Queued tracks are keyed by an entry ID rather than their rank, so a track can be added,
+# moved or removed without rewriting the rest of the queue. Ranks are fractional, so a
+# track can be placed between two others.
+alter table queue_vote drop foreign key queue_vote_ibfk_1;
+
+alter table queue add column entry bigint not null default 0 after lobbyID;
+update queue set entry = _rank;
+alter table queue
+    drop primary key,
+    add primary key (lobbyID, entry),
+    modify _rank double not null,
+    add index queue_rank (lobbyID, _rank);
+
+# Votes are removed along with the queued track they are on.
+alter table queue_vote add column entry bigint not null default 0 after lobbyID;
+update queue_vote set entry = _rank;
+alter table queue_vote
+    drop primary key,
+    drop column _rank,
+    add primary key (lobbyID, entry, username),
+    add constraint queue_vote_entry foreign key (lobbyID, entry) references queue(lobbyID, entry) on delete cascade;
@@ -0,0 +1,3 @@
+alter table lobby drop column node;
+
+drop table node;
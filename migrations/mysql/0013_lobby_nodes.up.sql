@@ -0,0 +1,11 @@
+# Lobbies are homed on one of the server instances sharing the database, which records
+# that it's alive with a heartbeat. A lobby whose node has stopped can be adopted by another.
+create table node(
+    id varchar(100) primary key,
+    # URL other nodes reach the node's HTTP server at.
+    address varchar(200) not null,
+    heartbeatAt bigint not null
+);
+
+# Lobbies stored before nodes were introduced have no node, and are adopted by whichever node first serves them.
+alter table lobby add column node varchar(100) not null default '' after public;
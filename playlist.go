@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Supported playlist file formats.
+const (
+	FORMAT_M3U  = "m3u"
+	FORMAT_XSPF = "xspf"
+	FORMAT_JSON = "json"
+)
+
+// The maximum number of tracks that can be imported at once.
+const MAX_IMPORT_TRACKS = 500
+
+// playlistFormat returns the playlist format named by the format parameter,
+// falling back to the content type if no format was provided.
+func playlistFormat(format string, contentType string) (string, error) {
+	switch strings.ToLower(format) {
+	case FORMAT_M3U, "m3u8":
+		return FORMAT_M3U, nil
+	case FORMAT_XSPF:
+		return FORMAT_XSPF, nil
+	case FORMAT_JSON:
+		return FORMAT_JSON, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported playlist format %q", format)
+	}
+
+	// Ignore parameters such as charset.
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	switch strings.ToLower(contentType) {
+	case "audio/x-mpegurl", "audio/mpegurl", "application/vnd.apple.mpegurl", "application/x-mpegurl":
+		return FORMAT_M3U, nil
+	case "application/xspf+xml":
+		return FORMAT_XSPF, nil
+	case "application/json":
+		return FORMAT_JSON, nil
+	}
+	return "", fmt.Errorf("unable to determine playlist format from content type %q", contentType)
+}
+
+// parsePlaylist parses a playlist file in the provided format.
+func parsePlaylist(format string, data []byte) ([]*Track, error) {
+	var tracks []*Track
+	var err error
+	switch format {
+	case FORMAT_M3U:
+		tracks, err = parseM3U(data)
+	case FORMAT_XSPF:
+		tracks, err = parseXSPF(data)
+	case FORMAT_JSON:
+		tracks, err = parseJSONPlaylist(data)
+	default:
+		return nil, fmt.Errorf("unsupported playlist format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("playlist has no tracks")
+	}
+	if len(tracks) > MAX_IMPORT_TRACKS {
+		return nil, fmt.Errorf("playlist has %d tracks, the maximum is %d", len(tracks), MAX_IMPORT_TRACKS)
+	}
+	return tracks, nil
+}
+
+// parseM3U parses an M3U playlist. Track details are read from #EXTINF lines
+// of the form "#EXTINF:<seconds>,<artist> - <title>", which precede the track's URI.
+func parseM3U(data []byte) ([]*Track, error) {
+	var tracks []*Track
+	next := &Track{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)
+			// Unknown durations are -1.
+			if seconds, err := strconv.ParseInt(strings.TrimSpace(info[0]), 10, 64); err == nil && seconds > 0 {
+				next.Duration = seconds * 1000
+			}
+			if len(info) == 2 {
+				if parts := strings.SplitN(info[1], " - ", 2); len(parts) == 2 {
+					next.Artist = strings.TrimSpace(parts[0])
+					next.Name = strings.TrimSpace(parts[1])
+				} else {
+					next.Name = strings.TrimSpace(info[1])
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+			// Other directives and comments are ignored.
+		default:
+			next.URI = line
+			tracks = append(tracks, next)
+			next = &Track{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read m3u playlist: %s", err)
+	}
+	return tracks, nil
+}
+
+// xspfPlaylist is the subset of the XSPF format that is imported.
+type xspfPlaylist struct {
+	Tracks []struct {
+		Location string `xml:"location"`
+		Title    string `xml:"title"`
+		Creator  string `xml:"creator"`
+		// Duration in millis.
+		Duration int64 `xml:"duration"`
+	} `xml:"trackList>track"`
+}
+
+// parseXSPF parses an XSPF playlist.
+func parseXSPF(data []byte) ([]*Track, error) {
+	playlist := xspfPlaylist{}
+	if err := xml.Unmarshal(data, &playlist); err != nil {
+		return nil, fmt.Errorf("failed to parse xspf playlist: %s", err)
+	}
+	var tracks []*Track
+	for _, t := range playlist.Tracks {
+		tracks = append(tracks, &Track{
+			URI:      strings.TrimSpace(t.Location),
+			Name:     strings.TrimSpace(t.Title),
+			Artist:   strings.TrimSpace(t.Creator),
+			Duration: t.Duration,
+		})
+	}
+	return tracks, nil
+}
+
+// parseJSONPlaylist parses a JSON playlist, either a list of tracks or an object with a tracks field.
+func parseJSONPlaylist(data []byte) ([]*Track, error) {
+	var tracks []*Track
+	if err := json.Unmarshal(data, &tracks); err == nil {
+		return tracks, nil
+	}
+	playlist := struct {
+		Tracks []*Track `json:"tracks"`
+	}{}
+	if err := json.Unmarshal(data, &playlist); err != nil {
+		return nil, fmt.Errorf("failed to parse json playlist: %s", err)
+	}
+	return playlist.Tracks, nil
+}
+
+// Playlist is a saved list of tracks belonging to either a user or a lobby.
+type Playlist struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// User who saved the playlist, empty if it belongs to a lobby.
+	Owner string `json:"owner,omitempty"`
+	// Lobby the playlist belongs to, or was saved from if it belongs to a user.
+	LobbyID   string   `json:"lobbyId,omitempty"`
+	CreatedAt int64    `json:"createdAt"`
+	Tracks    []*Track `json:"tracks,omitempty"`
+}
+
+// exportContentTypes maps each export format to the content type it is served with.
+var exportContentTypes = map[string]string{
+	FORMAT_M3U:  "audio/x-mpegurl",
+	FORMAT_JSON: "application/json",
+}
+
+// exportPlaylist encodes the tracks in the provided format, returning the encoded
+// playlist and its content type. Only M3U and JSON can be exported.
+func exportPlaylist(format string, name string, tracks []*Track) ([]byte, string, error) {
+	switch format {
+	case FORMAT_M3U:
+		return writeM3U(tracks), exportContentTypes[FORMAT_M3U], nil
+	case FORMAT_JSON:
+		data, err := writeJSONPlaylist(name, tracks)
+		return data, exportContentTypes[FORMAT_JSON], err
+	}
+	return nil, "", fmt.Errorf("cannot export playlists as %q", format)
+}
+
+// writeM3U encodes the tracks as an extended M3U playlist.
+func writeM3U(tracks []*Track) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	for _, t := range tracks {
+		seconds := int64(-1)
+		if t.Duration > 0 {
+			seconds = t.Duration / 1000
+		}
+		title := t.Name
+		if t.Artist != "" {
+			title = fmt.Sprintf("%s - %s", t.Artist, t.Name)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", seconds, title, t.URI)
+	}
+	return b.Bytes()
+}
+
+// writeJSONPlaylist encodes the tracks as a JSON playlist, in the same form read by parseJSONPlaylist.
+func writeJSONPlaylist(name string, tracks []*Track) ([]byte, error) {
+	// Positions and usernames only make sense within a session.
+	var exported []*Track
+	for _, t := range tracks {
+		track := *t
+		track.Position = 0
+		track.Username = ""
+		exported = append(exported, &track)
+	}
+	return json.Marshal(Playlist{Name: name, Tracks: exported})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// The most tracks exported from a lobby's history.
+const HISTORY_EXPORT_LIMIT = 1000
+
+// Where a saved playlist's tracks are taken from.
+const (
+	SOURCE_HISTORY = "history"
+	SOURCE_QUEUE   = "queue"
+)
+
+// The largest playlist file that can be imported.
+const MAX_PLAYLIST_BYTES = 1 << 20
+
+// ImportPlaylist parses a playlist file and sends its tracks to the lobby to be queued.
+// The import is performed by the lobby as if the user had sent an IMPORT command, so the
+// outcome is sent over the user's websocket, as a reply if a requestId is provided.
+func ImportPlaylist(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := r.URL.Query().Get("username")
+	log().Info("ImportPlaylist request received", "lobby", id, "username", username)
+
+	lobby, ok := lobbyMember(w, id, username)
+	if !ok {
+		return
+	}
+
+	format, err := playlistFormat(r.URL.Query().Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_PLAYLIST_BYTES))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read playlist: %s", err), http.StatusBadRequest)
+		return
+	}
+	tracks, err := parsePlaylist(format, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queueImport(w, r, lobby, username, tracks)
+}
+
+// lobbyMember returns the lobby if it exists and the user is one of its members,
+// otherwise writes an error response.
+func lobbyMember(w http.ResponseWriter, id string, username string) (*Lobby, bool) {
+	lobby, ok := getLobby(id)
+	if !ok {
+		http.Error(w, "Lobby does not exist", http.StatusNotFound)
+		return nil, false
+	}
+	if _, ok := lobby.Clients[username]; !ok {
+		http.Error(w, "User is not a lobby member", http.StatusForbidden)
+		return nil, false
+	}
+	return lobby, true
+}
+
+// queueImport sends the tracks to the lobby to be imported as if the user had sent an IMPORT command.
+func queueImport(w http.ResponseWriter, r *http.Request, lobby *Lobby, username string, tracks []*Track) {
+	resolveRemote(tracks...)
+	if !lobby.receive(Message{
+		Username:   username,
+		Command:    Command(IMPORT),
+		TrackQueue: tracks,
+		RequestID:  r.URL.Query().Get("requestId"),
+	}) {
+		http.Error(w, "Lobby is moving, try again", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("%d", len(tracks))))
+}
+
+// writeExport writes the tracks as a playlist in the format requested, defaulting to JSON.
+func writeExport(w http.ResponseWriter, r *http.Request, name string, tracks []*Track) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FORMAT_JSON
+	}
+	data, contentType, err := exportPlaylist(format, name, tracks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	w.Write(data)
+}
+
+// lobbyTracks returns the tracks of a lobby's history or queue.
+func lobbyTracks(lobby *Lobby, source string) ([]*Track, error) {
+	switch source {
+	case SOURCE_HISTORY:
+		return selectFullHistory(lobby.ID, HISTORY_EXPORT_LIMIT)
+	case SOURCE_QUEUE:
+		return lobby.TrackQueue, nil
+	}
+	return nil, fmt.Errorf("unknown playlist source %q", source)
+}
+
+// ExportHistory exports the tracks played in a lobby as a playlist.
+func ExportHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log().Info("ExportHistory request received", "lobby", id)
+
+	lobby, ok := getLobby(id)
+	if !ok {
+		http.Error(w, "Lobby does not exist", http.StatusNotFound)
+		return
+	}
+	tracks, err := lobbyTracks(lobby, SOURCE_HISTORY)
+	if err != nil {
+		log().Error("Failed to read history", "lobby", id, "error", err)
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+	writeExport(w, r, fmt.Sprintf("%s history", lobby.Name), tracks)
+}
+
+// ExportQueue exports a lobby's current queue as a playlist.
+func ExportQueue(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log().Info("ExportQueue request received", "lobby", id)
+
+	lobby, ok := getLobby(id)
+	if !ok {
+		http.Error(w, "Lobby does not exist", http.StatusNotFound)
+		return
+	}
+	writeExport(w, r, fmt.Sprintf("%s queue", lobby.Name), lobby.TrackQueue)
+}
+
+// SavePlaylist saves a lobby's history or current queue as a playlist. The playlist
+// belongs to the user named by owner if provided, otherwise to the lobby.
+func SavePlaylist(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	name := r.FormValue("name")
+	source := r.FormValue("source")
+	owner := r.FormValue("owner")
+	log().Info("SavePlaylist request received", "lobby", id, "name", name, "source", source, "owner", owner)
+
+	lobby, ok := getLobby(id)
+	if !ok {
+		http.Error(w, "Lobby does not exist", http.StatusNotFound)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Playlist name is required", http.StatusBadRequest)
+		return
+	}
+	tracks, err := lobbyTracks(lobby, source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(tracks) == 0 {
+		http.Error(w, "No tracks to save", http.StatusBadRequest)
+		return
+	}
+
+	playlist := Playlist{Name: name, Owner: owner, LobbyID: lobby.ID, CreatedAt: NowMillis(), Tracks: tracks}
+	pid, err := insertPlaylist(&playlist, lobby.Genre)
+	if err != nil {
+		log().Error("Failed to save playlist", "lobby", id, "error", err)
+		http.Error(w, "Failed to save playlist", http.StatusInternalServerError)
+		return
+	}
+	log().Info("Playlist saved", "lobby", id, "name", name, "playlist", pid)
+
+	w.Write([]byte(fmt.Sprintf("%d", pid)))
+}
+
+// GetPlaylists lists the saved playlists of a user, or of a lobby.
+func GetPlaylists(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	lobbyID := r.URL.Query().Get("lobby")
+	log().Info("GetPlaylists request received", "owner", owner, "lobby", lobbyID)
+
+	if owner == "" && lobbyID == "" {
+		http.Error(w, "Either owner or lobby is required", http.StatusBadRequest)
+		return
+	}
+	playlists, err := selectPlaylists(owner, lobbyID)
+	if err != nil {
+		log().Error("Failed to read playlists", "error", err)
+		http.Error(w, "Failed to read playlists", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(playlists)
+}
+
+// readPlaylist returns the saved playlist with the ID in the request, otherwise writes an error response.
+func readPlaylist(w http.ResponseWriter, r *http.Request) (*Playlist, bool) {
+	pid, err := strconv.ParseInt(mux.Vars(r)["pid"], 10, 64)
+	if err != nil {
+		http.Error(w, "Playlist ID is not an int", http.StatusBadRequest)
+		return nil, false
+	}
+	playlist, err := selectPlaylist(pid)
+	if err == errPlaylistNotFound {
+		http.Error(w, "Playlist does not exist", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log().Error("Failed to read playlist", "playlist", pid, "error", err)
+		http.Error(w, "Failed to read playlist", http.StatusInternalServerError)
+		return nil, false
+	}
+	return playlist, true
+}
+
+// GetPlaylist exports a saved playlist. Without a format, the playlist is returned with its details.
+func GetPlaylist(w http.ResponseWriter, r *http.Request) {
+	log().Info("GetPlaylist request received", "playlist", mux.Vars(r)["pid"])
+
+	playlist, ok := readPlaylist(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("format") == "" {
+		json.NewEncoder(w).Encode(playlist)
+		return
+	}
+	writeExport(w, r, playlist.Name, playlist.Tracks)
+}
+
+// LoadPlaylist queues the tracks of a saved playlist in a lobby, as an import by the user.
+func LoadPlaylist(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := r.URL.Query().Get("username")
+	log().Info("LoadPlaylist request received", "lobby", id, "playlist", mux.Vars(r)["pid"], "username", username)
+
+	lobby, ok := lobbyMember(w, id, username)
+	if !ok {
+		return
+	}
+	playlist, ok := readPlaylist(w, r)
+	if !ok {
+		return
+	}
+	queueImport(w, r, lobby, username, playlist.Tracks)
+}
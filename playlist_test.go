@@ -0,0 +1,168 @@
+package main
+
+import "testing"
+
+func TestPlaylistFormat(t *testing.T) {
+	testCases := []struct {
+		format      string
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{"m3u", "", FORMAT_M3U, false},
+		{"M3U8", "", FORMAT_M3U, false},
+		{"xspf", "application/json", FORMAT_XSPF, false},
+		{"", "application/json; charset=utf-8", FORMAT_JSON, false},
+		{"", "audio/x-mpegurl", FORMAT_M3U, false},
+		{"", "application/xspf+xml", FORMAT_XSPF, false},
+		{"pls", "", "", true},
+		{"", "text/plain", "", true},
+	}
+
+	for _, tc := range testCases {
+		got, err := playlistFormat(tc.format, tc.contentType)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("playlistFormat(%q, %q), got: %q, %v, want: %q, error: %t", tc.format, tc.contentType, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseM3U(t *testing.T) {
+	data := `#EXTM3U
+#EXTINF:213,Rick Astley - Never Gonna Give You Up
+spotify:track:4uLU6hMCjMI75M1A2tKUQC
+
+#EXTINF:-1,Untitled
+https://example.com/song.mp3
+youtube:dQw4w9WgXcQ
+`
+	tracks, err := parsePlaylist(FORMAT_M3U, []byte(data))
+	if err != nil {
+		t.Fatalf("parsePlaylist returned error: %s", err)
+	}
+
+	want := []Track{
+		{URI: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", Name: "Never Gonna Give You Up", Artist: "Rick Astley", Duration: 213000},
+		{URI: "https://example.com/song.mp3", Name: "Untitled"},
+		{URI: "youtube:dQw4w9WgXcQ"},
+	}
+	if len(tracks) != len(want) {
+		t.Fatalf("Incorrect number of tracks, got: %d, want: %d", len(tracks), len(want))
+	}
+	for i := range want {
+		if *tracks[i] != want[i] {
+			t.Errorf("Track %d, got: %#v, want: %#v", i, *tracks[i], want[i])
+		}
+	}
+}
+
+func TestParseXSPF(t *testing.T) {
+	data := `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <trackList>
+    <track>
+      <location>spotify:track:4uLU6hMCjMI75M1A2tKUQC</location>
+      <title>Never Gonna Give You Up</title>
+      <creator>Rick Astley</creator>
+      <duration>213573</duration>
+    </track>
+  </trackList>
+</playlist>`
+	tracks, err := parsePlaylist(FORMAT_XSPF, []byte(data))
+	if err != nil {
+		t.Fatalf("parsePlaylist returned error: %s", err)
+	}
+	want := Track{URI: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", Name: "Never Gonna Give You Up", Artist: "Rick Astley", Duration: 213573}
+	if len(tracks) != 1 || *tracks[0] != want {
+		t.Errorf("parsePlaylist, got: %v, want: %#v", tracks, want)
+	}
+}
+
+func TestParseJSONPlaylist(t *testing.T) {
+	testCases := []string{
+		`[{"uri":"youtube:dQw4w9WgXcQ","name":"a"}]`,
+		`{"name":"party","tracks":[{"uri":"youtube:dQw4w9WgXcQ","name":"a"}]}`,
+	}
+
+	for _, data := range testCases {
+		tracks, err := parsePlaylist(FORMAT_JSON, []byte(data))
+		if err != nil {
+			t.Errorf("parsePlaylist(%s) returned error: %s", data, err)
+			continue
+		}
+		if len(tracks) != 1 || tracks[0].URI != "youtube:dQw4w9WgXcQ" {
+			t.Errorf("parsePlaylist(%s), got: %v", data, tracks)
+		}
+	}
+}
+
+func TestParsePlaylist_Invalid(t *testing.T) {
+	testCases := []struct {
+		format string
+		data   string
+	}{
+		{FORMAT_M3U, "#EXTM3U\n"},
+		{FORMAT_XSPF, "<playlist>"},
+		{FORMAT_JSON, `{"tracks": "none"}`},
+		{"pls", "[playlist]"},
+	}
+
+	for _, tc := range testCases {
+		if _, err := parsePlaylist(tc.format, []byte(tc.data)); err == nil {
+			t.Errorf("parsePlaylist(%q, %q) did not return an error", tc.format, tc.data)
+		}
+	}
+}
+
+func TestExportPlaylist_RoundTrips(t *testing.T) {
+	tracks := []*Track{
+		{URI: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", Name: "Never Gonna Give You Up", Artist: "Rick Astley", Duration: 213000},
+		{URI: "https://example.com/song.mp3", Name: "song"},
+	}
+
+	for _, format := range []string{FORMAT_M3U, FORMAT_JSON} {
+		data, contentType, err := exportPlaylist(format, "party", tracks)
+		if err != nil {
+			t.Fatalf("%s: exportPlaylist returned error: %s", format, err)
+		}
+		if contentType != exportContentTypes[format] {
+			t.Errorf("%s: incorrect content type, got: %q", format, contentType)
+		}
+		got, err := parsePlaylist(format, data)
+		if err != nil {
+			t.Fatalf("%s: failed to parse exported playlist: %s", format, err)
+		}
+		if len(got) != len(tracks) {
+			t.Fatalf("%s: incorrect number of tracks, got: %d, want: %d", format, len(got), len(tracks))
+		}
+		for i := range tracks {
+			if *got[i] != *tracks[i] {
+				t.Errorf("%s: track %d, got: %#v, want: %#v", format, i, *got[i], *tracks[i])
+			}
+		}
+	}
+}
+
+func TestExportPlaylist_UnsupportedFormat(t *testing.T) {
+	if _, _, err := exportPlaylist(FORMAT_XSPF, "party", nil); err == nil {
+		t.Errorf("exportPlaylist did not return an error for xspf")
+	}
+}
+
+func TestWriteJSONPlaylist_OmitsSessionDetails(t *testing.T) {
+	track := &Track{URI: "youtube:dQw4w9WgXcQ", Position: 100, Username: "bob"}
+	data, err := writeJSONPlaylist("party", []*Track{track})
+	if err != nil {
+		t.Fatalf("writeJSONPlaylist returned error: %s", err)
+	}
+	got, err := parseJSONPlaylist(data)
+	if err != nil {
+		t.Fatalf("parseJSONPlaylist returned error: %s", err)
+	}
+	if got[0].Position != 0 || got[0].Username != "" {
+		t.Errorf("Session details were exported, got: %#v", got[0])
+	}
+	if track.Position != 100 {
+		t.Errorf("writeJSONPlaylist modified the track")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Protocol versions understood by the server.
+// Version 1 is the original flat Message format, which existing app builds still use.
+// Version 2 wraps every message in a typed Envelope.
+const (
+	PROTOCOL_V1     = 1
+	PROTOCOL_V2     = 2
+	LATEST_PROTOCOL = PROTOCOL_V2
+)
+
+// Envelope types.
+const (
+	TYPE_STATE   = "state"
+	TYPE_CHAT    = "chat"
+	TYPE_COMMAND = "command"
+	TYPE_ERROR   = "error"
+	TYPE_EVENT   = "event"
+	TYPE_ACK     = "ack"
+	// Recent chat messages, sent on join.
+	TYPE_CHAT_HISTORY = "chatHistory"
+)
+
+// Events sent in an EventPayload.
+const (
+	EVENT_WELCOME = "welcome"
+	EVENT_NOTICE  = "notice"
+)
+
+// Envelope wraps a single typed payload.
+type Envelope struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Request this envelope replies to, or for envelopes from a client, the ID of the request.
+	RequestID string `json:"requestId,omitempty"`
+	// Sequence number of the broadcast this envelope belongs to.
+	Seq     uint64      `json:"seq,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// StatePayload holds the state of the lobby, either in full or as diffs.
+// When sent by a client, only StateVersion is used, to acknowledge the version it has applied.
+type StatePayload struct {
+	StateVersion uint64   `json:"stateVersion"`
+	FullState    bool     `json:"fullState"`
+	CurrentTrack *Track   `json:"currentTrack,omitempty"`
+	TrackQueue   []*Track `json:"trackQueue,omitempty"`
+	ClientNames  []string `json:"clientNames,omitempty"`
+	Admin        string   `json:"admin,omitempty"`
+	Autoplay     string   `json:"autoplay,omitempty"`
+	DJ           string   `json:"dj,omitempty"`
+	DJWaitlist   []string `json:"djWaitlist,omitempty"`
+	// Number of members who gave each reaction to the current track.
+	Reactions  map[string]int `json:"reactions,omitempty"`
+	StateDiffs []StateDiff    `json:"stateDiffs,omitempty"`
+	// Time at which the current track's position is accurate.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// ChatPayload holds a message sent by a user.
+type ChatPayload struct {
+	Username string `json:"username"`
+	Text     string `json:"text"`
+}
+
+// CommandPayload holds a playback command from the server, or a request from a client.
+type CommandPayload struct {
+	Command string `json:"command"`
+	// User who caused the command, or for a PROMOTE or KICK request, the user to act on.
+	Username  string `json:"username,omitempty"`
+	Track     *Track `json:"track,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	// Autoplay strategy for a SET_AUTOPLAY request.
+	Autoplay string `json:"autoplay,omitempty"`
+	// Fallback playlist for a SET_AUTOPLAY request, or the tracks for an IMPORT request.
+	Tracks []*Track `json:"tracks,omitempty"`
+	// Reaction to the current track for a REACT request.
+	Reaction string `json:"reaction,omitempty"`
+}
+
+// ErrorPayload describes why a request failed.
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+// AckPayload holds the outcome of a successful request.
+type AckPayload struct {
+	Result string `json:"result"`
+}
+
+// ChatHistoryPayload holds a lobby's recent chat messages, oldest first.
+type ChatHistoryPayload struct {
+	Messages []ChatMessage `json:"messages"`
+}
+
+// EventPayload describes something that happened in the lobby, e.g. a server notice.
+type EventPayload struct {
+	Event   string `json:"event"`
+	Text    string `json:"text,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+// protocolError is returned when a client sends a message that can't be understood.
+// Unlike a read error, it doesn't mean the connection is broken.
+type protocolError struct {
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return e.msg
+}
+
+// negotiateProtocol returns the protocol version to use for a client that requested
+// the provided version. Clients that don't request a version use version 1.
+func negotiateProtocol(requested string) int {
+	version, err := strconv.Atoi(requested)
+	if err != nil || version < PROTOCOL_V1 {
+		return PROTOCOL_V1
+	}
+	if version > LATEST_PROTOCOL {
+		return LATEST_PROTOCOL
+	}
+	return version
+}
+
+// newEnvelope creates an envelope of the provided type.
+func newEnvelope(envType string, payload interface{}) Envelope {
+	return Envelope{Version: LATEST_PROTOCOL, Type: envType, Payload: payload}
+}
+
+// envelopesFromMessage splits a flat Message into one envelope per kind of content it carries,
+// in the order error or ack, chat or notice, chat history, command, then state.
+func envelopesFromMessage(msg Message) []Envelope {
+	var envelopes []Envelope
+	add := func(envType string, payload interface{}) {
+		env := newEnvelope(envType, payload)
+		env.RequestID = msg.RequestID
+		env.Seq = msg.Seq
+		envelopes = append(envelopes, env)
+	}
+
+	if msg.Error != "" {
+		add(TYPE_ERROR, ErrorPayload{Message: msg.Error})
+	} else if msg.Result != "" {
+		add(TYPE_ACK, AckPayload{Result: msg.Result})
+	}
+	if msg.UserMsg != "" {
+		// Messages without a username come from the server.
+		if msg.Username == "" {
+			add(TYPE_EVENT, EventPayload{Event: EVENT_NOTICE, Text: msg.UserMsg})
+		} else {
+			add(TYPE_CHAT, ChatPayload{Username: msg.Username, Text: msg.UserMsg})
+		}
+	}
+	if len(msg.ChatHistory) > 0 {
+		add(TYPE_CHAT_HISTORY, ChatHistoryPayload{Messages: msg.ChatHistory})
+	}
+	if msg.Command != 0 {
+		add(TYPE_COMMAND, CommandPayload{
+			Command:   ServerCommand(msg.Command).String(),
+			Username:  msg.Username,
+			Track:     msg.CurrentTrack,
+			Timestamp: msg.Timestamp,
+		})
+	}
+	if msg.hasState {
+		add(TYPE_STATE, StatePayload{
+			StateVersion: msg.StateVersion,
+			FullState:    msg.FullState,
+			CurrentTrack: msg.CurrentTrack,
+			TrackQueue:   msg.TrackQueue,
+			ClientNames:  msg.ClientNames,
+			Admin:        msg.Admin,
+			Autoplay:     msg.Autoplay,
+			DJ:           msg.DJ,
+			DJWaitlist:   msg.DJWaitlist,
+			Reactions:    msg.Reactions,
+			StateDiffs:   msg.StateDiffs,
+			Timestamp:    msg.Timestamp,
+		})
+	}
+	return envelopes
+}
+
+// decodePayload decodes the payload of an envelope read from a client into v.
+// The envelope is decoded before its type is known, leaving the payload in a generic form,
+// so it is re-encoded with the same codec and decoded again into the right type.
+func decodePayload(c Codec, env Envelope, v interface{}) error {
+	data, err := c.Encode(env.Payload)
+	if err != nil {
+		return &protocolError{fmt.Sprintf("malformed %s payload: %s", env.Type, err)}
+	}
+	if err := c.Decode(data, v); err != nil {
+		return &protocolError{fmt.Sprintf("malformed %s payload: %s", env.Type, err)}
+	}
+	return nil
+}
+
+// messageFromEnvelope converts an envelope sent by a client into the flat Message used by the lobby.
+func messageFromEnvelope(c Codec, env Envelope) (Message, error) {
+	msg := Message{RequestID: env.RequestID}
+	switch env.Type {
+	case TYPE_STATE:
+		payload := StatePayload{}
+		if err := decodePayload(c, env, &payload); err != nil {
+			return msg, err
+		}
+		msg.StateVersion = payload.StateVersion
+	case TYPE_CHAT:
+		payload := ChatPayload{}
+		if err := decodePayload(c, env, &payload); err != nil {
+			return msg, err
+		}
+		msg.UserMsg = payload.Text
+	case TYPE_COMMAND:
+		payload := CommandPayload{}
+		if err := decodePayload(c, env, &payload); err != nil {
+			return msg, err
+		}
+		command, ok := parseClientCommand(payload.Command)
+		if !ok {
+			return msg, &protocolError{fmt.Sprintf("unknown command %q", payload.Command)}
+		}
+		msg.Command = Command(command)
+		msg.CurrentTrack = payload.Track
+		msg.Timestamp = payload.Timestamp
+		msg.Autoplay = payload.Autoplay
+		msg.Reaction = payload.Reaction
+		msg.TrackQueue = payload.Tracks
+		switch command {
+		case PROMOTE:
+			msg.Admin = payload.Username
+		case KICK:
+			msg.Target = payload.Username
+		}
+	default:
+		return msg, &protocolError{fmt.Sprintf("unsupported message type %q", env.Type)}
+	}
+	return msg, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+)
+
+// decodeEnvelope decodes an envelope from JSON, as if read from a client.
+func decodeEnvelope(t *testing.T, data string) Envelope {
+	env := Envelope{}
+	if err := (jsonCodec{}).Decode([]byte(data), &env); err != nil {
+		t.Fatalf("Failed to decode envelope %s: %s", data, err)
+	}
+	return env
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	testCases := []struct {
+		requested string
+		want      int
+	}{
+		{"", PROTOCOL_V1},
+		{"1", PROTOCOL_V1},
+		{"2", PROTOCOL_V2},
+		{"99", LATEST_PROTOCOL},
+		{"0", PROTOCOL_V1},
+		{"abc", PROTOCOL_V1},
+	}
+
+	for _, tc := range testCases {
+		got := negotiateProtocol(tc.requested)
+		if got != tc.want {
+			t.Errorf("negotiateProtocol(%q), got: %d, want: %d", tc.requested, got, tc.want)
+		}
+	}
+}
+
+func TestEnvelopesFromMessage_Types(t *testing.T) {
+	testCases := []struct {
+		name string
+		msg  Message
+		want []string
+	}{
+		{"chat", Message{Username: "a", UserMsg: "hi"}, []string{TYPE_CHAT}},
+		{"notice", Message{UserMsg: "a joined"}, []string{TYPE_EVENT}},
+		{"error", Message{Error: "nope", Result: RESULT_REJECTED}, []string{TYPE_ERROR}},
+		{"ack", Message{RequestID: "1", Result: RESULT_QUEUED}, []string{TYPE_ACK}},
+		{"command with state", Message{Command: Command(PLAY), hasState: true}, []string{TYPE_COMMAND, TYPE_STATE}},
+		{"empty", Message{}, nil},
+	}
+
+	for _, tc := range testCases {
+		envelopes := envelopesFromMessage(tc.msg)
+		if len(envelopes) != len(tc.want) {
+			t.Errorf("%s: incorrect number of envelopes, got: %d, want: %d", tc.name, len(envelopes), len(tc.want))
+			continue
+		}
+		for i, env := range envelopes {
+			if env.Type != tc.want[i] {
+				t.Errorf("%s: envelope %d incorrect type, got: %q, want: %q", tc.name, i, env.Type, tc.want[i])
+			}
+			if env.Version != LATEST_PROTOCOL {
+				t.Errorf("%s: envelope %d incorrect version, got: %d, want: %d", tc.name, i, env.Version, LATEST_PROTOCOL)
+			}
+		}
+	}
+}
+
+func TestEnvelopesFromMessage_NamesCommand(t *testing.T) {
+	envelopes := envelopesFromMessage(Message{Command: Command(PAUSE), Timestamp: 5})
+	payload := envelopes[0].Payload.(CommandPayload)
+	if payload.Command != "PAUSE" || payload.Timestamp != 5 {
+		t.Errorf("Incorrect command payload, got: %#v", payload)
+	}
+}
+
+func TestMessageFromEnvelope(t *testing.T) {
+	testCases := []struct {
+		env  string
+		want Message
+	}{
+		{
+			`{"type":"chat","payload":{"text":"hello"}}`,
+			Message{UserMsg: "hello"},
+		},
+		{
+			`{"type":"state","payload":{"stateVersion":3}}`,
+			Message{StateVersion: 3},
+		},
+		{
+			`{"type":"command","payload":{"command":"VOTE_SKIP"}}`,
+			Message{Command: Command(VOTE_SKIP)},
+		},
+		{
+			`{"type":"command","payload":{"command":"PROMOTE","username":"bob"}}`,
+			Message{Command: Command(PROMOTE), Admin: "bob"},
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := messageFromEnvelope(jsonCodec{}, decodeEnvelope(t, tc.env))
+		if err != nil {
+			t.Errorf("messageFromEnvelope(%s) returned error: %s", tc.env, err)
+			continue
+		}
+		if got.UserMsg != tc.want.UserMsg || got.Command != tc.want.Command || got.Admin != tc.want.Admin || got.StateVersion != tc.want.StateVersion {
+			t.Errorf("messageFromEnvelope(%s), got: %s, want: %s", tc.env, got, tc.want)
+		}
+	}
+}
+
+func TestMessageFromEnvelope_Invalid(t *testing.T) {
+	testCases := []string{
+		`{"type":"unknown"}`,
+		`{"type":"command","payload":{"command":"PLAY"}}`,
+		`{"type":"chat","payload":[]}`,
+	}
+
+	for _, data := range testCases {
+		_, err := messageFromEnvelope(jsonCodec{}, decodeEnvelope(t, data))
+		if _, ok := err.(*protocolError); !ok {
+			t.Errorf("messageFromEnvelope(%s), got: %v, want a protocolError", data, err)
+		}
+	}
+}
+
+func TestEnvelopesFromMessage_CopiesRequestIDAndSeq(t *testing.T) {
+	envelopes := envelopesFromMessage(Message{RequestID: "abc", Seq: 7, Command: Command(PLAY), hasState: true})
+	for _, env := range envelopes {
+		if env.RequestID != "abc" || env.Seq != 7 {
+			t.Errorf("%s envelope incorrect correlation, got: %q, %d, want: %q, %d", env.Type, env.RequestID, env.Seq, "abc", 7)
+		}
+	}
+}
+
+func TestMessageFromEnvelope_KeepsRequestID(t *testing.T) {
+	env := decodeEnvelope(t, `{"type":"command","requestId":"xyz","payload":{"command":"STATE"}}`)
+	msg, err := messageFromEnvelope(jsonCodec{}, env)
+	if err != nil {
+		t.Fatalf("messageFromEnvelope returned error: %s", err)
+	}
+	if msg.RequestID != "xyz" {
+		t.Errorf("Incorrect request ID, got: %q, want: %q", msg.RequestID, "xyz")
+	}
+}
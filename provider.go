@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Names of the supported music providers, sent with each Track so that
+// clients know how to play it.
+const (
+	PROVIDER_SPOTIFY    = "spotify"
+	PROVIDER_YOUTUBE    = "youtube"
+	PROVIDER_SOUNDCLOUD = "soundcloud"
+	PROVIDER_DIRECT     = "direct"
+)
+
+// Longest track URI that can be stored, the width of the database's URI columns.
+const MAX_URI_LENGTH = 100
+
+// Provider is a source of music that clients can play tracks from.
+type Provider interface {
+	Name() string
+	// Matches returns true if the URI belongs to this provider.
+	Matches(uri string) bool
+	// Validate returns an error if the URI does not identify a single playable track.
+	Validate(uri string) error
+	// Normalise rewrites the track's URI into the provider's canonical form and tidies its metadata.
+	Normalise(track *Track)
+}
+
+// Providers are checked in order, so more specific schemes must come before direct URLs.
+var providers = []Provider{
+	spotifyProvider{},
+	youtubeProvider{},
+	soundcloudProvider{},
+	directProvider{},
+}
+
+// providerForURI returns the provider that the URI belongs to.
+func providerForURI(uri string) (Provider, bool) {
+	for _, p := range providers {
+		if p.Matches(uri) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// providerByName returns the provider with the provided name.
+func providerByName(name string) (Provider, bool) {
+	for _, p := range providers {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// parseProviders parses a comma separated list of provider names.
+// An empty list means any provider is allowed.
+func parseProviders(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := providerByName(name); !ok {
+			return nil, fmt.Errorf("unknown provider %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// normaliseMetadata tidies the metadata common to all providers.
+func normaliseMetadata(track *Track, provider Provider) {
+	track.Provider = provider.Name()
+	track.Name = strings.TrimSpace(track.Name)
+	track.Artist = strings.TrimSpace(track.Artist)
+}
+
+// parseHTTPURL parses the URI if it is an http or https URL.
+func parseHTTPURL(uri string) (*url.URL, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, false
+	}
+	return u, true
+}
+
+// hostIs returns true if the URL's host is one of the provided hosts, ignoring any www. prefix.
+func hostIs(u *url.URL, hosts ...string) bool {
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	for _, h := range hosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+var spotifyIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+
+// spotifyProvider handles spotify:track: URIs and open.spotify.com links.
+type spotifyProvider struct{}
+
+func (spotifyProvider) Name() string {
+	return PROVIDER_SPOTIFY
+}
+
+func (spotifyProvider) Matches(uri string) bool {
+	if strings.HasPrefix(uri, "spotify:") {
+		return true
+	}
+	u, ok := parseHTTPURL(uri)
+	return ok && hostIs(u, "open.spotify.com")
+}
+
+// trackID returns the Spotify track ID from either form of URI.
+func (spotifyProvider) trackID(uri string) string {
+	if strings.HasPrefix(uri, "spotify:track:") {
+		return strings.TrimPrefix(uri, "spotify:track:")
+	}
+	if u, ok := parseHTTPURL(uri); ok && strings.HasPrefix(u.Path, "/track/") {
+		return strings.TrimPrefix(u.Path, "/track/")
+	}
+	return ""
+}
+
+func (p spotifyProvider) Validate(uri string) error {
+	if !spotifyIDPattern.MatchString(p.trackID(uri)) {
+		return fmt.Errorf("%q is not a Spotify track", uri)
+	}
+	return nil
+}
+
+func (p spotifyProvider) Normalise(track *Track) {
+	track.URI = "spotify:track:" + p.trackID(track.URI)
+	normaliseMetadata(track, p)
+}
+
+var youtubeIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{11}$`)
+
+// youtubeProvider handles youtube: URIs and youtube.com or youtu.be links.
+type youtubeProvider struct{}
+
+func (youtubeProvider) Name() string {
+	return PROVIDER_YOUTUBE
+}
+
+func (youtubeProvider) Matches(uri string) bool {
+	if strings.HasPrefix(uri, "youtube:") {
+		return true
+	}
+	u, ok := parseHTTPURL(uri)
+	return ok && hostIs(u, "youtube.com", "m.youtube.com", "music.youtube.com", "youtu.be")
+}
+
+// videoID returns the YouTube video ID from any form of URI.
+func (youtubeProvider) videoID(uri string) string {
+	if strings.HasPrefix(uri, "youtube:") {
+		return strings.TrimPrefix(uri, "youtube:")
+	}
+	u, ok := parseHTTPURL(uri)
+	if !ok {
+		return ""
+	}
+	if hostIs(u, "youtu.be") {
+		return strings.TrimPrefix(u.Path, "/")
+	}
+	return u.Query().Get("v")
+}
+
+func (p youtubeProvider) Validate(uri string) error {
+	if !youtubeIDPattern.MatchString(p.videoID(uri)) {
+		return fmt.Errorf("%q is not a YouTube video", uri)
+	}
+	return nil
+}
+
+func (p youtubeProvider) Normalise(track *Track) {
+	track.URI = "youtube:" + p.videoID(track.URI)
+	normaliseMetadata(track, p)
+}
+
+// soundcloudProvider handles soundcloud:tracks: URIs and soundcloud.com track links.
+type soundcloudProvider struct{}
+
+var soundcloudIDPattern = regexp.MustCompile(`^soundcloud:tracks:[0-9]+$`)
+
+func (soundcloudProvider) Name() string {
+	return PROVIDER_SOUNDCLOUD
+}
+
+func (soundcloudProvider) Matches(uri string) bool {
+	if strings.HasPrefix(uri, "soundcloud:") {
+		return true
+	}
+	u, ok := parseHTTPURL(uri)
+	return ok && hostIs(u, "soundcloud.com", "m.soundcloud.com")
+}
+
+func (soundcloudProvider) Validate(uri string) error {
+	if soundcloudIDPattern.MatchString(uri) {
+		return nil
+	}
+	// Links to a track are of the form soundcloud.com/<artist>/<track>.
+	if u, ok := parseHTTPURL(uri); ok && len(strings.Split(strings.Trim(u.Path, "/"), "/")) == 2 {
+		return nil
+	}
+	return fmt.Errorf("%q is not a SoundCloud track", uri)
+}
+
+func (p soundcloudProvider) Normalise(track *Track) {
+	if u, ok := parseHTTPURL(track.URI); ok {
+		track.URI = "https://soundcloud.com/" + strings.ToLower(strings.Trim(u.Path, "/"))
+	}
+	normaliseMetadata(track, p)
+}
+
+// Extensions of audio files that clients can stream directly.
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".m4a":  true,
+	".aac":  true,
+	".ogg":  true,
+	".opus": true,
+	".flac": true,
+	".wav":  true,
+}
+
+// directProvider handles links straight to an audio file.
+type directProvider struct{}
+
+func (directProvider) Name() string {
+	return PROVIDER_DIRECT
+}
+
+func (directProvider) Matches(uri string) bool {
+	_, ok := parseHTTPURL(uri)
+	return ok
+}
+
+func (directProvider) Validate(uri string) error {
+	u, ok := parseHTTPURL(uri)
+	if !ok || u.Host == "" {
+		return fmt.Errorf("%q is not a URL", uri)
+	}
+	if !audioExtensions[strings.ToLower(path.Ext(u.Path))] {
+		return fmt.Errorf("%q is not a supported audio file", uri)
+	}
+	return nil
+}
+
+func (p directProvider) Normalise(track *Track) {
+	// Fall back to the file name if the client didn't name the track.
+	if strings.TrimSpace(track.Name) == "" {
+		if u, ok := parseHTTPURL(track.URI); ok {
+			track.Name = strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+		}
+	}
+	normaliseMetadata(track, p)
+}
@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func TestProviderForURI(t *testing.T) {
+	testCases := []struct {
+		uri  string
+		want string
+	}{
+		{"spotify:track:4uLU6hMCjMI75M1A2tKUQC", PROVIDER_SPOTIFY},
+		{"https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC", PROVIDER_SPOTIFY},
+		{"youtube:dQw4w9WgXcQ", PROVIDER_YOUTUBE},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", PROVIDER_YOUTUBE},
+		{"https://youtu.be/dQw4w9WgXcQ", PROVIDER_YOUTUBE},
+		{"soundcloud:tracks:123", PROVIDER_SOUNDCLOUD},
+		{"https://soundcloud.com/artist/track", PROVIDER_SOUNDCLOUD},
+		{"https://example.com/song.mp3", PROVIDER_DIRECT},
+	}
+
+	for _, tc := range testCases {
+		p, ok := providerForURI(tc.uri)
+		if !ok || p.Name() != tc.want {
+			t.Errorf("providerForURI(%q), got: %v, want: %s", tc.uri, p, tc.want)
+		}
+	}
+}
+
+func TestProviderForURI_Unknown(t *testing.T) {
+	for _, uri := range []string{"", "ftp://example.com/song.mp3", "apple:123"} {
+		if p, ok := providerForURI(uri); ok {
+			t.Errorf("providerForURI(%q), got: %s, want no provider", uri, p.Name())
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		uri   string
+		valid bool
+	}{
+		{"spotify:track:4uLU6hMCjMI75M1A2tKUQC", true},
+		{"spotify:album:4uLU6hMCjMI75M1A2tKUQC", false},
+		{"spotify:track:short", false},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", true},
+		{"https://www.youtube.com/playlist?list=abc", false},
+		{"soundcloud:tracks:123", true},
+		{"https://soundcloud.com/artist", false},
+		{"https://example.com/song.flac", true},
+		{"https://example.com/page.html", false},
+	}
+
+	for _, tc := range testCases {
+		p, _ := providerForURI(tc.uri)
+		err := p.Validate(tc.uri)
+		if (err == nil) != tc.valid {
+			t.Errorf("Validate(%q), got: %v, want valid: %t", tc.uri, err, tc.valid)
+		}
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	testCases := []struct {
+		track Track
+		want  Track
+	}{
+		{
+			Track{URI: "https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC?si=abc", Name: " song ", Artist: "artist "},
+			Track{URI: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", Provider: PROVIDER_SPOTIFY, Name: "song", Artist: "artist"},
+		},
+		{
+			Track{URI: "https://youtu.be/dQw4w9WgXcQ"},
+			Track{URI: "youtube:dQw4w9WgXcQ", Provider: PROVIDER_YOUTUBE},
+		},
+		{
+			Track{URI: "https://SoundCloud.com/Artist/Track/?in=x"},
+			Track{URI: "https://soundcloud.com/artist/track", Provider: PROVIDER_SOUNDCLOUD},
+		},
+		{
+			Track{URI: "https://example.com/music/my%20song.mp3"},
+			Track{URI: "https://example.com/music/my%20song.mp3", Provider: PROVIDER_DIRECT, Name: "my song"},
+		},
+	}
+
+	for _, tc := range testCases {
+		got := tc.track
+		p, _ := providerForURI(got.URI)
+		p.Normalise(&got)
+		if got != tc.want {
+			t.Errorf("Normalise(%#v), got: %#v, want: %#v", tc.track, got, tc.want)
+		}
+	}
+}
+
+func TestParseProviders(t *testing.T) {
+	got, err := parseProviders(" Spotify, youtube,,")
+	if err != nil {
+		t.Fatalf("parseProviders returned error: %s", err)
+	}
+	if len(got) != 2 || got[0] != PROVIDER_SPOTIFY || got[1] != PROVIDER_YOUTUBE {
+		t.Errorf("parseProviders, got: %v, want: [spotify youtube]", got)
+	}
+	if _, err := parseProviders("spotify,tidal"); err == nil {
+		t.Errorf("parseProviders did not return an error for an unknown provider")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// QueueRules limit what members can add to a lobby's queue.
+// A zero limit means there is no limit.
+type QueueRules struct {
+	// Most tracks that can be waiting in the queue.
+	MaxQueueLength int `json:"maxQueueLength"`
+	// Most tracks a single member can have waiting in the queue.
+	MaxPerUser int `json:"maxPerUser"`
+	// Tracks played within this many of the most recent plays can't be added again.
+	RepeatWindow int `json:"repeatWindow"`
+	// Longest track that can be added, in millis.
+	MaxDuration int64 `json:"maxDuration"`
+	// Whether a track can be in the queue more than once.
+	AllowDuplicates bool `json:"allowDuplicates"`
+}
+
+// parseQueueRules reads queue rules from the form values of a create lobby request.
+// Missing values are left unlimited.
+func parseQueueRules(value func(string) string) (QueueRules, error) {
+	rules := QueueRules{}
+	ints := []struct {
+		key string
+		dst *int
+	}{
+		{"maxQueueLength", &rules.MaxQueueLength},
+		{"maxPerUser", &rules.MaxPerUser},
+		{"repeatWindow", &rules.RepeatWindow},
+	}
+	for _, i := range ints {
+		if value(i.key) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value(i.key))
+		if err != nil || n < 0 {
+			return QueueRules{}, fmt.Errorf("%s must be a positive int", i.key)
+		}
+		*i.dst = n
+	}
+	if v := value("maxDuration"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return QueueRules{}, fmt.Errorf("maxDuration must be a positive int")
+		}
+		rules.MaxDuration = n
+	}
+	if v := value("allowDuplicates"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return QueueRules{}, fmt.Errorf("allowDuplicates must be a bool")
+		}
+		rules.AllowDuplicates = allow
+	}
+	return rules, nil
+}
+
+// checkQueueRules returns an error if the user can't add the tracks to the queue.
+// If nothing is playing, the first track is played rather than queued.
+func (l *Lobby) checkQueueRules(username string, tracks []*Track) error {
+	rules := l.Rules
+	queued := len(tracks)
+	if l.CurrentTrack == nil {
+		queued--
+	}
+	if rules.MaxQueueLength > 0 && len(l.TrackQueue)+queued > rules.MaxQueueLength {
+		return fmt.Errorf("the queue is limited to %d tracks", rules.MaxQueueLength)
+	}
+	if rules.MaxPerUser > 0 {
+		userQueued := queued
+		for _, track := range l.TrackQueue {
+			if track.Username == username {
+				userQueued++
+			}
+		}
+		if userQueued > rules.MaxPerUser {
+			return fmt.Errorf("each member can only have %d tracks in the queue", rules.MaxPerUser)
+		}
+	}
+
+	for i, track := range tracks {
+		if rules.MaxDuration > 0 && track.Duration > rules.MaxDuration {
+			return fmt.Errorf("%s is longer than the %d second limit", track.Name, rules.MaxDuration/1000)
+		}
+		if !rules.AllowDuplicates && (l.isQueued(track.URI) || containsURI(tracks[:i], track.URI)) {
+			return fmt.Errorf("%s is already in the queue", track.Name)
+		}
+		if l.playedRecently(track.URI) {
+			return fmt.Errorf("%s was played within the last %d tracks", track.Name, rules.RepeatWindow)
+		}
+	}
+	return nil
+}
+
+// isQueued returns true if the track is in the queue.
+func (l *Lobby) isQueued(uri string) bool {
+	return containsURI(l.TrackQueue, uri)
+}
+
+// playedRecently returns true if the track is within the lobby's repeat window of history.
+// History includes the current track, so it is always counted.
+func (l *Lobby) playedRecently(uri string) bool {
+	if l.Rules.RepeatWindow == 0 {
+		return false
+	}
+	start := len(l.History) - l.Rules.RepeatWindow
+	if start < 0 {
+		start = 0
+	}
+	return containsURI(l.History[start:], uri)
+}
+
+// containsURI returns true if any of the tracks has the URI.
+func containsURI(tracks []*Track, uri string) bool {
+	for _, track := range tracks {
+		if track.URI == uri {
+			return true
+		}
+	}
+	return false
+}
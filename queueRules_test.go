@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseQueueRules(t *testing.T) {
+	testCases := []struct {
+		values  map[string]string
+		want    QueueRules
+		wantErr bool
+	}{
+		{map[string]string{}, QueueRules{}, false},
+		{
+			map[string]string{"maxQueueLength": "20", "maxPerUser": "3", "repeatWindow": "10", "maxDuration": "600000", "allowDuplicates": "true"},
+			QueueRules{MaxQueueLength: 20, MaxPerUser: 3, RepeatWindow: 10, MaxDuration: 600000, AllowDuplicates: true},
+			false,
+		},
+		{map[string]string{"maxPerUser": "-1"}, QueueRules{}, true},
+		{map[string]string{"maxDuration": "long"}, QueueRules{}, true},
+		{map[string]string{"allowDuplicates": "maybe"}, QueueRules{}, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseQueueRules(func(key string) string { return tc.values[key] })
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseQueueRules(%v) incorrect error, got: %v, want error: %t", tc.values, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseQueueRules(%v), got: %+v, want: %+v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestCheckQueueRules(t *testing.T) {
+	playing := &Track{URI: "uri:playing", Name: "playing"}
+	queued := TrackQueue{
+		{URI: "uri:a", Name: "a", Username: "alice"},
+		{URI: "uri:b", Name: "b", Username: "alice"},
+	}
+	history := []*Track{{URI: "uri:old"}, {URI: "uri:recent"}, playing}
+
+	testCases := []struct {
+		name    string
+		rules   QueueRules
+		tracks  []*Track
+		wantErr bool
+	}{
+		{"no rules", QueueRules{AllowDuplicates: true}, []*Track{{URI: "uri:a"}}, false},
+		{"queue full", QueueRules{MaxQueueLength: 2}, []*Track{{URI: "uri:c"}}, true},
+		{"queue has room", QueueRules{MaxQueueLength: 3}, []*Track{{URI: "uri:c"}}, false},
+		{"user quota reached", QueueRules{MaxPerUser: 2}, []*Track{{URI: "uri:c"}}, true},
+		{"too long", QueueRules{MaxDuration: 1000}, []*Track{{URI: "uri:c", Duration: 2000}}, true},
+		{"duplicate of queued", QueueRules{}, []*Track{{URI: "uri:b"}}, true},
+		{"duplicate within import", QueueRules{}, []*Track{{URI: "uri:c"}, {URI: "uri:c"}}, true},
+		{"played recently", QueueRules{RepeatWindow: 2}, []*Track{{URI: "uri:recent"}}, true},
+		{"played outside window", QueueRules{RepeatWindow: 2}, []*Track{{URI: "uri:old"}}, false},
+	}
+
+	for _, tc := range testCases {
+		l := Lobby{CurrentTrack: playing, TrackQueue: queued, History: history, Rules: tc.rules}
+		err := l.checkQueueRules("alice", tc.tracks)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: incorrect result, got: %v, want error: %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckQueueRules_FirstTrackPlays(t *testing.T) {
+	l := Lobby{Rules: QueueRules{MaxQueueLength: 1}}
+	if err := l.checkQueueRules("alice", []*Track{{URI: "uri:a"}, {URI: "uri:b"}}); err != nil {
+		t.Errorf("checkQueueRules counted the track that will be played, got: %s", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The most times a batch of queue changes is tried before it is dropped.
+const MAX_QUEUE_WRITE_ATTEMPTS = 5
+
+// queueChange is a change to a queued track's row in the database that hasn't been written yet.
+// Changes to the same track are merged, so only the latest state of its row is written.
+type queueChange struct {
+	// Details of the track, used to insert its row.
+	track Track
+	// True if the row doesn't exist yet.
+	insert bool
+	remove bool
+	moved  bool
+	rank   float64
+	voted  bool
+	votes  map[string]int
+}
+
+// queueWriter writes changes to a lobby's queue to the database in the order they are made,
+// so older changes never overwrite newer ones. Changes made while a write is in progress are
+// merged, then written together in a single transaction.
+type queueWriter struct {
+	lobbyID string
+	genre   string
+
+	mu      sync.Mutex
+	pending map[int64]*queueChange
+	// True from when a change is made until every change has been written.
+	active bool
+	// Set once the lobby has stopped, after which changes are ignored.
+	stopped bool
+	wake    chan struct{}
+
+	// Writes a batch of changes, decides whether a failed batch is worth retrying,
+	// and waits before retrying it. Replaced in tests.
+	write     func(lobbyID string, genre string, changes map[int64]*queueChange) error
+	retryable func(err error) bool
+	retryWait func(attempt int) time.Duration
+}
+
+// newQueueWriter starts a writer for the queue of a lobby.
+func newQueueWriter(lobbyID string, genre string) *queueWriter {
+	w := &queueWriter{
+		lobbyID:   lobbyID,
+		genre:     genre,
+		pending:   make(map[int64]*queueChange),
+		wake:      make(chan struct{}, 1),
+		write:     writeQueueChanges,
+		retryable: isRetryable,
+		retryWait: backoff,
+	}
+	go w.run()
+	return w
+}
+
+// insert records that the track has been added to the queue.
+func (w *queueWriter) insert(t *Track) {
+	w.add(t.entry, &queueChange{track: *t, insert: true, rank: t.rank})
+}
+
+// move records that the track has been given a new rank.
+func (w *queueWriter) move(t *Track) {
+	w.add(t.entry, &queueChange{moved: true, rank: t.rank})
+}
+
+// setVotes records the votes on the track. The map must not be changed afterwards.
+func (w *queueWriter) setVotes(t *Track, votes map[string]int) {
+	w.add(t.entry, &queueChange{voted: true, votes: votes})
+}
+
+// remove records that the track has left the queue.
+func (w *queueWriter) remove(t *Track) {
+	w.add(t.entry, &queueChange{remove: true})
+}
+
+// add merges a change into the pending changes and wakes the writer.
+// Lobbies without a writer aren't stored, so nothing is recorded.
+func (w *queueWriter) add(entry int64, c *queueChange) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.pending = mergeChanges(w.pending, map[int64]*queueChange{entry: c})
+	// Shutdown waits for the writer while it has changes to write.
+	if !w.active {
+		w.active = true
+		pendingWrites.Add(1)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the writer once it has tried the changes already made.
+func (w *queueWriter) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.wake)
+	}
+}
+
+// run writes pending changes whenever there are any. A batch that fails because of a lost
+// connection or a lock conflict is retried with any newer changes merged into it, up to
+// MAX_QUEUE_WRITE_ATTEMPTS times. Otherwise the batch is dropped, so later changes can be written.
+// Should be called asynchronously.
+func (w *queueWriter) run() {
+	var batch map[int64]*queueChange
+	attempt := 0
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			batch = mergeChanges(batch, w.pending)
+			w.pending = make(map[int64]*queueChange)
+			if len(batch) == 0 {
+				// The writer may be woken again after already writing the change that woke it.
+				if w.active {
+					w.active = false
+					pendingWrites.Done()
+				}
+				w.mu.Unlock()
+				break
+			}
+			w.mu.Unlock()
+
+			if err := timePersist("queue", func() error { return w.write(w.lobbyID, w.genre, batch) }); err != nil {
+				attempt++
+				// A batch that can't be written mustn't hold up the changes after it, or keep shutdown waiting.
+				if !w.retryable(err) || attempt >= MAX_QUEUE_WRITE_ATTEMPTS {
+					w.log().Error("Failed to persist queue, dropping changes", "error", err, "changes", len(batch), "attempts", attempt)
+					batch = nil
+					attempt = 0
+					continue
+				}
+				wait := w.retryWait(attempt - 1)
+				w.log().Error("Failed to persist queue, retrying", "error", err, "changes", len(batch), "attempt", attempt, "wait", wait)
+				time.Sleep(wait)
+				continue
+			}
+			w.log().Debug("Queue changes written to db", "changes", len(batch))
+			batch = nil
+			attempt = 0
+		}
+	}
+}
+
+// mergeChanges applies newer changes on top of older ones that haven't been written, returning the result.
+// A track added and removed again before being written is left out altogether.
+func mergeChanges(older map[int64]*queueChange, newer map[int64]*queueChange) map[int64]*queueChange {
+	if older == nil {
+		return newer
+	}
+	for entry, n := range newer {
+		o, ok := older[entry]
+		if !ok {
+			older[entry] = n
+			continue
+		}
+		if n.remove {
+			if o.insert {
+				delete(older, entry)
+			} else {
+				older[entry] = &queueChange{remove: true}
+			}
+			continue
+		}
+		if n.moved {
+			o.moved = true
+			o.rank = n.rank
+		}
+		if n.voted {
+			o.voted = true
+			o.votes = n.votes
+		}
+	}
+	return older
+}
+
+// log returns a logger that adds the lobby ID to each log.
+func (w *queueWriter) log() *slog.Logger {
+	return log().With("lobby", w.lobbyID)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestMergeChanges(t *testing.T) {
+	votes := map[string]int{"a": 1}
+	pending := map[int64]*queueChange{
+		1: {insert: true, rank: 1},
+		2: {insert: true, rank: 2},
+		3: {moved: true, rank: 3},
+	}
+	pending = mergeChanges(pending, map[int64]*queueChange{
+		1: {moved: true, rank: 0.5},
+		2: {remove: true},
+		3: {remove: true},
+		4: {voted: true, votes: votes},
+	})
+
+	if c := pending[1]; c == nil || !c.insert || c.rank != 0.5 {
+		t.Errorf("Move not merged into pending insert, got: %+v", c)
+	}
+	if _, ok := pending[2]; ok {
+		t.Errorf("Track added and removed before being written was kept")
+	}
+	if c := pending[3]; c == nil || !c.remove || c.moved {
+		t.Errorf("Removal did not replace pending move, got: %+v", c)
+	}
+	if c := pending[4]; c == nil || c.votes["a"] != 1 {
+		t.Errorf("New change not added, got: %+v", c)
+	}
+}
+
+// testQueueWriter returns a writer that records each batch it writes, failing while fail returns true.
+// Failures are treated as retryable.
+func testQueueWriter(fail func() bool) (*queueWriter, *[]map[int64]*queueChange, *sync.Mutex) {
+	var mu sync.Mutex
+	var batches []map[int64]*queueChange
+	w := &queueWriter{
+		pending: make(map[int64]*queueChange),
+		wake:    make(chan struct{}, 1),
+		write: func(lobbyID string, genre string, changes map[int64]*queueChange) error {
+			if fail() {
+				return errors.New("unavailable")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, changes)
+			return nil
+		},
+		retryable: func(error) bool { return true },
+		retryWait: func(int) time.Duration { return time.Millisecond },
+	}
+	go w.run()
+	return w, &batches, &mu
+}
+
+func TestQueueWriter_WritesChanges(t *testing.T) {
+	suppressLogging()
+	w, batches, mu := testQueueWriter(func() bool { return false })
+	track := &Track{URI: "a", entry: 7, rank: 2}
+	w.insert(track)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitFor(ctx, &pendingWrites) {
+		t.Fatalf("Changes not written")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 1 || (*batches)[0][7].track.URI != "a" {
+		t.Errorf("Incorrect batches written, got: %v", *batches)
+	}
+}
+
+func TestQueueWriter_RetriesWithNewerChanges(t *testing.T) {
+	suppressLogging()
+	// Writes fail, and retries wait, until the second change has been made.
+	moved := make(chan struct{})
+	var failures int32
+	w, batches, mu := testQueueWriter(func() bool {
+		select {
+		case <-moved:
+			return false
+		default:
+			atomic.AddInt32(&failures, 1)
+			return true
+		}
+	})
+	w.retryWait = func(int) time.Duration {
+		<-moved
+		return time.Millisecond
+	}
+	track := &Track{URI: "a", entry: 1, rank: 1}
+	w.insert(track)
+	time.Sleep(5 * time.Millisecond)
+	track.rank = 0.5
+	w.move(track)
+	close(moved)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitFor(ctx, &pendingWrites) {
+		t.Fatalf("Changes not written")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if atomic.LoadInt32(&failures) == 0 {
+		t.Fatalf("Write never failed")
+	}
+	if len(*batches) != 1 {
+		t.Fatalf("Incorrect number of batches, got: %d, want: 1", len(*batches))
+	}
+	if c := (*batches)[0][1]; !c.insert || c.rank != 0.5 {
+		t.Errorf("Retried batch does not have the latest rank, got: %+v", c)
+	}
+}
+
+func TestQueueWriter_DropsFailingBatch(t *testing.T) {
+	suppressLogging()
+	testCases := []struct {
+		name      string
+		retryable bool
+		wantCalls int32
+	}{
+		{"not retryable", false, 1},
+		{"retryable", true, MAX_QUEUE_WRITE_ATTEMPTS},
+	}
+
+	for _, tc := range testCases {
+		var calls int32
+		w, batches, mu := testQueueWriter(func() bool {
+			atomic.AddInt32(&calls, 1)
+			return true
+		})
+		w.retryable = func(error) bool { return tc.retryable }
+		w.insert(&Track{URI: "a", entry: 1})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if !waitFor(ctx, &pendingWrites) {
+			t.Fatalf("%s: failing batch kept shutdown waiting", tc.name)
+		}
+		cancel()
+		mu.Lock()
+		if got := atomic.LoadInt32(&calls); got != tc.wantCalls || len(*batches) != 0 {
+			t.Errorf("%s: got %d attempts and %d batches written, want %d attempts", tc.name, got, len(*batches), tc.wantCalls)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestQueueWriter_Stop(t *testing.T) {
+	suppressLogging()
+	w, batches, mu := testQueueWriter(func() bool { return false })
+	w.insert(&Track{URI: "a", entry: 1})
+	w.stop()
+	w.insert(&Track{URI: "b", entry: 2})
+	w.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitFor(ctx, &pendingWrites) {
+		t.Fatalf("Changes made before stopping not written")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, batch := range *batches {
+		if _, ok := batch[2]; ok {
+			t.Errorf("Change made after stopping written")
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("failed to queue track: %w", &mysql.MySQLError{Number: ER_LOCK_DEADLOCK}), true},
+		{fmt.Errorf("failed to begin transaction: %w", driver.ErrBadConn), true},
+		{&mysql.MySQLError{Number: 1406, Message: "Data too long"}, false},
+		{errors.New("failed"), false},
+	}
+
+	for _, tc := range testCases {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("isRetryable(%v), got: %t, want: %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRankQueued_Reranks(t *testing.T) {
+	a := &Track{URI: "a", rank: 1}
+	b := &Track{URI: "b"}
+	c := &Track{URI: "c", rank: 1}
+	l := Lobby{TrackQueue: TrackQueue{a, b, c}}
+
+	l.rankQueued(1)
+	if a.rank != 0 || b.rank != 1 || c.rank != 2 {
+		t.Errorf("Queue not reranked, got: %v %v %v", a.rank, b.rank, c.rank)
+	}
+}
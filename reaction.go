@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reaction that marks a track as liked, counted towards a lobby's most loved tracks.
+// Members can also react with an emoji.
+const REACTION_LIKE = "like"
+
+// The most characters an emoji reaction can contain, allowing for modifiers and joiners.
+const MAX_REACTION_LENGTH = 8
+
+// The most loved tracks listed by default.
+const LOVED_TRACKS_LIMIT = 20
+
+// LovedTrack is a track along with how many times it has been liked.
+type LovedTrack struct {
+	Track *Track `json:"track"`
+	Likes int    `json:"likes"`
+}
+
+// validReaction returns true if the reaction is a like or an emoji.
+func validReaction(reaction string) bool {
+	if reaction == REACTION_LIKE {
+		return true
+	}
+	if reaction == "" || utf8.RuneCountInString(reaction) > MAX_REACTION_LENGTH {
+		return false
+	}
+	symbol := false
+	for _, r := range reaction {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		// Skin tones, joiners and presentation selectors only modify an emoji.
+		case unicode.Is(unicode.Sk, r), r == '\u200d', unicode.Is(unicode.Variation_Selector, r):
+		default:
+			return false
+		}
+	}
+	return symbol
+}
+
+// react toggles the user's reaction to the current track.
+func (l *Lobby) react(username string, reaction string) error {
+	if l.CurrentTrack == nil {
+		return errors.New("nothing is playing")
+	}
+	if !validReaction(reaction) {
+		return fmt.Errorf("%q is not a valid reaction", reaction)
+	}
+
+	// A new map is made, as the counts of the old one may be being sent.
+	reactions := make(map[string]map[string]bool, len(l.Reactions)+1)
+	for r, users := range l.Reactions {
+		reactions[r] = users
+	}
+	users := make(map[string]bool, len(reactions[reaction])+1)
+	for user := range reactions[reaction] {
+		users[user] = true
+	}
+	added := !users[username]
+	if added {
+		users[username] = true
+	} else {
+		delete(users, username)
+	}
+	reactions[reaction] = users
+	l.Reactions = reactions
+	l.persistReaction(l.CurrentTrack, username, reaction, added)
+	return nil
+}
+
+// reactionCounts returns the number of members who gave each reaction to the current track.
+func (l *Lobby) reactionCounts() map[string]int {
+	if len(l.Reactions) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(l.Reactions))
+	for reaction, users := range l.Reactions {
+		if len(users) > 0 {
+			counts[reaction] = len(users)
+		}
+	}
+	return counts
+}
+
+// persistReaction records that a reaction to the current play was given or removed, to be written to the database.
+func (l *Lobby) persistReaction(track *Track, username string, reaction string, added bool) {
+	l.reactionWriter.add(reactionKey{playedAt: l.playedAt, username: username, reaction: reaction}, reactionChange{uri: track.URI, added: added})
+}
+
+// reactionKey identifies a member's reaction to a play of a track.
+type reactionKey struct {
+	playedAt int64
+	username string
+	reaction string
+}
+
+// reactionChange is whether a reaction is given, along with the track it was given to.
+type reactionChange struct {
+	uri   string
+	added bool
+}
+
+// reactionWriter writes reactions to a lobby's plays to the database in the order they are given and
+// removed, so a reaction removed straight after being given is never left stored. Only the latest
+// state of each reaction is written.
+type reactionWriter struct {
+	lobbyID string
+
+	mu      sync.Mutex
+	pending map[reactionKey]reactionChange
+	// True from when a reaction changes until every change has been written.
+	active bool
+	// Set once the lobby has stopped, after which changes are ignored.
+	stopped bool
+	wake    chan struct{}
+
+	// Writes the state of a reaction. Replaced in tests.
+	write func(lobbyID string, key reactionKey, c reactionChange) error
+}
+
+// newReactionWriter starts a writer for the reactions of a lobby.
+func newReactionWriter(lobbyID string) *reactionWriter {
+	w := &reactionWriter{
+		lobbyID: lobbyID,
+		pending: make(map[reactionKey]reactionChange),
+		wake:    make(chan struct{}, 1),
+		write:   writeReaction,
+	}
+	go w.run()
+	return w
+}
+
+// writeReaction inserts or deletes the row of a reaction, depending on whether it is given.
+func writeReaction(lobbyID string, key reactionKey, c reactionChange) error {
+	if c.added {
+		return insertReaction(lobbyID, key.playedAt, c.uri, key.username, key.reaction)
+	}
+	return deleteReaction(lobbyID, key.playedAt, key.username, key.reaction)
+}
+
+// add replaces any pending change to the reaction and wakes the writer.
+// Lobbies without a writer aren't stored, so nothing is recorded.
+func (w *reactionWriter) add(key reactionKey, c reactionChange) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.pending[key] = c
+	// Shutdown waits for the writer while it has changes to write.
+	if !w.active {
+		w.active = true
+		pendingWrites.Add(1)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the writer once it has tried the changes already made.
+func (w *reactionWriter) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.wake)
+	}
+}
+
+// run writes pending changes whenever there are any. A failed write isn't retried, as a reaction
+// is worth less than holding up the ones after it. Should be called asynchronously.
+func (w *reactionWriter) run() {
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			batch := w.pending
+			w.pending = make(map[reactionKey]reactionChange)
+			if len(batch) == 0 {
+				// The writer may be woken again after already writing the change that woke it.
+				if w.active {
+					w.active = false
+					pendingWrites.Done()
+				}
+				w.mu.Unlock()
+				break
+			}
+			w.mu.Unlock()
+
+			for key, c := range batch {
+				if err := timePersist("reaction", func() error { return w.write(w.lobbyID, key, c) }); err != nil {
+					w.log().Error("Failed to persist reaction", "error", err)
+					continue
+				}
+				w.log().Debug("Reaction written to db")
+			}
+		}
+	}
+}
+
+func (w *reactionWriter) log() *slog.Logger {
+	return log().With("lobby", w.lobbyID)
+}
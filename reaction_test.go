@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidReaction(t *testing.T) {
+	testCases := []struct {
+		reaction string
+		want     bool
+	}{
+		{REACTION_LIKE, true},
+		{"🔥", true},
+		{"👍🏽", true},
+		{"❤️", true},
+		{"👨‍👩‍👧", true},
+		{"🇮🇪", true},
+		{"", false},
+		{"love", false},
+		{"^", false},
+		{"🔥🔥🔥🔥🔥🔥🔥🔥🔥", false},
+	}
+
+	for _, tc := range testCases {
+		if got := validReaction(tc.reaction); got != tc.want {
+			t.Errorf("validReaction(%q), got: %t, want: %t", tc.reaction, got, tc.want)
+		}
+	}
+}
+
+func TestReact(t *testing.T) {
+	l := Lobby{CurrentTrack: &Track{URI: "a"}}
+
+	l.react("alice", REACTION_LIKE)
+	l.react("bob", REACTION_LIKE)
+	l.react("bob", "🔥")
+	counts := l.reactionCounts()
+	if counts[REACTION_LIKE] != 2 || counts["🔥"] != 1 {
+		t.Errorf("Incorrect reaction counts, got: %v", counts)
+	}
+
+	// Reacting again removes the reaction.
+	l.react("bob", "🔥")
+	counts = l.reactionCounts()
+	if _, ok := counts["🔥"]; ok {
+		t.Errorf("Reaction not removed, got: %v", counts)
+	}
+}
+
+func TestReact_Rejected(t *testing.T) {
+	l := Lobby{}
+	if err := l.react("alice", REACTION_LIKE); err == nil {
+		t.Errorf("react did not return an error when nothing is playing")
+	}
+	l.CurrentTrack = &Track{URI: "a"}
+	if err := l.react("alice", "meh"); err == nil {
+		t.Errorf("react did not return an error for an invalid reaction")
+	}
+}
+
+func TestSetCurrentTrack_ClearsReactions(t *testing.T) {
+	suppressLogging()
+	l := Lobby{CurrentTrack: &Track{URI: "a"}}
+	l.react("alice", REACTION_LIKE)
+	l.SetCurrentTrack(nil)
+	if counts := l.reactionCounts(); counts != nil {
+		t.Errorf("Reactions not cleared for the next track, got: %v", counts)
+	}
+}
+
+func TestReactionWriter_WritesLatestState(t *testing.T) {
+	suppressLogging()
+	var mu sync.Mutex
+	written := make(map[reactionKey]bool)
+	w := &reactionWriter{
+		pending: make(map[reactionKey]reactionChange),
+		wake:    make(chan struct{}, 1),
+		write: func(lobbyID string, key reactionKey, c reactionChange) error {
+			mu.Lock()
+			defer mu.Unlock()
+			written[key] = c.added
+			return nil
+		},
+	}
+	like := reactionKey{playedAt: 1, username: "a", reaction: REACTION_LIKE}
+	fire := reactionKey{playedAt: 1, username: "a", reaction: "🔥"}
+	// Given and removed before the writer runs, as when a member quickly toggles a reaction.
+	w.add(like, reactionChange{uri: "a", added: true})
+	w.add(like, reactionChange{uri: "a", added: false})
+	w.add(fire, reactionChange{uri: "a", added: true})
+	go w.run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitFor(ctx, &pendingWrites) {
+		t.Fatalf("Reactions not written")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if added, ok := written[like]; !ok || added {
+		t.Errorf("Removed reaction not written as removed, got written: %t, added: %t", ok, added)
+	}
+	if !written[fire] {
+		t.Errorf("Given reaction not written")
+	}
+}
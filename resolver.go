@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The shortest track duration in millis that is accepted from a client.
+// Anything shorter is almost certainly wrong, and would cause the track timer to skip the track straight away.
+const MIN_TRACK_DURATION int64 = 5000
+
+// How long to wait for a remote catalogue to answer a lookup.
+const RESOLVER_TIMEOUT = 3 * time.Second
+
+var errTrackNotFound = errors.New("track not found")
+
+// MetadataResolver looks up the details of tracks in a catalogue.
+type MetadataResolver interface {
+	// Resolve returns the catalogue's details of the track with the provided URI,
+	// or errTrackNotFound if the catalogue doesn't have it.
+	Resolve(uri string) (*Track, error)
+}
+
+// Resolver is used to fill in the details of tracks added by clients. It's used on the lobby goroutine,
+// so must answer from memory. If nil, the details sent by clients are used as long as they are plausible.
+var Resolver MetadataResolver
+
+// RemoteResolver looks up tracks with network calls, such as a provider's API, and should be wrapped with
+// newDBCachingResolver. Lookups are too slow for the lobby goroutine, so tracks are resolved with it before
+// they are sent to the lobby, see resolveRemote. Set from RESOLVER_URL in main, unused if nil.
+var RemoteResolver MetadataResolver
+
+// resolveTrack replaces the details of the track with those from the resolver.
+// Tracks the resolver can't find keep the details sent by the client, provided they are valid.
+func resolveTrack(r MetadataResolver, track *Track) error {
+	if r != nil {
+		resolved, err := r.Resolve(track.URI)
+		if err == nil {
+			track.Name = resolved.Name
+			track.Artist = resolved.Artist
+			track.Duration = resolved.Duration
+			return nil
+		}
+		if err != errTrackNotFound {
+			log().Warn("Failed to resolve track, using client metadata", "track", track.URI, "error", err)
+		}
+	}
+
+	if track.Name == "" {
+		return fmt.Errorf("track %q has no name", track.URI)
+	}
+	if track.Duration < MIN_TRACK_DURATION {
+		return fmt.Errorf("track %q has an invalid duration of %dms", track.URI, track.Duration)
+	}
+	return nil
+}
+
+// resolveRemote fills in the details of tracks from RemoteResolver, off the lobby goroutine. The lobby
+// still checks the tracks when they arrive, keeping the details found here unless its Resolver has others.
+func resolveRemote(tracks ...*Track) {
+	if RemoteResolver == nil {
+		return
+	}
+	for _, track := range tracks {
+		if track == nil {
+			continue
+		}
+		provider, ok := providerForURI(track.URI)
+		if !ok {
+			continue
+		}
+		// Tracks are looked up by the URI the lobby stores them under, which the lobby normalises itself.
+		normalised := *track
+		provider.Normalise(&normalised)
+		resolved, err := RemoteResolver.Resolve(normalised.URI)
+		if err != nil {
+			if err != errTrackNotFound {
+				log().Warn("Failed to resolve track, using client metadata", "track", normalised.URI, "error", err)
+			}
+			continue
+		}
+		track.Name = resolved.Name
+		track.Artist = resolved.Artist
+		track.Duration = resolved.Duration
+	}
+}
+
+// fixtureResolver resolves tracks from a fixed set, for tests and offline use.
+type fixtureResolver struct {
+	tracks map[string]Track
+}
+
+func newFixtureResolver(tracks []Track) *fixtureResolver {
+	r := &fixtureResolver{tracks: make(map[string]Track)}
+	for _, t := range tracks {
+		r.tracks[t.URI] = t
+	}
+	return r
+}
+
+// loadFixtureResolver creates a fixtureResolver from a JSON file containing a list of tracks.
+func loadFixtureResolver(path string) (*fixtureResolver, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %s", err)
+	}
+	var tracks []Track
+	if err := json.Unmarshal(data, &tracks); err != nil {
+		return nil, fmt.Errorf("failed to parse fixtures: %s", err)
+	}
+	return newFixtureResolver(tracks), nil
+}
+
+func (r *fixtureResolver) Resolve(uri string) (*Track, error) {
+	t, ok := r.tracks[uri]
+	if !ok {
+		return nil, errTrackNotFound
+	}
+	return &t, nil
+}
+
+// httpResolver looks up tracks in a catalogue served over HTTP. The track's URI is passed in the uri query
+// parameter, and the catalogue answers with the track as JSON, or 404 if it doesn't have it.
+type httpResolver struct {
+	url string
+}
+
+func newHTTPResolver(url string) *httpResolver {
+	return &httpResolver{url: url}
+}
+
+func (r *httpResolver) Resolve(uri string) (*Track, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RESOLVER_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", r.url+"?uri="+url.QueryEscape(uri), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errTrackNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var track Track
+	if err := json.NewDecoder(resp.Body).Decode(&track); err != nil {
+		return nil, fmt.Errorf("failed to decode track: %s", err)
+	}
+	// Cached under the URI it was asked for, whatever the catalogue calls it.
+	track.URI = uri
+	if provider, ok := providerForURI(uri); ok {
+		track.Provider = provider.Name()
+	}
+	return &track, nil
+}
+
+// cachingResolver caches tracks found by another resolver.
+type cachingResolver struct {
+	next MetadataResolver
+	// Functions used to read and write the cache.
+	lookup func(uri string) (*Track, error)
+	store  func(track *Track) error
+}
+
+// newDBCachingResolver creates a resolver that caches tracks found by next in the track table.
+func newDBCachingResolver(next MetadataResolver) *cachingResolver {
+	return &cachingResolver{
+		next:   next,
+		lookup: selectResolvedTrack,
+		store:  storeResolvedTrack,
+	}
+}
+
+func (r *cachingResolver) Resolve(uri string) (*Track, error) {
+	track, err := r.lookup(uri)
+	if err == nil {
+		return track, nil
+	}
+	if err != errTrackNotFound {
+		log().Error("Failed to read cached track", "track", uri, "error", err)
+	}
+
+	track, err = r.next.Resolve(uri)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.store(track); err != nil {
+		log().Error("Failed to cache track", "track", uri, "error", err)
+	}
+	return track, nil
+}
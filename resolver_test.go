@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testFixtures = newFixtureResolver([]Track{
+	{URI: "spotify:track:1", Name: "Catalogue name", Artist: "Catalogue artist", Duration: 200000},
+})
+
+func TestResolveTrack(t *testing.T) {
+	testCases := []struct {
+		name     string
+		resolver MetadataResolver
+		track    Track
+		want     Track
+		wantErr  bool
+	}{
+		{
+			"resolved track replaces client details",
+			testFixtures,
+			Track{URI: "spotify:track:1", Name: "wrong", Duration: 0},
+			Track{URI: "spotify:track:1", Name: "Catalogue name", Artist: "Catalogue artist", Duration: 200000},
+			false,
+		},
+		{
+			"unknown track keeps valid client details",
+			testFixtures,
+			Track{URI: "spotify:track:2", Name: "client", Duration: 100000},
+			Track{URI: "spotify:track:2", Name: "client", Duration: 100000},
+			false,
+		},
+		{
+			"unknown track with invalid duration",
+			testFixtures,
+			Track{URI: "spotify:track:2", Name: "client", Duration: -1},
+			Track{},
+			true,
+		},
+		{
+			"no resolver and no name",
+			nil,
+			Track{URI: "spotify:track:2", Duration: 100000},
+			Track{},
+			true,
+		},
+	}
+
+	for _, tc := range testCases {
+		got := tc.track
+		err := resolveTrack(tc.resolver, &got)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error: %v, want error: %t", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && got != tc.want {
+			t.Errorf("%s: got: %#v, want: %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLoadFixtureResolver(t *testing.T) {
+	r, err := loadFixtureResolver("testdata/tracks.json")
+	if err != nil {
+		t.Fatalf("loadFixtureResolver returned error: %s", err)
+	}
+	track, err := r.Resolve("youtube:dQw4w9WgXcQ")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %s", err)
+	}
+	if track.Duration != 212000 || track.Artist != "Rick Astley" {
+		t.Errorf("Incorrect fixture track, got: %#v", track)
+	}
+	if _, err := r.Resolve("youtube:missing"); err != errTrackNotFound {
+		t.Errorf("Resolve of missing track, got: %v, want: %v", err, errTrackNotFound)
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	cache := make(map[string]*Track)
+	r := &cachingResolver{
+		next: testFixtures,
+		lookup: func(uri string) (*Track, error) {
+			if t, ok := cache[uri]; ok {
+				return t, nil
+			}
+			return nil, errTrackNotFound
+		},
+		store: func(track *Track) error {
+			cache[track.URI] = track
+			return nil
+		},
+	}
+
+	if _, err := r.Resolve("spotify:track:1"); err != nil {
+		t.Fatalf("Resolve returned error: %s", err)
+	}
+	if _, ok := cache["spotify:track:1"]; !ok {
+		t.Errorf("Resolved track was not cached")
+	}
+	if _, err := r.Resolve("spotify:track:2"); err != errTrackNotFound {
+		t.Errorf("Resolve of unknown track, got: %v, want: %v", err, errTrackNotFound)
+	}
+}
+
+func TestCachingResolver_UsesCache(t *testing.T) {
+	cached := &Track{URI: "spotify:track:9", Name: "cached"}
+	r := &cachingResolver{
+		next:   testFixtures,
+		lookup: func(uri string) (*Track, error) { return cached, nil },
+		store: func(track *Track) error {
+			return errors.New("should not store a cached track")
+		},
+	}
+
+	got, err := r.Resolve("spotify:track:9")
+	if err != nil || got != cached {
+		t.Errorf("Resolve, got: %v, %v, want the cached track", got, err)
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	suppressLogging()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("uri") {
+		case "spotify:track:1":
+			json.NewEncoder(w).Encode(Track{Name: "Catalogue name", Artist: "Catalogue artist", Duration: 200000})
+		case "spotify:track:3":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	r := newHTTPResolver(server.URL)
+
+	track, err := r.Resolve("spotify:track:1")
+	want := Track{URI: "spotify:track:1", Provider: PROVIDER_SPOTIFY, Name: "Catalogue name", Artist: "Catalogue artist", Duration: 200000}
+	if err != nil || *track != want {
+		t.Errorf("Resolve() = %+v, %v; want %+v", track, err, want)
+	}
+	if _, err := r.Resolve("spotify:track:2"); err != errTrackNotFound {
+		t.Errorf("Expected errTrackNotFound for an unknown track, got: %v", err)
+	}
+	if _, err := r.Resolve("spotify:track:3"); err == nil || err == errTrackNotFound {
+		t.Errorf("Expected an error for a failed lookup, got: %v", err)
+	}
+}
+
+func TestResolveRemote(t *testing.T) {
+	defer func() { RemoteResolver = nil }()
+	RemoteResolver = testFixtures
+
+	known := &Track{URI: "https://open.spotify.com/track/1?si=abc", Name: "wrong"}
+	unknown := &Track{URI: "spotify:track:2", Name: "client", Duration: 100000}
+	resolveRemote(known, unknown, nil)
+	if known.Name != "Catalogue name" || known.Duration != 200000 {
+		t.Errorf("Track not resolved by its normalised URI, got: %#v", known)
+	}
+	if known.URI != "https://open.spotify.com/track/1?si=abc" {
+		t.Errorf("URI changed before the lobby checked it, got: %s", known.URI)
+	}
+	if unknown.Name != "client" || unknown.Duration != 100000 {
+		t.Errorf("Unknown track details changed, got: %#v", unknown)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long shutdown waits for clients to be notified and pending writes to finish.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// Sent to clients before their connection is closed for a restart.
+const RESTART_NOTICE = "Server restarting, reconnect in a moment."
+
+// Set once the server has started shutting down, after which joins are rejected.
+var shuttingDown int32
+
+// Database writes that have been started in the background but not finished.
+var pendingWrites sync.WaitGroup
+
+// isShuttingDown returns true if the server has started shutting down.
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// goPersist runs a database write in the background, tracking it so shutdown can wait for it.
+func goPersist(write func()) {
+	pendingWrites.Add(1)
+	go func() {
+		defer pendingWrites.Done()
+		write()
+	}()
+}
+
+// shutdownServer stops accepting joins, records the position of each lobby and tells
+// its clients the server is restarting, then waits for the clients to be closed and
+// pending writes to finish before leaving the cluster and stopping the HTTP server.
+// Anything not finished within the timeout is abandoned.
+func shutdownServer(srv *http.Server, timeout time.Duration) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Lobbies may still be being loaded, in which case there is nothing to close.
+	var closed []<-chan struct{}
+	if loaded, _ := lobbiesLoaded(); loaded {
+		for _, l := range lobbySnapshot() {
+			closed = append(closed, l.shutdown(ctx)...)
+		}
+	}
+	for _, done := range closed {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	if !waitFor(ctx, &pendingWrites) {
+		log().Warn("Timed out waiting for database writes")
+	}
+	// Other nodes can adopt this node's lobbies straight away, rather than once its heartbeat expires.
+	if clustered() {
+		leaveCluster()
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log().Warn("Failed to stop HTTP server cleanly", "error", err)
+	}
+}
+
+// shutdown stops the lobby playing and records how far into the track it is, then tells its
+// clients the server is restarting and closes their connections once the notice is sent.
+// It runs on the lobby goroutine, so nothing else changes the lobby meanwhile.
+// Returns channels that are closed as each connection closes, or none if the context is done first.
+func (l *Lobby) shutdown(ctx context.Context) []<-chan struct{} {
+	var closed []<-chan struct{}
+	ok := l.do(ctx, func() {
+		// Stop the next track being played while the server shuts down.
+		l.stopPlayback()
+		if l.CurrentTrack != nil {
+			position := l.position()
+			l.log().Info("Saving playback position", "track", l.CurrentTrack.URI, "position", position)
+			l.persistPositionAfterTrack(ctx, position)
+		}
+		closed = l.closeClients(RESTART_NOTICE)
+	})
+	if !ok {
+		l.log().Warn("Timed out waiting to shut down lobby")
+		return nil
+	}
+	return closed
+}
+
+// stopPlayback stops the track timer, and the timer that would start it, for good.
+func (l *Lobby) stopPlayback() {
+	atomic.StoreInt32(&l.stopped, 1)
+	if l.trackStart != nil {
+		l.trackStart.Stop()
+	}
+	if l.TrackTimer != nil {
+		l.TrackTimer.Stop()
+	}
+}
+
+// stop stops the lobby for good once it is no longer served by this node. Its goroutine ends, and its
+// writers end once they have tried the changes already made. Must be called on the lobby goroutine.
+func (l *Lobby) stop() {
+	l.stopPlayback()
+	l.queueWriter.stop()
+	l.reactionWriter.stop()
+	close(l.done)
+}
+
+// isStopped returns true if the lobby has stopped playing.
+func (l *Lobby) isStopped() bool {
+	return atomic.LoadInt32(&l.stopped) == 1
+}
+
+// closeClients sends the notice to the lobby's clients, then closes their connections as a restart
+// once it is sent, so they reconnect. Returns channels that are closed as each connection closes.
+func (l *Lobby) closeClients(notice string) []<-chan struct{} {
+	l.sendServerMessage("%s", notice)
+	var closed []<-chan struct{}
+	for _, c := range l.Clients {
+		closed = append(closed, c.CloseAfterSending(websocket.CloseServiceRestart, notice))
+	}
+	for c := range l.Spectators {
+		closed = append(closed, c.CloseAfterSending(websocket.CloseServiceRestart, notice))
+	}
+	return closed
+}
+
+// position returns how far into the current track the lobby is in millis.
+// The track timer starts once clients begin playing, so until then it is the position the track started from.
+func (l *Lobby) position() int64 {
+	if l.TrackTimer == nil {
+		return l.trackOffset
+	}
+	return l.TrackTimer.TimePassed(l.trackOffset)
+}
+
+// persistPositionAfterTrack writes the position of the current track to the database once any writes of
+// the current track in progress have finished, as those reset the position. Playback has stopped, so no
+// more are started. Gives up if the context is done first.
+func (l *Lobby) persistPositionAfterTrack(ctx context.Context, position int64) {
+	if !waitFor(ctx, &l.currentTrackWrites) {
+		l.log().Warn("Timed out waiting for current track to be written, position not saved")
+		return
+	}
+	if err := timePersist("position", func() error { return persistPosition(l.ID, position) }); err != nil {
+		l.log().Error("Failed to persist position", "error", err)
+		return
+	}
+	l.log().Debug("Position written to db")
+}
+
+// waitFor waits for the wait group, returning false if the context is done first.
+func waitFor(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseAfterSending_SendsQueuedMessagesFirst(t *testing.T) {
+	c := &Client{Lobby: &Lobby{}, outboxReady: make(chan struct{}, 1), done: make(chan struct{})}
+	c.Send(Message{UserMsg: "queued"})
+	c.CloseAfterSending(websocket.CloseServiceRestart, RESTART_NOTICE)
+
+	if err := c.Send(Message{UserMsg: "late"}); err != errClientClosed {
+		t.Errorf("Send after closing not rejected, got: %v", err)
+	}
+	if frame := c.closeFrameIfSent(); frame != nil {
+		t.Errorf("Close frame returned before queued message was written")
+	}
+	if _, ok := c.nextOutgoing(); !ok {
+		t.Fatalf("Queued message discarded")
+	}
+	if frame := c.closeFrameIfSent(); frame == nil {
+		t.Errorf("No close frame returned once outbox was empty")
+	}
+}
+
+func TestPosition(t *testing.T) {
+	l := &Lobby{}
+	if got := l.position(); got != 0 {
+		t.Errorf("Position without a track timer, got: %d, want: 0", got)
+	}
+
+	l.TrackTimer = NewMillisTimer(9999999, func() {})
+	defer l.TrackTimer.Stop()
+	replaceTimeNow(testFuture)
+	defer replaceTimeNow(testNow)
+	if got := l.position(); got != 1000 {
+		t.Errorf("Incorrect position, got: %d, want: 1000", got)
+	}
+}
+
+func TestReadyz_ShuttingDown(t *testing.T) {
+	defer func() { pingStorage = pingDB }()
+	pingStorage = func() error { return nil }
+	defer setStartup(true, nil)()
+	atomic.StoreInt32(&shuttingDown, 1)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	rec := httptest.NewRecorder()
+	Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Ready while shutting down, got code: %d", rec.Code)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	var wg sync.WaitGroup
+	if !waitFor(context.Background(), &wg) {
+		t.Errorf("waitFor returned false with nothing to wait for")
+	}
+
+	wg.Add(1)
+	defer wg.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if waitFor(ctx, &wg) {
+		t.Errorf("waitFor returned true before the wait group finished")
+	}
+}
+
+func TestShutdown_StopsPendingTrackStart(t *testing.T) {
+	suppressLogging()
+	l := NewLobby("SHUT", "lobby", FREE_FOR_ALL, "", true, "")
+	l.do(context.Background(), func() {
+		l.playTrack(&Message{}, &Track{URI: "youtube:dQw4w9WgXcQ", Name: "song", Duration: 60000})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l.shutdown(ctx)
+	if !l.isStopped() {
+		t.Errorf("Lobby not stopped")
+	}
+	if l.trackStart.Stop() {
+		t.Errorf("Pending start of the track timer not cancelled")
+	}
+}
+
+func TestShutdown_LobbyBusy(t *testing.T) {
+	suppressLogging()
+	// Nothing runs the lobby's tasks, as if it were stuck handling a message.
+	l := &Lobby{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if closed := l.shutdown(ctx); closed != nil || l.isStopped() {
+		t.Errorf("Busy lobby shut down off its goroutine")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "sync"
+
+// Operations that can be recorded in a StateDiff.
+const (
+	DIFF_QUEUE_INSERT = "queueInsert"
+	DIFF_QUEUE_REMOVE = "queueRemove"
+	DIFF_QUEUE_MOVE   = "queueMove"
+	DIFF_QUEUE_SCORE  = "queueScore"
+	DIFF_MEMBER_JOIN  = "memberJoin"
+	DIFF_MEMBER_LEAVE = "memberLeave"
+	DIFF_ADMIN        = "admin"
+)
+
+// The number of diffs a lobby remembers. Clients that are further behind than this
+// are sent a full snapshot instead.
+const STATE_LOG_SIZE = 100
+
+// StateDiff is a single change to the lobby state.
+type StateDiff struct {
+	// Version of the state after this change was applied.
+	Version uint64 `json:"version"`
+	Op      string `json:"op"`
+	// Position in the queue for queue operations. For a move, the position the track moved from.
+	Index int `json:"index"`
+	// Position the track moved to.
+	To int `json:"to,omitempty"`
+	// Track that was inserted, or whose score changed.
+	Track *Track `json:"track,omitempty"`
+	// Member who joined or left, or the new admin.
+	Username string `json:"username,omitempty"`
+}
+
+// StateLog versions the lobby state and keeps a bounded history of changes to it.
+type StateLog struct {
+	mutex   sync.Mutex
+	version uint64
+	diffs   []StateDiff
+}
+
+// Record assigns the next version to the diff and adds it to the log.
+func (s *StateLog) Record(diff StateDiff) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.version++
+	diff.Version = s.version
+	s.diffs = append(s.diffs, diff)
+	if len(s.diffs) > STATE_LOG_SIZE {
+		s.diffs = s.diffs[len(s.diffs)-STATE_LOG_SIZE:]
+	}
+	return s.version
+}
+
+// Version returns the current state version.
+func (s *StateLog) Version() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.version
+}
+
+// Since returns the diffs needed to bring a client from version from to version to.
+// Returns false if the log no longer holds them, or the client has no state yet,
+// in which case the client needs a full snapshot.
+func (s *StateLog) Since(from uint64, to uint64) ([]StateDiff, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if from == 0 || from > to {
+		return nil, false
+	}
+	var diffs []StateDiff
+	// Check the log goes back far enough.
+	if from < to && (len(s.diffs) == 0 || s.diffs[0].Version > from+1) {
+		return nil, false
+	}
+	for _, diff := range s.diffs {
+		if diff.Version > from && diff.Version <= to {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, true
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestRecord_IncrementsVersion(t *testing.T) {
+	s := StateLog{}
+	s.Record(StateDiff{Op: DIFF_MEMBER_JOIN, Username: "a"})
+	got := s.Record(StateDiff{Op: DIFF_MEMBER_JOIN, Username: "b"})
+	if got != 2 || s.Version() != 2 {
+		t.Errorf("Incorrect version after two diffs, got: %d, want: %d", got, 2)
+	}
+}
+
+func TestSince(t *testing.T) {
+	s := StateLog{}
+	for i := 0; i < 5; i++ {
+		s.Record(StateDiff{Op: DIFF_QUEUE_INSERT, Index: i})
+	}
+
+	testCases := []struct {
+		from      uint64
+		to        uint64
+		wantDiffs int
+		wantOK    bool
+	}{
+		// Partially behind.
+		{2, 5, 3, true},
+		// Up to date.
+		{5, 5, 0, true},
+		// Only up to the version being sent.
+		{1, 3, 2, true},
+		// No state yet.
+		{0, 5, 0, false},
+		// Ahead of the version being sent.
+		{6, 5, 0, false},
+	}
+
+	for _, tc := range testCases {
+		diffs, ok := s.Since(tc.from, tc.to)
+		if ok != tc.wantOK || len(diffs) != tc.wantDiffs {
+			t.Errorf("Since(%d, %d), got: %d diffs, %t, want: %d diffs, %t", tc.from, tc.to, len(diffs), ok, tc.wantDiffs, tc.wantOK)
+		}
+	}
+}
+
+func TestSince_TooFarBehind(t *testing.T) {
+	s := StateLog{}
+	for i := 0; i < STATE_LOG_SIZE+10; i++ {
+		s.Record(StateDiff{Op: DIFF_QUEUE_INSERT, Index: i})
+	}
+
+	if _, ok := s.Since(5, s.Version()); ok {
+		t.Errorf("Since returned diffs that are no longer in the log")
+	}
+	diffs, ok := s.Since(10, s.Version())
+	if !ok || len(diffs) != STATE_LOG_SIZE {
+		t.Errorf("Since oldest logged version, got: %d diffs, %t, want: %d diffs, true", len(diffs), ok, STATE_LOG_SIZE)
+	}
+}
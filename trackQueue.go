@@ -15,3 +15,35 @@ func (q *TrackQueue) Pop() *Track {
 func (q *TrackQueue) IsEmpty() bool {
 	return len(*q) == 0
 }
+
+// Insert returns a copy of the queue with the track inserted at index i.
+// A copy is made as messages being sent may still reference the old queue.
+func (q TrackQueue) Insert(i int, t *Track) TrackQueue {
+	queue := make(TrackQueue, 0, len(q)+1)
+	queue = append(queue, q[:i]...)
+	queue = append(queue, t)
+	return append(queue, q[i:]...)
+}
+
+// rankAt returns a rank for the track at index i that orders it between its neighbours.
+// Returns false if the neighbours' ranks are too close together for one to fit between them.
+func (q TrackQueue) rankAt(i int) (float64, bool) {
+	switch {
+	case len(q) == 1:
+		return 0, true
+	case i == 0:
+		return q[1].rank - 1, true
+	case i == len(q)-1:
+		return q[i-1].rank + 1, true
+	}
+	before, after := q[i-1].rank, q[i+1].rank
+	rank := before + (after-before)/2
+	return rank, before < rank && rank < after
+}
+
+// Remove returns a copy of the queue without the track at index i.
+func (q TrackQueue) Remove(i int) TrackQueue {
+	queue := make(TrackQueue, 0, len(q))
+	queue = append(queue, q[:i]...)
+	return append(queue, q[i+1:]...)
+}
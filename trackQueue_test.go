@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestPush_AddsToQueue(t *testing.T) {
 	q := TrackQueue{}
@@ -67,3 +70,30 @@ func TestIsEmpty_WhenNotEmpty(t *testing.T) {
 		t.Errorf("IsEmpty returned false on empty queue")
 	}
 }
+
+func TestRankAt(t *testing.T) {
+	testCases := []struct {
+		name   string
+		ranks  []float64
+		i      int
+		want   float64
+		wantOk bool
+	}{
+		{"only track", []float64{-1}, 0, 0, true},
+		{"front", []float64{-1, 3, 4}, 0, 2, true},
+		{"back", []float64{3, 4, -1}, 2, 5, true},
+		{"between", []float64{3, -1, 4}, 1, 3.5, true},
+		{"no room", []float64{1, -1, math.Nextafter(1, 2)}, 1, 0, false},
+	}
+
+	for _, tc := range testCases {
+		q := TrackQueue{}
+		for _, rank := range tc.ranks {
+			q.Push(&Track{rank: rank})
+		}
+		got, ok := q.rankAt(tc.i)
+		if ok != tc.wantOk || (ok && got != tc.want) {
+			t.Errorf("%s: got: %v %t, want: %v %t", tc.name, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}